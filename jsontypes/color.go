@@ -0,0 +1,26 @@
+package jsontypes
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrInvalidColor is returned by NormalizeColor for colors not in the #rrggbb
+// format.
+var ErrInvalidColor = errors.New("Invalid color")
+
+// NormalizeColor checks that the color is in the #rrggbb format, the hex
+// digits in any case, and returns it with lowercase digits. This is the format
+// of every color in the messages.
+func NormalizeColor(color string) (string, error) {
+	if len(color) != 7 || color[0] != '#' {
+		return "", fmt.Errorf("%w '%s', expected #rrggbb", ErrInvalidColor, color)
+	}
+	for _, c := range color[1:] {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F') {
+			return "", fmt.Errorf("%w '%s', expected #rrggbb", ErrInvalidColor, color)
+		}
+	}
+	return strings.ToLower(color), nil
+}
@@ -0,0 +1,17 @@
+package jsontypes
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNormalizeColor(t *testing.T) {
+	if c, err := NormalizeColor("#12aBcD"); err != nil || c != "#12abcd" {
+		t.Fatalf("color should be lowercased, got %s, %v", c, err)
+	}
+	for _, color := range []string{"", "red", "#123", "12345678", "#12345g", "#1234567"} {
+		if _, err := NormalizeColor(color); !errors.Is(err, ErrInvalidColor) {
+			t.Fatalf("color '%s' should be invalid, got %v", color, err)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package jsontypes
+
+// Codes of the error messages sent to the clients.
+const (
+	CodeServerFull         = "SERVER_FULL"
+	CodeUnauthorized       = "UNAUTHORIZED"
+	CodeProtocolMismatch   = "PROTOCOL_MISMATCH"
+	CodeNotHost            = "NOT_HOST"
+	CodeBoostUnavailable   = "BOOST_UNAVAILABLE"
+	CodeIllegalMove        = "ILLEGAL_MOVE"
+	CodeRematchUnavailable = "REMATCH_UNAVAILABLE"
+	CodeRoomUnavailable    = "ROOM_UNAVAILABLE"
+	CodeSpectatorsFull     = "SPECTATORS_FULL"
+	CodeInvalidToken       = "INVALID_TOKEN"
+	CodeIdleTimeout        = "IDLE_TIMEOUT"
+	CodeRateLimited        = "RATE_LIMITED"
+	CodeBadMessage         = "BAD_MESSAGE"
+	CodeInvalidFields      = "INVALID_FIELDS"
+	CodeMessageTooLarge    = "MESSAGE_TOO_LARGE"
+	CodeChatTooLong        = "CHAT_TOO_LONG"
+)
+
+// NewError returns the error message with the code, one of the Code
+// constants. The message is optional, it is left out if empty.
+func NewError(code, msg string) ErrorData {
+	return ErrorData{Type: "error", Code: code, Message: msg}
+}
@@ -0,0 +1,26 @@
+package jsontypes
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestNewError(t *testing.T) {
+	codes := []string{CodeServerFull, CodeUnauthorized, CodeProtocolMismatch, CodeNotHost,
+		CodeBoostUnavailable, CodeIllegalMove, CodeRematchUnavailable, CodeRoomUnavailable,
+		CodeSpectatorsFull, CodeInvalidToken, CodeIdleTimeout, CodeRateLimited, CodeBadMessage,
+		CodeInvalidFields, CodeMessageTooLarge, CodeChatTooLong}
+	for _, code := range codes {
+		b, err := json.Marshal(NewError(code, ""))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := `{"type":"error","code":"` + code + `"}`; string(b) != expected {
+			t.Fatalf("expected %s, got %s", expected, b)
+		}
+	}
+	b, _ := json.Marshal(NewError(CodeBadMessage, "unknown type"))
+	if expected := `{"type":"error","code":"BAD_MESSAGE","message":"unknown type"}`; string(b) != expected {
+		t.Fatalf("expected %s, got %s", expected, b)
+	}
+}
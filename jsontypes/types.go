@@ -3,27 +3,302 @@ package jsontypes
 type ColorData struct {
     Type string `json:"type"`
     Color string `json:"color"`
+    PlayerId *int `json:"player_id,omitempty"`
+    Name string `json:"name,omitempty"`
+    Room string `json:"room,omitempty"`
+    Token string `json:"token,omitempty"`
+    Host bool `json:"host,omitempty"`
+    Protocol int `json:"protocol,omitempty"`
+    Features []string `json:"features,omitempty"`
+    Compression string `json:"compression,omitempty"`
+    Framing string `json:"framing,omitempty"`
+    YouAre *Identity `json:"you_are,omitempty"`
 }
 
 type ChatData struct {
     Type string `json:"type"`
     Color string `json:"color"`
+    Name string `json:"name,omitempty"`
     Message string `json:"message"`
+    To string `json:"to,omitempty"`
+    Room string `json:"room,omitempty"`
+    Token string `json:"token,omitempty"`
+    Team *int `json:"team,omitempty"`
+    Mode string `json:"mode,omitempty"`
+}
+
+type ModeData struct {
+    Type string `json:"type"`
+    Mode string `json:"mode"`
+}
+
+type ChatHistory struct {
+    Type string `json:"type"`
+    Messages []ChatData `json:"messages"`
 }
 
 type EventData struct {
     CoordX int `json:"coord_x"`
     CoordY int `json:"coord_y"`
     Direction string `json:"direction"`
+    Boost bool `json:"boost,omitempty"`
 }
 
 type StartGame struct {
     Type string `json:"type"`
     Colors []string `json:"colors"`
+    Names []string `json:"names"`
+    PlayerIds []int `json:"player_ids"`
+    Width int `json:"width"`
+    Height int `json:"height"`
+    Spawns []Spawn `json:"spawns"`
+    Obstacles []Point `json:"obstacles,omitempty"`
+    Teams []TeamMember `json:"teams,omitempty"`
+    Ts *int64 `json:"ts,omitempty"`
+    Mode string `json:"mode,omitempty"`
+}
+
+type TeamMember struct {
+    Color string `json:"color"`
+    Team int `json:"team"`
+}
+
+type Spawn struct {
+    Color string `json:"color"`
+    X int `json:"x"`
+    Y int `json:"y"`
+    Direction string `json:"direction"`
 }
 
 type GameData struct {
     Type string `json:"type"`
     Color string `json:"color"`
+    PlayerId *int `json:"player_id,omitempty"`
     Event EventData `json:"event"`
+    Ts *int64 `json:"ts,omitempty"`
+}
+
+type Events struct {
+    Type string `json:"type"`
+    Tick int `json:"tick"`
+    Events []GameData `json:"events"`
+}
+
+type SimpleData struct {
+    Type string `json:"type"`
+}
+
+type PlayerDead struct {
+    Type string `json:"type"`
+    Color string `json:"color"`
+}
+
+type GameOver struct {
+    Type string `json:"type"`
+    Winner *string `json:"winner"`
+}
+
+type TeamGameOver struct {
+    Type string `json:"type"`
+    WinningTeam *int `json:"winning_team"`
+}
+
+type ErrorData struct {
+    Type string `json:"type"`
+    Code string `json:"code"`
+    Message string `json:"message,omitempty"`
+}
+
+type RoomEntry struct {
+    Id string `json:"id"`
+    Players int `json:"players"`
+    Phase string `json:"phase"`
+    Joinable bool `json:"joinable"`
+}
+
+type RoomList struct {
+    Type string `json:"type"`
+    Rooms []RoomEntry `json:"rooms"`
+}
+
+type RoomData struct {
+    Type string `json:"type"`
+    Room string `json:"room"`
+}
+
+type Score struct {
+    Color string `json:"color"`
+    Name string `json:"name,omitempty"`
+    Wins int `json:"wins"`
+}
+
+type Scoreboard struct {
+    Type string `json:"type"`
+    Scores []Score `json:"scores"`
+}
+
+type Countdown struct {
+    Type string `json:"type"`
+    Seconds int `json:"seconds"`
+}
+
+type LobbyPlayer struct {
+    Color string `json:"color"`
+    Name string `json:"name,omitempty"`
+    Ready bool `json:"ready"`
+    Team *int `json:"team,omitempty"`
+    IsSelf bool `json:"is_self,omitempty"`
+}
+
+type Identity struct {
+    Color string `json:"color"`
+    PlayerId int `json:"player_id"`
+    Name string `json:"name,omitempty"`
+}
+
+type LobbyUpdate struct {
+    Type string `json:"type"`
+    Players []LobbyPlayer `json:"players"`
+    Waiting []string `json:"waiting"`
+    Mode string `json:"mode,omitempty"`
+}
+
+type Auth struct {
+    Type string `json:"type"`
+    Token string `json:"token"`
+}
+
+type Hello struct {
+    Type string `json:"type"`
+    Protocol *int `json:"protocol,omitempty"`
+    Features []string `json:"features,omitempty"`
+}
+
+type ReplayEvent struct {
+    Tick int `json:"tick"`
+    Color string `json:"color,omitempty"`
+    Direction string `json:"direction,omitempty"`
+    Boost bool `json:"boost,omitempty"`
+    PowerUp *PowerUpSpawn `json:"powerup,omitempty"`
+}
+
+type Replay struct {
+    Room string `json:"room"`
+    Start StartGame `json:"start_game"`
+    Events []ReplayEvent `json:"events"`
+    Ticks int `json:"ticks"`
+    Winner *string `json:"winner"`
+    TickInterval int `json:"tick_interval,omitempty"`
+}
+
+type CarState struct {
+    Color string `json:"color"`
+    X int `json:"x"`
+    Y int `json:"y"`
+    Direction string `json:"direction"`
+    Alive bool `json:"alive"`
+    Trail []Point `json:"trail"`
+}
+
+type State struct {
+    Type string `json:"type"`
+    Tick int `json:"tick"`
+    Cars []CarState `json:"cars"`
+}
+
+type Tick struct {
+    Type string `json:"type"`
+    N int `json:"n"`
+    Ts *int64 `json:"ts,omitempty"`
+}
+
+type Boost struct {
+    Type string `json:"type"`
+    Color string `json:"color"`
+    Active bool `json:"active"`
+}
+
+type Point struct {
+    X int `json:"x"`
+    Y int `json:"y"`
+}
+
+type PowerUpSpawn struct {
+    Type string `json:"type"`
+    Id int `json:"id"`
+    Kind string `json:"kind"`
+    X int `json:"x"`
+    Y int `json:"y"`
+}
+
+type Bounds struct {
+    X int `json:"x"`
+    Y int `json:"y"`
+    Width int `json:"width"`
+    Height int `json:"height"`
+}
+
+type Shrink struct {
+    Type string `json:"type"`
+    Bounds Bounds `json:"bounds"`
+}
+
+type AdminCommand struct {
+    Type string `json:"type"`
+    Message string `json:"message,omitempty"`
+    Color string `json:"color,omitempty"`
+    Room *string `json:"room,omitempty"`
+}
+
+type AdminStats struct {
+    Type string `json:"type"`
+    Uptime int64 `json:"uptime"`
+    Clients int `json:"clients"`
+    Rooms []RoomEntry `json:"rooms"`
+}
+
+type Announcement struct {
+    Type string `json:"type"`
+    Message string `json:"message"`
+}
+
+type Matched struct {
+    Type string `json:"type"`
+    Room string `json:"room"`
+    Players []string `json:"players"`
+}
+
+type Motd struct {
+    Type string `json:"type"`
+    Message string `json:"message"`
+}
+
+type TrailExpire struct {
+    Type string `json:"type"`
+    Color string `json:"color"`
+    X int `json:"x"`
+    Y int `json:"y"`
+}
+
+type PowerUpCollected struct {
+    Type string `json:"type"`
+    Id int `json:"id"`
+    Color string `json:"color"`
+}
+
+type Latency struct {
+    Type string `json:"type"`
+    Color string `json:"color"`
+    Ms int64 `json:"ms"`
+}
+
+type AutoStart struct {
+    Type string `json:"type"`
+    Seconds int `json:"seconds"`
+}
+
+type PlayerLeft struct {
+    Type string `json:"type"`
+    Color string `json:"color"`
+    Reason string `json:"reason"`
 }
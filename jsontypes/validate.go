@@ -0,0 +1,52 @@
+package jsontypes
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ErrInvalidFields is returned by Decode for messages with unknown fields,
+// fields of the wrong type, or missing required fields.
+var ErrInvalidFields = errors.New("Invalid fields")
+
+// required contains the fields every message of a type has to contain, with
+// a value other than null or an empty string.
+var required = map[string][]string{
+	"chat":         {"message"},
+	"set_name":     {"name"},
+	"set_team":     {"team"},
+	"set_mode":     {"mode"},
+	"reconnect":    {"token"},
+	"join_room":    {"room"},
+	"kick":         {"color"},
+	"auth":         {"token"},
+	"player_event": {"event"},
+}
+
+// Decode decodes an incoming message strictly into v. Syntax errors are
+// returned as they are, messages with fields v does not know, or without the
+// fields required by their type are refused with an error wrapping
+// ErrInvalidFields.
+func Decode(msg []byte, v interface{}) error {
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(msg, &fields); err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(msg))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidFields, err.Error())
+	}
+
+	var msgType string
+	json.Unmarshal(fields["type"], &msgType)
+	for _, name := range required[msgType] {
+		value := string(bytes.TrimSpace(fields[name]))
+		if value == "" || value == "null" || value == `""` {
+			return fmt.Errorf("%w: missing field '%s' in %s message", ErrInvalidFields, name, msgType)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package jsontypes
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	chat := &ChatData{}
+	if err := Decode([]byte(`{"type":"chat","message":"hi"}`), chat); err != nil {
+		t.Fatalf("valid message refused: %v", err)
+	}
+	if chat.Message != "hi" {
+		t.Fatal("message should be decoded")
+	}
+
+	invalid := []string{
+		`{"type":"chat"}`,
+		`{"type":"chat","message":""}`,
+		`{"type":"chat","message":"hi","mood":"happy"}`,
+		`{"type":"chat","message":42}`,
+	}
+	for _, msg := range invalid {
+		if err := Decode([]byte(msg), &ChatData{}); !errors.Is(err, ErrInvalidFields) {
+			t.Fatalf("message %s should have invalid fields, got %v", msg, err)
+		}
+	}
+
+	if err := Decode([]byte(`{"type":`), &ChatData{}); err == nil || errors.Is(err, ErrInvalidFields) {
+		t.Fatalf("malformed message should be a syntax error, got %v", err)
+	}
+}
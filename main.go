@@ -1,9 +1,22 @@
 package main
 
-import "github.com/tron_server/server"
+import (
+    "context"
+    "fmt"
+    "github.com/tron_server/server"
+    "os"
+    "os/signal"
+)
 
 
 func main() {
+    // shut down cleanly on Ctrl+C
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+    defer stop()
+
     s := server.Create()
-    s.Start("8765")
+    if err := s.StartContext(ctx, "8765"); err != nil {
+        fmt.Println(err.Error())
+        os.Exit(1)
+    }
 }
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/tron_server/jsontypes"
+	"net"
+	"time"
+)
+
+// adminRequest is a command of the admin listener, handled by the broker.
+type adminRequest struct {
+	command jsontypes.AdminCommand
+	reply   chan interface{}
+}
+
+// startAdmin starts the admin listener if Config.AdminAddr is set. Addresses
+// without a host are bound to localhost, so operators are not reachable from
+// other machines by default.
+func (s *Server) startAdmin() error {
+	if s.cfg.AdminAddr == "" {
+		return nil
+	}
+	addr := s.cfg.AdminAddr
+	if host, port, err := net.SplitHostPort(addr); err == nil && host == "" {
+		addr = net.JoinHostPort("127.0.0.1", port)
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s.adminListener = l
+	s.log.Info("Start hosting admin listener", "addr", addr)
+	go s.acceptAdmin(l)
+	return nil
+}
+
+// acceptAdmin serves the connections of the admin listener until it is
+// closed.
+func (s *Server) acceptAdmin(l net.Listener) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			s.log.Info("Stop admin listener", "err", err)
+			return
+		}
+		go s.serveAdmin(c)
+	}
+}
+
+// serveAdmin reads the commands of an admin connection, one JSON message per
+// line, passes them to the broker, and writes back the responses.
+func (s *Server) serveAdmin(c net.Conn) {
+	defer c.Close()
+	s.log.Info("Admin connected", "addr", c.RemoteAddr().String())
+	scanner := bufio.NewScanner(c)
+	for scanner.Scan() {
+		var response interface{}
+		command := jsontypes.AdminCommand{}
+		if err := jsontypes.Decode(scanner.Bytes(), &command); err != nil {
+			response = jsontypes.NewError(jsontypes.CodeBadMessage, err.Error())
+		} else {
+			req := adminRequest{command: command, reply: make(chan interface{}, 1)}
+			select {
+			case s.adminCmds <- req:
+				response = <-req.reply
+			case <-s.done:
+				return
+			}
+		}
+		m, ok := s.encode(response)
+		if !ok {
+			return
+		}
+		if send(c, m) != nil {
+			return
+		}
+	}
+}
+
+// handleAdmin runs the admin command and returns the response.
+func (s *Server) handleAdmin(command jsontypes.AdminCommand) interface{} {
+	s.log.Info("Admin command", "type", command.Type)
+	switch command.Type {
+	case "shutdown":
+		s.shutdown()
+		return jsontypes.SimpleData{Type: "ok"}
+	case "stats":
+		stats := jsontypes.AdminStats{Type: "stats", Uptime: time.Since(s.startTime).Milliseconds(),
+			Clients: len(s.clients), Rooms: make([]jsontypes.RoomEntry, 0, len(s.rooms))}
+		for _, info := range s.roomInfos() {
+			stats.Rooms = append(stats.Rooms, jsontypes.RoomEntry{Id: info.Id, Players: info.Players,
+				Phase: info.Phase, Joinable: info.Joinable})
+		}
+		return stats
+	case "broadcast":
+		if command.Message == "" {
+			return jsontypes.NewError(jsontypes.CodeBadMessage, "message is missing")
+		}
+		if m, ok := s.encode(jsontypes.Announcement{Type: "broadcast", Message: command.Message}); ok {
+			s.handleBroadcast(m)
+		}
+		return jsontypes.SimpleData{Type: "ok"}
+	case "kick":
+		if command.Room == nil {
+			return jsontypes.NewError(jsontypes.CodeBadMessage, "room is missing")
+		}
+		var target *client
+		if r, ok := s.rooms[*command.Room]; ok {
+			target = r.playerByColor(command.Color)
+		}
+		if target == nil {
+			return jsontypes.NewError(jsontypes.CodeBadMessage, "no player with the color in the room")
+		}
+		s.log.Info("Kicking player", "color", target.color, "room", *command.Room)
+		if !target.disconnected {
+			s.sendMessage(target.conn, jsontypes.SimpleData{Type: "kicked"})
+		}
+		// like a leave, the car of the player crashes
+		s.cancelCountdown(target.room)
+		s.playerLeft(target, "kicked")
+		s.expel(target)
+		return jsontypes.SimpleData{Type: "ok"}
+	default:
+		return jsontypes.NewError(jsontypes.CodeBadMessage, fmt.Sprintf("unknown command '%s'", command.Type))
+	}
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/tron_server/jsontypes"
+	"net"
+	"testing"
+	"time"
+)
+
+// adminCommand sends the command over the admin connection and decodes the
+// response into v.
+func adminCommand(t *testing.T, c net.Conn, reader *bufio.Reader, command string, v interface{}) {
+	c.Write([]byte(command + "\n"))
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		t.Fatalf("No response to %s: %s", command, err.Error())
+	}
+	if err := json.Unmarshal(line, v); err != nil {
+		t.Fatalf("Invalid response to %s: %s", command, line)
+	}
+}
+
+// dialAdmin connects to the admin listener on addr. It retries for a while,
+// since the server might not be listening yet.
+func dialAdmin(t *testing.T, addr string) net.Conn {
+	var admin net.Conn
+	var err error
+	for i := 0; i < 50; i++ {
+		if admin, err = net.Dial("tcp", addr); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("Cannot connect to the admin listener: %s", err.Error())
+	}
+	admin.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return admin
+}
+
+func TestAdmin(t *testing.T) {
+	const port = "8836"
+	s := startServerWithConfig(t, port, Config{AdminAddr: ":8837"})
+	conn := dial(t, port)
+	defer conn.Close()
+	player := bufio.NewReader(conn)
+	connect := &jsontypes.ColorData{}
+	receiveType(t, player, "connect", connect)
+	other := dial(t, port)
+	defer other.Close()
+	receiveType(t, bufio.NewReader(other), "connect", &jsontypes.ColorData{})
+
+	admin := dialAdmin(t, "127.0.0.1:8837")
+	defer admin.Close()
+	reader := bufio.NewReader(admin)
+
+	stats := &jsontypes.AdminStats{}
+	adminCommand(t, admin, reader, `{"type":"stats"}`, stats)
+	if stats.Type != "stats" || stats.Clients != 2 || len(stats.Rooms) != 1 {
+		t.Fatalf("Unexpected stats %+v", stats)
+	}
+
+	ok := &jsontypes.SimpleData{}
+	adminCommand(t, admin, reader, `{"type":"broadcast","message":"restart"}`, ok)
+	if ok.Type != "ok" {
+		t.Fatalf("Broadcast should succeed, got %s", ok.Type)
+	}
+	announcement := &jsontypes.Announcement{}
+	receiveType(t, player, "broadcast", announcement)
+	if announcement.Message != "restart" {
+		t.Fatalf("Unexpected broadcast %+v", announcement)
+	}
+
+	errorData := &jsontypes.ErrorData{}
+	adminCommand(t, admin, reader, `{"type":"kick","color":"`+connect.Color+`"}`, errorData)
+	if errorData.Code != "BAD_MESSAGE" {
+		t.Fatalf("Kick without a room should fail, got %+v", errorData)
+	}
+	errorData = &jsontypes.ErrorData{}
+	adminCommand(t, admin, reader, `{"type":"kick","room":"abc","color":"`+connect.Color+`"}`, errorData)
+	if errorData.Code != "BAD_MESSAGE" {
+		t.Fatalf("Kick in another room should fail, got %+v", errorData)
+	}
+	adminCommand(t, admin, reader, `{"type":"kick","room":"","color":"`+connect.Color+`"}`, ok)
+	if ok.Type != "ok" {
+		t.Fatalf("Kick should succeed, got %s", ok.Type)
+	}
+	receiveType(t, player, "kicked", &jsontypes.SimpleData{})
+	errorData = &jsontypes.ErrorData{}
+	adminCommand(t, admin, reader, `{"type":"kick","room":"","color":"#123456"}`, errorData)
+	if errorData.Code != "BAD_MESSAGE" {
+		t.Fatalf("Kick of an unknown color should fail, got %+v", errorData)
+	}
+
+	adminCommand(t, admin, reader, `{"type":"shutdown"}`, ok)
+	select {
+	case <-s.done:
+	case <-time.After(time.Second):
+		t.Fatal("Server should shut down")
+	}
+}
+
+func TestAdminKickInGame(t *testing.T) {
+	const port = "8856"
+	startServerWithConfig(t, port, Config{AdminAddr: ":8857", CountdownSeconds: -1})
+	conn1, _, conn2, reader2 := startTwoPlayerGame(t, port)
+	defer conn1.Close()
+	defer conn2.Close()
+	sendMessage(t, conn1, `{"type":"start"}`)
+	receiveType(t, reader2, "tick", &jsontypes.Tick{})
+	admin := dialAdmin(t, "127.0.0.1:8857")
+	defer admin.Close()
+	reader := bufio.NewReader(admin)
+
+	ok := &jsontypes.SimpleData{}
+	adminCommand(t, admin, reader, `{"type":"kick","room":"game-1","color":"#ff0000"}`, ok)
+	if ok.Type != "ok" {
+		t.Fatalf("Kick should succeed, got %s", ok.Type)
+	}
+	left := &jsontypes.PlayerLeft{}
+	receiveType(t, reader2, "player_left", left)
+	if left.Color != "#ff0000" || left.Reason != "kicked" {
+		t.Fatalf("Unexpected player left %+v", left)
+	}
+	dead := &jsontypes.PlayerDead{}
+	receiveType(t, reader2, "player_dead", dead)
+	if dead.Color != "#ff0000" {
+		t.Fatalf("Car of the kicked player should crash, got %+v", dead)
+	}
+	receiveType(t, reader2, "game_over", &jsontypes.GameOver{})
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"github.com/tron_server/jsontypes"
+	"net"
+	"time"
+)
+
+// Authenticator decides whether a client may join the server, see
+// Config.Authenticator. It is called from the goroutine of the connection, so
+// it may block, but it has to be safe for concurrent use.
+type Authenticator interface {
+	// Authenticate tells whether the token sent by the client is valid.
+	Authenticate(token string) bool
+}
+
+// SharedSecret returns an authenticator which accepts the clients sending the
+// given secret as their token.
+func SharedSecret(secret string) Authenticator {
+	return sharedSecret(secret)
+}
+
+type sharedSecret string
+
+func (s sharedSecret) Authenticate(token string) bool {
+	return subtle.ConstantTimeCompare([]byte(s), []byte(token)) == 1
+}
+
+// admit passes the new connection to the broker. If authentication is
+// configured, the client has to authenticate first, connections of clients
+// failing to do so are closed.
+func (s *Server) admit(c net.Conn) {
+	if s.cfg.Authenticator != nil {
+		var ok bool
+		if c, ok = s.authenticate(c); !ok {
+			c.Close()
+			return
+		}
+	}
+	select {
+	case s.conns <- c:
+	case <-s.done:
+		c.Close()
+	}
+}
+
+// authenticate waits for the auth message of the client, and checks its
+// token. Clients sending something else, an invalid token, or nothing within
+// the auth timeout are refused. The connection to use afterwards is returned,
+// since messages following the auth message might have been read already.
+func (s *Server) authenticate(c net.Conn) (net.Conn, bool) {
+	addr := c.RemoteAddr().String()
+	c.SetReadDeadline(time.Now().Add(s.cfg.AuthTimeout))
+	reader := bufio.NewReaderSize(c, s.cfg.MaxMessageSize)
+	line, err := reader.ReadSlice('\n')
+	if err != nil {
+		s.log.Info("Client did not authenticate", "addr", addr, "err", err)
+		s.replyError(c, jsontypes.CodeUnauthorized)
+		return c, false
+	}
+	auth := &jsontypes.Auth{}
+	if err := jsontypes.Decode(line, auth); err != nil || auth.Type != "auth" {
+		s.log.Warn("Malformed auth message", "addr", addr, "err", err)
+		s.replyError(c, jsontypes.CodeUnauthorized)
+		return c, false
+	}
+	if !s.cfg.Authenticator.Authenticate(auth.Token) {
+		s.log.Warn("Invalid auth token", "addr", addr)
+		s.replyError(c, jsontypes.CodeUnauthorized)
+		return c, false
+	}
+	s.log.Info("Client authenticated", "addr", addr)
+	return &bufferedConn{Conn: c, reader: reader}, true
+}
+
+// bufferedConn is a connection partly read into a buffer already. Reading
+// returns the buffered data first.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/tron_server/jsontypes"
+	"time"
+)
+
+// autoStartWarning is the time before the automatic start of a game when the
+// players are warned.
+const autoStartWarning = 5 * time.Second
+
+// autoStartEvent is sent to the broker when the lobby of a room waited long
+// enough for its players.
+type autoStartEvent struct {
+	room    *room
+	gen     int  // number of the wait the event belongs to
+	warning bool // the game is about to be started, but not yet
+}
+
+// armAutoStart starts the wait of the room for its players, if automatic
+// starts are enabled. A wait already running is replaced.
+func (s *Server) armAutoStart(r *room) {
+	wait := s.cfg.AutoStartWait
+	if wait <= 0 {
+		return
+	}
+	r.autoStarts++
+	warnAt := wait - autoStartWarning
+	if warnAt < 0 {
+		warnAt = 0
+	}
+	s.log.Info("Waiting for players", "room", r.id, "wait", wait)
+	for _, e := range []autoStartEvent{{room: r, gen: r.autoStarts, warning: true}, {room: r, gen: r.autoStarts}} {
+		e := e
+		d := wait
+		if e.warning {
+			d = warnAt
+		}
+		time.AfterFunc(d, func() {
+			select {
+			case s.autoStarts <- e:
+			case <-s.done:
+			}
+		})
+	}
+}
+
+// handleAutoStart warns the players of the room about the automatic start, or
+// fills the room with bots and starts the game. The room must still be in the
+// lobby it waited in, with at least one player who is not a bot, and the server
+// must not be draining.
+func (s *Server) handleAutoStart(e autoStartEvent) {
+	r := e.room
+	if s.rooms[r.id] != r || r.phase != phaseLobby || r.autoStarts != e.gen || r.bots() == len(r.players) ||
+		s.draining {
+		return
+	}
+	if e.warning {
+		remaining := s.cfg.AutoStartWait
+		if remaining > autoStartWarning {
+			remaining = autoStartWarning
+		}
+		warning := jsontypes.AutoStart{Type: "auto_start", Seconds: int(remaining.Seconds())}
+		jsonByte, err := json.Marshal(warning)
+		if err != nil {
+			s.log.Error("Could not produce auto start json", "err", err)
+			return
+		}
+		r.sendAllClients(string(jsonByte), -1)
+		return
+	}
+	for len(r.players) < s.cfg.MinPlayers {
+		if _, err := s.addBot(r); err != nil {
+			s.log.Info("Cannot start game automatically", "room", r.id, "err", err)
+			return
+		}
+	}
+	s.log.Info("Starting game automatically", "room", r.id)
+	for _, p := range r.players {
+		p.ready = true
+	}
+	s.maybeStart(r)
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/tron_server/jsontypes"
+)
+
+// relayEvent delivers the player event to the room, except to the player with
+// except_id. If events are batched, the event is queued for the next tick
+// instead, and every player gets it then.
+func (s *Server) relayEvent(r *room, event jsontypes.GameData, except_id int) {
+	event.Ts = s.timestamp(r)
+	if s.cfg.BatchEvents {
+		r.events = append(r.events, event)
+		return
+	}
+	if m, ok := s.encode(event); ok {
+		r.sendAllClients(m, except_id)
+	}
+}
+
+// flushEvents sends the events queued since the last tick in one message, and
+// clears the queue. Nothing is sent if no event was queued.
+func (s *Server) flushEvents(r *room) {
+	if len(r.events) == 0 {
+		return
+	}
+	events := jsontypes.Events{Type: "events", Tick: r.game.ticks, Events: r.events}
+	r.events = nil
+	jsonByte, err := json.Marshal(events)
+	if err != nil {
+		s.log.Error("Could not produce events json", "err", err)
+		return
+	}
+	r.sendAllClients(string(jsonByte), -1)
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"fmt"
+	"github.com/tron_server/jsontypes"
+	"net"
+	"time"
+)
+
+// botLookahead is the number of cells a bot checks in each direction.
+const botLookahead = 10
+
+// turns contains the directions a car may turn to, reversing is not an option.
+var turns = map[string][]string{
+	"up":    {"left", "right"},
+	"down":  {"right", "left"},
+	"left":  {"down", "up"},
+	"right": {"up", "down"},
+}
+
+// handleAddBot adds a bot to the room of the host.
+func (s *Server) handleAddBot(host *client) {
+	r := host.room
+	if host != r.host {
+		s.log.Warn("Bot added by player who is not the host", "color", host.color, "room", r.id)
+		s.sendError(host.conn, jsontypes.CodeNotHost, "")
+		return
+	}
+	if _, err := s.addBot(r); err != nil {
+		s.log.Info("Cannot add bot", "room", r.id, "err", err)
+		s.sendError(host.conn, jsontypes.CodeRoomUnavailable, err.Error())
+		return
+	}
+	s.maybeStart(r)
+}
+
+// addBot adds a bot to the room. Bots are always ready, and they are removed
+// from the room when the game is over.
+func (s *Server) addBot(r *room) (*client, error) {
+	if r.bots() >= s.cfg.MaxBots {
+		return nil, fmt.Errorf("At most %d bots are allowed", s.cfg.MaxBots)
+	}
+	b := &client{id: s.ids, conn: discardConn{}, token: newToken(), bot: true,
+		name: fmt.Sprintf("bot-%d", r.bots()+1)}
+	s.ids++
+	if err := r.subscribe(b); err != nil {
+		return nil, err
+	}
+	b.ready = true
+	s.welcome(b)
+	r.sendLobbyUpdate(-1)
+	return b, nil
+}
+
+// moveBots lets the bots of the room turn before the next step of the game.
+// Their turns are announced like the ones of the players.
+func (s *Server) moveBots(r *room) {
+	for _, p := range r.players {
+		if !p.bot {
+			continue
+		}
+		c := r.game.cars[p.id]
+		if c == nil || !c.alive {
+			continue
+		}
+		dir := r.game.botDirection(c)
+		if dir == c.dir {
+			continue
+		}
+		if err := r.game.turn(p.id, dir); err != nil {
+			continue
+		}
+		r.recordTurn(p, dir)
+		event := jsontypes.GameData{Type: "player_event", Color: p.color, PlayerId: &p.id,
+			Event: jsontypes.EventData{CoordX: c.pos.x, CoordY: c.pos.y, Direction: dir}}
+		s.relayEvent(r, event, p.id)
+	}
+}
+
+// removeBots removes the bots from the room.
+func (s *Server) removeBots(r *room) {
+	for _, p := range append([]*client(nil), r.players...) {
+		if p.bot {
+			r.unsubscribe(p)
+		}
+	}
+}
+
+// botDirection chooses the direction of the car with the most free cells
+// ahead. The car keeps its direction unless turning is better.
+func (g *game) botDirection(c *car) string {
+	best, bestFree := c.dir, g.freeCells(c.pos, c.dir)
+	for _, dir := range turns[c.dir] {
+		if free := g.freeCells(c.pos, dir); free > bestFree {
+			best, bestFree = dir, free
+		}
+	}
+	return best
+}
+
+// freeCells counts the free cells from the position in the direction, up to
+// the lookahead of bots.
+func (g *game) freeCells(pos point, dir string) int {
+	d := directions[dir]
+	n := 0
+	for p := (point{pos.x + d.x, pos.y + d.y}); n < botLookahead; p = (point{p.x + d.x, p.y + d.y}) {
+		if _, occupied := g.grid[p]; occupied || !g.inside(p) {
+			break
+		}
+		n++
+	}
+	return n
+}
+
+// discardConn is the connection of bots. Messages written to it are dropped.
+type discardConn struct{}
+
+func (discardConn) Read(b []byte) (int, error)         { return 0, net.ErrClosed }
+func (discardConn) Write(b []byte) (int, error)        { return len(b), nil }
+func (discardConn) Close() error                       { return nil }
+func (discardConn) LocalAddr() net.Addr                { return botAddr{} }
+func (discardConn) RemoteAddr() net.Addr               { return botAddr{} }
+func (discardConn) SetDeadline(t time.Time) error      { return nil }
+func (discardConn) SetReadDeadline(t time.Time) error  { return nil }
+func (discardConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type botAddr struct{}
+
+func (botAddr) Network() string { return "bot" }
+func (botAddr) String() string  { return "bot" }
@@ -0,0 +1,35 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// Broadcast sends a message to every connected client, e.g. to announce a
+// restart. The message is marshalled to JSON, an error is returned if that
+// fails or the server is not running. The message is sent by the broker, so
+// Broadcast is safe to call from any goroutine, but like Stats, it must not be
+// called from an EventHandler.
+func (s *Server) Broadcast(msg interface{}) error {
+	if !s.started.IsSet() {
+		return errors.New("Server is not started")
+	}
+	jsonByte, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	select {
+	case s.broadcasts <- string(jsonByte):
+		return nil
+	case <-s.done:
+		return errors.New("Server is stopped")
+	}
+}
+
+// handleBroadcast sends the message to every connected client.
+func (s *Server) handleBroadcast(m string) {
+	s.log.Info("Broadcasting message", "clients", len(s.clients))
+	for _, p := range s.clients {
+		s.write(p.conn, m)
+	}
+}
@@ -0,0 +1,29 @@
+package server
+
+import (
+	"github.com/tron_server/jsontypes"
+)
+
+// recordChat keeps the chat message in the history of the room. Only the last
+// Config.ChatHistory messages are kept.
+func (r *room) recordChat(chat jsontypes.ChatData) {
+	size := r.server.cfg.ChatHistory
+	if size == 0 {
+		return
+	}
+	if len(r.chats) == size {
+		// drop the oldest message
+		copy(r.chats, r.chats[1:])
+		r.chats = r.chats[:size-1]
+	}
+	r.chats = append(r.chats, chat)
+}
+
+// sendChatHistory sends the chat messages of the room before the player
+// joined, if there are any.
+func (s *Server) sendChatHistory(p *client) {
+	if len(p.room.chats) == 0 {
+		return
+	}
+	s.sendMessage(p.conn, jsontypes.ChatHistory{Type: "chat_history", Messages: p.room.chats})
+}
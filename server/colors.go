@@ -0,0 +1,133 @@
+package server
+
+import (
+	"fmt"
+	"github.com/tron_server/jsontypes"
+)
+
+// ColorProvider gives the colors of the cars, see Config.Colors. Every room
+// asks for the colors in order, starting from 0, so the provider must return a
+// distinct color for every n. Colors must be in the #rrggbb format, they are
+// lowercased by the server.
+type ColorProvider interface {
+	// Color returns the n-th color handed out in a room.
+	Color(n int) string
+}
+
+// generatedColors is the default color provider. The hues of the generated
+// colors are spread evenly on the color wheel: first red, green and blue,
+// then the hues halfway between the already used ones, and so on.
+type generatedColors struct{}
+
+func (generatedColors) Color(n int) string {
+	return hueToHex(generatedHue(n))
+}
+
+// Palette is a color provider handing out its colors in order. When the
+// palette runs out, generated colors not in the palette are handed out.
+type Palette []string
+
+func (p Palette) Color(n int) string {
+	if n < len(p) {
+		return p[n]
+	}
+	n -= len(p)
+	for i := 0; ; i++ {
+		c := generatedColors{}.Color(i)
+		if p.contains(c) {
+			continue
+		}
+		if n == 0 {
+			return c
+		}
+		n--
+	}
+}
+
+func (p Palette) contains(color string) bool {
+	for _, c := range p {
+		if c == color {
+			return true
+		}
+	}
+	return false
+}
+
+// colorGenerator produces distinct car colors on demand.
+type colorGenerator struct {
+	n        int
+	provider ColorProvider // nil means generated colors
+}
+
+func (g *colorGenerator) next() string {
+	if g.provider == nil {
+		g.provider = generatedColors{}
+	}
+	c := g.provider.Color(g.n)
+	g.n++
+	if normalized, err := jsontypes.NormalizeColor(c); err == nil {
+		// invalid colors are refused by validateColors already
+		c = normalized
+	}
+	return c
+}
+
+// validateColors checks the first n colors of the provider, the most a room
+// can hand out. They must be valid and distinct, also when lowercased.
+func validateColors(provider ColorProvider, n int) error {
+	seen := make(map[string]bool, n)
+	for i := 0; i < n; i++ {
+		c, err := jsontypes.NormalizeColor(provider.Color(i))
+		if err != nil {
+			return fmt.Errorf("Color %d of the color provider: %w", i, err)
+		}
+		if seen[c] {
+			return fmt.Errorf("Color %d of the color provider is handed out twice: %s", i, c)
+		}
+		seen[c] = true
+	}
+	return nil
+}
+
+// generatedHue returns the hue of the n-th generated color in degrees.
+func generatedHue(n int) float64 {
+	if n < 3 {
+		return float64(n) * 120
+	}
+	// level k adds count new hues between the ones of the previous levels
+	n -= 3
+	count := 3
+	step := 120.0
+	for n >= count {
+		n -= count
+		count *= 2
+		step /= 2
+	}
+	return step/2 + float64(n)*step
+}
+
+// hueToHex converts a fully saturated, full brightness color of the given hue
+// to the #rrggbb format.
+func hueToHex(hue float64) string {
+	h := hue / 60
+	sector := int(h) % 6
+	f := h - float64(int(h))
+	up := int(f*255 + 0.5)
+	down := 255 - up
+	var r, g, b int
+	switch sector {
+	case 0:
+		r, g, b = 255, up, 0
+	case 1:
+		r, g, b = down, 255, 0
+	case 2:
+		r, g, b = 0, 255, up
+	case 3:
+		r, g, b = 0, down, 255
+	case 4:
+		r, g, b = up, 0, 255
+	default:
+		r, g, b = 255, 0, down
+	}
+	return fmt.Sprintf("#%02x%02x%02x", r, g, b)
+}
@@ -0,0 +1,39 @@
+package server
+
+import "testing"
+
+func TestColorGeneratorDistinct(t *testing.T) {
+	g := colorGenerator{}
+	expected := []string{"#ff0000", "#00ff00", "#0000ff", "#ffff00", "#00ffff", "#ff00ff"}
+	for _, e := range expected {
+		if c := g.next(); c != e {
+			t.Fatalf("expected color %s, got %s", e, c)
+		}
+	}
+	seen := make(map[string]bool)
+	g = colorGenerator{}
+	for i := 0; i < 48; i++ {
+		c := g.next()
+		if seen[c] {
+			t.Fatalf("color %s generated twice", c)
+		}
+		seen[c] = true
+	}
+}
+
+func TestPalette(t *testing.T) {
+	g := colorGenerator{provider: Palette{"#123456", "#00ff00"}}
+	expected := []string{"#123456", "#00ff00", "#ff0000", "#0000ff"}
+	for _, e := range expected {
+		if c := g.next(); c != e {
+			t.Fatalf("expected color %s, got %s", e, c)
+		}
+	}
+}
+
+func TestColorGeneratorNormalizes(t *testing.T) {
+	g := colorGenerator{provider: Palette{"#ABCDEF"}}
+	if c := g.next(); c != "#abcdef" {
+		t.Fatalf("color should be lowercased, got %s", c)
+	}
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"compress/flate"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// Compression modes of the connections, see Config.Compression.
+const (
+	NoCompression    = ""
+	FlateCompression = "flate"
+)
+
+// flateConn is a connection compressed with flate in both directions. The
+// messages keep their newline delimited framing inside the compressed stream.
+// Every Write is flushed, so the client can decompress each message as soon
+// as it arrives.
+type flateConn struct {
+	net.Conn
+	reader  io.ReadCloser
+	writer  *flate.Writer
+	writeMu sync.Mutex
+}
+
+func newFlateConn(c net.Conn) *flateConn {
+	// the level is valid, so no error can be returned
+	w, _ := flate.NewWriter(c, flate.BestSpeed)
+	return &flateConn{Conn: c, reader: flate.NewReader(c), writer: w}
+}
+
+func (c *flateConn) Read(b []byte) (int, error) {
+	n, err := c.reader.Read(b)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		// clients close the connection without finishing the stream
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (c *flateConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	n, err := c.writer.Write(b)
+	if err != nil {
+		return n, err
+	}
+	return n, c.writer.Flush()
+}
@@ -0,0 +1,497 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	defaultMaxPlayers   = 8
+	defaultMinPlayers   = 2
+	defaultTickInterval = 50 * time.Millisecond
+	defaultGracePeriod  = 10 * time.Second
+	defaultReadTimeout  = 30 * time.Second
+	defaultPingInterval = 10 * time.Second
+	defaultMissedPongs  = 3
+	defaultMessageRate  = 60
+	defaultMessageSize  = 64 * 1024
+	defaultChatLength   = 500
+	defaultChatRate     = 5
+	defaultWidth        = 100
+	defaultHeight       = 100
+	defaultCountdown    = 3
+	defaultMaxBots      = 3
+	defaultAuthTimeout  = 10 * time.Second
+	defaultRematchWait  = 30 * time.Second
+	defaultQueueSize    = 256
+	defaultWriteTimeout = 10 * time.Second
+	defaultMatchSize    = 2
+	defaultMatchWait    = 30 * time.Second
+)
+
+// minMapSize is the minimum width and height of the map.
+const minMapSize = 10
+
+// Config contains the settings of the server. The zero value of every field
+// means the default setting.
+type Config struct {
+	// MaxPlayers is the maximum number of players in a room. New
+	// connections are rejected while the default room is full, and players
+	// cannot join full rooms. See MaxConnections for a limit of the whole
+	// server. Default is 8.
+	MaxPlayers int
+
+	// MinPlayers is the number of players needed to start a game, e.g. 1
+	// for practicing alone. Default is 2.
+	MinPlayers int
+
+	// TickInterval is the time elapsing between two ticks of the game.
+	// Default is 50ms.
+	TickInterval time.Duration
+
+	// ReconnectGracePeriod is the time the slot of a disconnected player
+	// is kept for reconnecting. Default is 10s.
+	ReconnectGracePeriod time.Duration
+
+	// ReadTimeout is the time a client may stay silent. Clients who do not
+	// send a message within the timeout are disconnected. Default is 30s.
+	ReadTimeout time.Duration
+
+	// PingInterval is the time between two pings sent to the clients.
+	// Default is 10s.
+	PingInterval time.Duration
+
+	// MaxMissedPongs is the number of pings in a row a client may leave
+	// unanswered before it is disconnected. Default is 3.
+	MaxMissedPongs int
+
+	// MessageRate is the number of messages per second a client may send.
+	// Messages over the limit are dropped. Default is 60.
+	MessageRate int
+
+	// MaxChatLength is the maximum length of a chat message in characters.
+	// Longer messages are refused. Default is 500.
+	MaxChatLength int
+
+	// ChatRate is the number of chat messages per second a client may
+	// send, in addition to MessageRate. Chat messages over the limit are
+	// refused. Default is 5.
+	ChatRate int
+
+	// MaxMessageSize is the maximum length of a message in bytes,
+	// including the newline, or excluding the length prefix of
+	// length-prefixed framing. Clients sending larger messages are
+	// disconnected. Default is 64KB.
+	MaxMessageSize int
+
+	// Width and Height are the size of the map in cells. Default is
+	// 100x100.
+	Width  int
+	Height int
+
+	// CountdownSeconds is the length of the countdown before the game
+	// starts. Default is 3, negative values disable the countdown.
+	CountdownSeconds int
+
+	// Logger receives the log messages of the server. Connects and
+	// disconnects are logged at info level, malformed messages at warn
+	// level, internal errors at error level and the ticker at debug level.
+	// Default logs at info level to the standard output.
+	Logger *slog.Logger
+
+	// Trace logs every message sent and received, with the address of the
+	// connection and the direction, for debugging clients. Messages are
+	// logged at LevelTrace. Tracing is verbose and slows the server down.
+	// Default is false.
+	Trace bool
+
+	// TraceFile is the file the traced messages are appended to, in JSON
+	// lines. Default is empty, the messages are logged with the Logger.
+	TraceFile string
+
+	// ChatFilter is applied to every chat message before it is delivered,
+	// e.g. to mask offensive words, see MaskWords. Default leaves the
+	// messages unchanged.
+	ChatFilter func(string) string
+
+	// ReplayDir is the directory the replays of the finished games are
+	// written to. Default is not writing replays, the last one is still
+	// available from LastReplay.
+	ReplayDir string
+
+	// MaxBots is the maximum number of bots in a room. Default is 3,
+	// negative values disable bots.
+	MaxBots int
+
+	// ObstacleLayout is the layout of the obstacles on the map:
+	// NoObstacles, RandomObstacles, or one of the presets CrossObstacles
+	// and PillarsObstacles. Default is no obstacles.
+	ObstacleLayout string
+
+	// ObstacleSeed is the seed of the random obstacle layout, so the layout
+	// is the same in every game. Default is 0, the layout is drawn like
+	// the rest of the randomness, see Seed.
+	ObstacleSeed int64
+
+	// Seed is the seed of all randomness of the games, e.g. the random
+	// obstacle layouts and the power-up spawns, so a server started with
+	// the same seed plays the same matches given the same inputs. Default
+	// is 0, seeded from the time.
+	Seed int64
+
+	// PowerUpInterval is the number of ticks between the spawns of two
+	// power-ups. Default is no power-ups.
+	PowerUpInterval int
+
+	// Modes are the game modes the hosts may choose from, by name, in
+	// addition to the built-in ones: classic, powerups, arena, fading and
+	// sudden_death. A mode with the name of a built-in one replaces it.
+	// Default is only the built-in modes.
+	Modes map[string]GameMode
+
+	// PowerUpKinds are the kinds of power-ups spawned: SpeedPowerUp,
+	// InvinciblePowerUp and ClearPowerUp. Default is all of them.
+	PowerUpKinds []string
+
+	// Events is notified about connects, disconnects, games and chat
+	// messages. Default is nil, no notifications.
+	Events EventHandler
+
+	// Colors gives the colors of the cars in every room, e.g. a Palette
+	// for a custom set of colors. Default generates colors with hues spread
+	// evenly on the color wheel. Providers handing out invalid or
+	// duplicate colors are refused.
+	Colors ColorProvider
+
+	// LobbyIdleTimeout is the time the server waits for a message while no
+	// game is running. When it elapses, the clients are told and the server
+	// shuts down. Default is 0, waiting forever.
+	LobbyIdleTimeout time.Duration
+
+	// AutoStartWait is the time a lobby waits for its players to get
+	// ready. When it elapses, the lobby is filled with bots up to
+	// MinPlayers, and the game is started. The wait starts when the first
+	// player joins the lobby, and again after every game. Default is 0,
+	// waiting until everyone is ready.
+	AutoStartWait time.Duration
+
+	// Compression is the compression mode of the TCP connections:
+	// NoCompression or FlateCompression. The mode is told to the clients in
+	// the connect message. Default is no compression.
+	Compression string
+
+	// Framing is the framing of the messages on the TCP connections:
+	// NewlineFraming or LengthPrefixedFraming. The framing is told to the
+	// clients in the connect message. Default is newline framing.
+	Framing string
+
+	// BatchEvents makes the server collect the player events arriving
+	// between two ticks, and send them in one message with the next tick,
+	// instead of relaying every event right away. It saves messages, but
+	// delays the events until the next tick. Default is false.
+	BatchEvents bool
+
+	// Timestamps adds the time elapsed since the start of the game, in
+	// milliseconds, to the tick, player_event and start_game messages, so
+	// clients can compensate for the latency. Default is false.
+	Timestamps bool
+
+	// Authenticator checks the token clients have to send in an auth
+	// message before they join, e.g. SharedSecret. Default is nil,
+	// clients join without authentication.
+	Authenticator Authenticator
+
+	// Teams is the number of teams in team games. Default is 0, no teams,
+	// every player for itself.
+	Teams int
+
+	// RematchTimeout is the time the players have to ask for a rematch
+	// after a game. Players who do not ask for it are moved to the default
+	// room. Default is 30s.
+	RematchTimeout time.Duration
+
+	// LatencyInterval is the minimum time between two announcements of the
+	// round trip time of a player in the lobby. Default is 0, no
+	// announcements. The round trip times are reported by Stats anyway.
+	LatencyInterval time.Duration
+
+	// AuthTimeout is the time a client has to authenticate. Default is
+	// 10s.
+	AuthTimeout time.Duration
+
+	// MaxConnections is the maximum number of open connections, including
+	// connections still authenticating. Further connections are refused
+	// with the error SERVER_FULL. Default is 0, no limit.
+	MaxConnections int
+
+	// MaxGameDuration is the time after which games are decided in sudden
+	// death, the map shrinking until the cars crash. Default is 0, no
+	// sudden death.
+	MaxGameDuration time.Duration
+
+	// ShrinkInterval is the number of ticks between two shrinks of the map
+	// in sudden death. Default is 1.
+	ShrinkInterval int
+
+	// MaxSpectators is the maximum number of spectators on the server.
+	// Default is 0, no limit.
+	MaxSpectators int
+
+	// MaxSpectatorsPerIP is the maximum number of spectators connected from
+	// the same IP address. Default is 0, no limit.
+	MaxSpectatorsPerIP int
+
+	// AdminAddr is the address of the admin listener, which accepts the
+	// commands of operators, see the package documentation. Addresses
+	// without a host, like ":8766", are bound to localhost. Default is
+	// empty, no admin listener.
+	AdminAddr string
+
+	// MatchSize is the number of players of a quick match. Default is 2.
+	MatchSize int
+
+	// MatchTimeout is the time the first player in the quick match queue
+	// waits for a full match. When it elapses, the players queued are
+	// matched anyway. Default is 30s.
+	MatchTimeout time.Duration
+
+	// ShutdownWhenEmpty makes the server shut down when the last player
+	// left and all rooms are closed, e.g. for a server hosting a single
+	// game. Default is false, the server runs until it is stopped.
+	ShutdownWhenEmpty bool
+
+	// SendQueueSize is the number of messages queued for a client which
+	// are not written yet. Messages are written to the clients in the
+	// background, so a slow client does not stall the server. Clients whose
+	// queue is full are disconnected. Default is 256.
+	SendQueueSize int
+
+	// SendQueuePolicy tells what happens when the send queue of a client is
+	// full: DisconnectPolicy disconnects the client, DropPolicy drops the
+	// oldest message which is superseded by later ones, e.g. a tick. Clients
+	// are still disconnected if only critical messages are queued. Messages
+	// of compressed connections are never dropped. Default is
+	// DisconnectPolicy.
+	SendQueuePolicy string
+
+	// WriteTimeout is the time writing a message to a client may take.
+	// Clients exceeding it are disconnected. Default is 10s.
+	WriteTimeout time.Duration
+
+	// ChatHistory is the number of chat messages kept per room. Players
+	// joining a room get the messages kept. The history is cleared when the
+	// room is closed. Default is 0, no history is kept.
+	ChatHistory int
+
+	// AllowedOrigins are the origins of the web pages whose browsers may
+	// open WebSocket connections, e.g. "https://example.com". "*" allows
+	// every origin. Connections of other origins are refused with 403
+	// Forbidden. Default is empty, only pages served from the host of the
+	// WebSocket server are allowed.
+	AllowedOrigins []string
+
+	// MOTD is the message of the day, sent to every new client right after
+	// its connect message. Default is empty, no message.
+	MOTD string
+
+	// TrailTTL is the number of ticks after which the cells of the trails
+	// are removed from the map. Default is 0, trails never expire.
+	TrailTTL int
+}
+
+// withDefaults returns a copy of the config with the unset values replaced
+// with the defaults.
+func (cfg Config) withDefaults() Config {
+	if cfg.MaxPlayers == 0 {
+		cfg.MaxPlayers = defaultMaxPlayers
+	}
+	if cfg.MinPlayers == 0 {
+		cfg.MinPlayers = defaultMinPlayers
+	}
+	if cfg.TickInterval == 0 {
+		cfg.TickInterval = defaultTickInterval
+	}
+	if cfg.ReconnectGracePeriod == 0 {
+		cfg.ReconnectGracePeriod = defaultGracePeriod
+	}
+	if cfg.ShrinkInterval == 0 {
+		cfg.ShrinkInterval = 1
+	}
+	if cfg.ReadTimeout == 0 {
+		cfg.ReadTimeout = defaultReadTimeout
+	}
+	if cfg.PingInterval == 0 {
+		cfg.PingInterval = defaultPingInterval
+	}
+	if cfg.MaxMissedPongs == 0 {
+		cfg.MaxMissedPongs = defaultMissedPongs
+	}
+	if cfg.MessageRate == 0 {
+		cfg.MessageRate = defaultMessageRate
+	}
+	if cfg.MaxMessageSize == 0 {
+		cfg.MaxMessageSize = defaultMessageSize
+	}
+	if cfg.MaxChatLength == 0 {
+		cfg.MaxChatLength = defaultChatLength
+	}
+	if cfg.ChatRate == 0 {
+		cfg.ChatRate = defaultChatRate
+	}
+	if cfg.Width == 0 {
+		cfg.Width = defaultWidth
+	}
+	if cfg.Height == 0 {
+		cfg.Height = defaultHeight
+	}
+	if cfg.CountdownSeconds == 0 {
+		cfg.CountdownSeconds = defaultCountdown
+	}
+	if cfg.RematchTimeout == 0 {
+		cfg.RematchTimeout = defaultRematchWait
+	}
+	if cfg.SendQueueSize == 0 {
+		cfg.SendQueueSize = defaultQueueSize
+	}
+	if cfg.WriteTimeout == 0 {
+		cfg.WriteTimeout = defaultWriteTimeout
+	}
+	if cfg.MatchSize == 0 {
+		cfg.MatchSize = defaultMatchSize
+	}
+	if cfg.MatchTimeout == 0 {
+		cfg.MatchTimeout = defaultMatchWait
+	}
+	if cfg.AuthTimeout == 0 {
+		cfg.AuthTimeout = defaultAuthTimeout
+	}
+	if cfg.MaxBots == 0 {
+		cfg.MaxBots = defaultMaxBots
+	}
+	if cfg.PowerUpKinds == nil {
+		cfg.PowerUpKinds = []string{SpeedPowerUp, InvinciblePowerUp, ClearPowerUp}
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = slog.New(slog.NewTextHandler(os.Stdout, nil))
+	}
+	if cfg.Events == nil {
+		cfg.Events = noEvents{}
+	}
+	if cfg.ChatFilter == nil {
+		cfg.ChatFilter = func(message string) string { return message }
+	}
+	return cfg
+}
+
+// validate checks the configuration with the defaults applied.
+func (cfg Config) validate() error {
+	if cfg.MaxPlayers < 2 {
+		return errors.New("MaxPlayers must be at least 2")
+	}
+	if cfg.Teams < 0 || cfg.Teams == 1 || cfg.Teams > cfg.MaxPlayers {
+		return errors.New("Teams must be 0, or between 2 and MaxPlayers")
+	}
+	if cfg.MinPlayers < 0 || cfg.MatchSize < 0 {
+		return errors.New("MinPlayers and MatchSize must not be negative")
+	}
+	if cfg.TickInterval < 0 || cfg.PingInterval < 0 || cfg.ShrinkInterval < 0 || cfg.PowerUpInterval < 0 {
+		return errors.New("Intervals must not be negative")
+	}
+	if cfg.ReadTimeout < 0 || cfg.WriteTimeout < 0 || cfg.AuthTimeout < 0 || cfg.ReconnectGracePeriod < 0 ||
+		cfg.RematchTimeout < 0 || cfg.MatchTimeout < 0 {
+		return errors.New("Timeouts must not be negative")
+	}
+	if cfg.MaxMissedPongs < 0 || cfg.MessageRate < 0 || cfg.ChatRate < 0 || cfg.MaxMessageSize < 0 ||
+		cfg.MaxChatLength < 0 || cfg.SendQueueSize < 0 {
+		return errors.New("Limits of the clients must not be negative")
+	}
+	if cfg.MaxGameDuration < 0 {
+		return errors.New("MaxGameDuration must not be negative")
+	}
+	if cfg.MaxSpectators < 0 || cfg.MaxSpectatorsPerIP < 0 {
+		return errors.New("Spectator limits must not be negative")
+	}
+	if cfg.MaxConnections < 0 {
+		return errors.New("MaxConnections must not be negative")
+	}
+	if cfg.TrailTTL < 0 {
+		return errors.New("TrailTTL must not be negative")
+	}
+	if cfg.ChatHistory < 0 {
+		return errors.New("ChatHistory must not be negative")
+	}
+	if cfg.MatchSize > cfg.MaxPlayers {
+		return errors.New("MatchSize must not be more than MaxPlayers")
+	}
+	if cfg.MinPlayers > cfg.MaxPlayers {
+		return errors.New("MinPlayers must not be more than MaxPlayers")
+	}
+	if cfg.Width < minMapSize || cfg.Height < minMapSize {
+		return fmt.Errorf("Map must be at least %dx%d cells", minMapSize, minMapSize)
+	}
+	if cfg.MaxPlayers >= cfg.Height {
+		return errors.New("Map is too small for MaxPlayers, every player needs its own row")
+	}
+	if cfg.Colors != nil {
+		if err := validateColors(cfg.Colors, cfg.MaxPlayers); err != nil {
+			return err
+		}
+	}
+	switch cfg.ObstacleLayout {
+	case NoObstacles, RandomObstacles, CrossObstacles, PillarsObstacles:
+	default:
+		return fmt.Errorf("Unknown obstacle layout '%s'", cfg.ObstacleLayout)
+	}
+	switch cfg.Compression {
+	case NoCompression, FlateCompression:
+	default:
+		return fmt.Errorf("Unknown compression '%s'", cfg.Compression)
+	}
+	for name, m := range cfg.Modes {
+		if err := m.validate(name); err != nil {
+			return err
+		}
+	}
+	switch cfg.SendQueuePolicy {
+	case DisconnectPolicy, DropPolicy:
+	default:
+		return fmt.Errorf("Unknown send queue policy '%s'", cfg.SendQueuePolicy)
+	}
+	switch cfg.Framing {
+	case NewlineFraming, LengthPrefixedFraming:
+	default:
+		return fmt.Errorf("Unknown framing '%s'", cfg.Framing)
+	}
+	for _, kind := range cfg.PowerUpKinds {
+		switch kind {
+		case SpeedPowerUp, InvinciblePowerUp, ClearPowerUp:
+		default:
+			return fmt.Errorf("Unknown power-up kind '%s'", kind)
+		}
+	}
+	return nil
+}
+
+// MaskWords returns a chat filter which replaces the given words with
+// asterisks. Words are matched case-insensitively, and only as whole words.
+func MaskWords(words []string) func(string) string {
+	if len(words) == 0 {
+		return func(message string) string { return message }
+	}
+	quoted := make([]string, len(words))
+	for i, w := range words {
+		quoted[i] = regexp.QuoteMeta(w)
+	}
+	re := regexp.MustCompile(`(?i)\b(` + strings.Join(quoted, "|") + `)\b`)
+	return func(message string) string {
+		return re.ReplaceAllStringFunc(message, func(w string) string {
+			return strings.Repeat("*", utf8.RuneCountInString(w))
+		})
+	}
+}
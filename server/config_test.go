@@ -0,0 +1,87 @@
+package server
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigDefaults(t *testing.T) {
+	cfg := Config{}.withDefaults()
+	if cfg.MaxPlayers != defaultMaxPlayers {
+		t.Errorf("expected default max players, got %d", cfg.MaxPlayers)
+	}
+	if cfg.TickInterval != defaultTickInterval {
+		t.Errorf("expected default tick interval, got %s", cfg.TickInterval)
+	}
+
+	cfg = Config{TickInterval: 500 * time.Millisecond}.withDefaults()
+	if cfg.TickInterval != 500*time.Millisecond {
+		t.Errorf("configured tick interval should be kept, got %s", cfg.TickInterval)
+	}
+}
+
+func TestConfigLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelWarn}))
+	s, _ := CreateWithConfig(Config{Logger: logger})
+	s.joinRoom(&client{}, defaultRoom)
+	s.handleMessage(msgFormat{42, `{"type":"chat"}`})
+
+	if strings.Contains(buf.String(), "Client subscribed") {
+		t.Errorf("info messages should be filtered, got %s", buf.String())
+	}
+	if !strings.Contains(buf.String(), "Player not found") {
+		t.Errorf("warning should be logged, got %s", buf.String())
+	}
+}
+
+func TestMaskWords(t *testing.T) {
+	filter := MaskWords([]string{"darn", "heck"})
+	if m := filter("Darn it, what the heck, darnit"); m != "**** it, what the ****, darnit" {
+		t.Errorf("unexpected filtered message: %s", m)
+	}
+	if m := MaskWords(nil)("darn"); m != "darn" {
+		t.Errorf("empty word list should not filter, got %s", m)
+	}
+}
+
+func TestConfigValidation(t *testing.T) {
+	if _, err := CreateWithConfig(Config{}); err != nil {
+		t.Errorf("default config should be valid: %s", err.Error())
+	}
+	for _, cfg := range []Config{
+		{MaxPlayers: 1},
+		{Width: 5},
+		{MaxPlayers: 20, Height: 15},
+		{ObstacleLayout: "maze"},
+		{PowerUpKinds: []string{"teleport"}},
+		{Compression: "gzip"},
+		{Framing: "xml"},
+		{SendQueuePolicy: "ignore"},
+		{Modes: map[string]GameMode{"maze": {ObstacleLayout: "maze"}}},
+		{Modes: map[string]GameMode{"fast": {PowerUpInterval: -1}}},
+		{MinPlayers: 9},
+		{Teams: 1},
+		{TrailTTL: -1},
+		{ChatHistory: -1},
+		{MaxConnections: -1},
+		{MatchSize: 9},
+		{MaxSpectators: -1},
+		{MaxSpectatorsPerIP: -1},
+		{MaxGameDuration: -time.Second},
+		{MinPlayers: -1},
+		{TickInterval: -time.Millisecond},
+		{ReadTimeout: -time.Second},
+		{MaxMissedPongs: -1},
+		{SendQueueSize: -1},
+		{Colors: Palette{"#ff0000", "blue"}},
+		{Colors: Palette{"#ff0000", "#FF0000"}},
+	} {
+		if _, err := CreateWithConfig(cfg); err == nil {
+			t.Errorf("config should be invalid: %+v", cfg)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/tron_server/jsontypes"
+	"strings"
+)
+
+// anyPhase is the phase of handlers for messages accepted in every phase,
+// also from spectators.
+const anyPhase = -1
+
+// message is an incoming message being dispatched to its handler. The message
+// is decoded into the type of its phase: lobby messages into ChatData, game
+// messages into GameData. Messages of any phase decode themselves.
+type message struct {
+	connId int    // id of the connection the message arrived on
+	raw    string // the message, without surrounding whitespace
+	lobby  *jsontypes.ChatData
+	game   *jsontypes.GameData
+}
+
+type handlerKey struct {
+	phase   int
+	msgType string
+}
+
+// messageHandler handles a message of the player.
+type messageHandler func(s *Server, p *client, msg *message)
+
+// handlers contains the handler of every message type, in the phase the type
+// is accepted in.
+var handlers = map[handlerKey]messageHandler{
+	{anyPhase, "pong"}:       func(s *Server, p *client, msg *message) { s.handlePong(p) },
+	{anyPhase, "hello"}:      func(s *Server, p *client, msg *message) { s.handleHello(p, msg.raw) },
+	{anyPhase, "list_rooms"}: func(s *Server, p *client, msg *message) { s.handleListRooms(p) },
+	{anyPhase, "leave"}:      func(s *Server, p *client, msg *message) { s.handleLeave(p) },
+
+	{phaseLobby, "chat"}:         func(s *Server, p *client, msg *message) { s.handleChat(p, msg.lobby) },
+	{phaseLobby, "set_name"}:     func(s *Server, p *client, msg *message) { s.handleSetName(p, msg.lobby.Name) },
+	{phaseLobby, "set_team"}:     func(s *Server, p *client, msg *message) { s.handleSetTeam(p, msg.lobby.Team) },
+	{phaseLobby, "set_mode"}:     func(s *Server, p *client, msg *message) { s.handleSetMode(p, msg.lobby.Mode) },
+	{phaseLobby, "reconnect"}:    func(s *Server, p *client, msg *message) { s.handleReconnect(msg.connId, p, msg.lobby.Token) },
+	{phaseLobby, "join_room"}:    func(s *Server, p *client, msg *message) { s.handleJoinRoom(p, msg.lobby.Room) },
+	{phaseLobby, "spectate"}:     func(s *Server, p *client, msg *message) { s.handleSpectate(p, msg.lobby.Room) },
+	{phaseLobby, "watch_replay"}: func(s *Server, p *client, msg *message) { s.handleWatchReplay(p) },
+	{phaseLobby, "reset_scores"}: func(s *Server, p *client, msg *message) { s.handleResetScores(p) },
+	{phaseLobby, "quick_match"}:  func(s *Server, p *client, msg *message) { s.handleQuickMatch(p) },
+	{phaseLobby, "kick"}:         func(s *Server, p *client, msg *message) { s.handleKick(p, msg.lobby.Color) },
+	{phaseLobby, "add_bot"}:      func(s *Server, p *client, msg *message) { s.handleAddBot(p) },
+	{phaseLobby, "ready"}:        func(s *Server, p *client, msg *message) { s.handleReady(p, true) },
+	{phaseLobby, "unready"}:      func(s *Server, p *client, msg *message) { s.handleReady(p, false) },
+	{phaseLobby, "rematch"}:      func(s *Server, p *client, msg *message) { s.handleRematch(p) },
+
+	{phaseGame, "start"}:        func(s *Server, p *client, msg *message) { s.handleStart(p) },
+	{phaseGame, "pause"}:        func(s *Server, p *client, msg *message) { s.handlePause(p, true) },
+	{phaseGame, "resume"}:       func(s *Server, p *client, msg *message) { s.handlePause(p, false) },
+	{phaseGame, "player_event"}: func(s *Server, p *client, msg *message) { s.handlePlayerEvent(p, msg) },
+}
+
+// handleMessage reads the type of the message, and passes the message to the
+// handler of the type in the phase of the room of the sender.
+func (s *Server) handleMessage(mf msgFormat) {
+	m := strings.TrimSpace(mf.msg)
+	p, err := s.findById(mf.senderId)
+	if err != nil {
+		// the player might have disconnected after sending the message
+		s.log.Warn("Player not found in list", "id", mf.senderId)
+		return
+	}
+	envelope := &jsontypes.SimpleData{}
+	if err := json.Unmarshal([]byte(m), envelope); err != nil {
+		s.log.Warn("Malformed message", "id", p.id, "message", m, "err", err)
+		s.sendError(p.conn, jsontypes.CodeBadMessage, err.Error())
+		return
+	}
+	s.metrics.countMessage(envelope.Type)
+	if envelope.Type != "pong" {
+		// pongs are sent by idle clients as well
+		s.resetIdle()
+	}
+	msg := &message{connId: mf.senderId, raw: m}
+	if handle, ok := handlers[handlerKey{anyPhase, envelope.Type}]; ok {
+		handle(s, p, msg)
+		return
+	}
+	r := p.room
+	if p.spectator {
+		s.log.Debug("Ignoring message of spectator", "id", p.id)
+		return
+	}
+
+	handle, ok := handlers[handlerKey{r.phase, envelope.Type}]
+	if !ok {
+		phase := phaseNames[r.phase]
+		s.log.Warn("Unknown message type", "id", p.id, "type", envelope.Type, "phase", phase)
+		s.sendError(p.conn, jsontypes.CodeBadMessage,
+			fmt.Sprintf("unknown message type '%s' in %s phase", envelope.Type, phase))
+		return
+	}
+	var data interface{}
+	switch r.phase {
+	case phaseLobby:
+		msg.lobby = &jsontypes.ChatData{}
+		data = msg.lobby
+	case phaseGame:
+		msg.game = &jsontypes.GameData{}
+		data = msg.game
+	}
+	if !s.decode(p, m, data) {
+		return
+	}
+	handle(s, p, msg)
+}
+
+// decode decodes the message of the player strictly into data. Malformed
+// messages are answered with an error, and false is returned.
+func (s *Server) decode(p *client, m string, data interface{}) bool {
+	err := jsontypes.Decode([]byte(m), data)
+	if err == nil {
+		return true
+	}
+	s.log.Warn("Malformed message", "id", p.id, "message", m, "err", err)
+	if errors.Is(err, jsontypes.ErrInvalidFields) {
+		s.sendError(p.conn, jsontypes.CodeInvalidFields, err.Error())
+	} else {
+		s.sendError(p.conn, jsontypes.CodeBadMessage, err.Error())
+	}
+	return false
+}
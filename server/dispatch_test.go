@@ -0,0 +1,36 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestDispatchPhases(t *testing.T) {
+	s := Create()
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	p := &client{conn: conn}
+	s.joinRoom(p, defaultRoom)
+	s.clients[p.id] = p
+	reader := bufio.NewReader(peer)
+
+	// game messages are unknown in the lobby
+	go s.handleMessage(msgFormat{p.id, `{"type":"start"}`})
+	if msg, _ := reader.ReadString('\n'); !strings.Contains(msg, "BAD_MESSAGE") {
+		t.Fatalf("start should be refused in the lobby, got %s", msg)
+	}
+	go io.Copy(io.Discard, reader)
+
+	handlers[handlerKey{phaseLobby, "ready"}](s, p, &message{raw: `{"type":"ready"}`})
+	if !p.ready {
+		t.Fatal("ready handler should set the player ready")
+	}
+	for key := range handlers {
+		if key.phase != anyPhase && phaseNames[key.phase] == "" {
+			t.Fatalf("handler of %s registered for unknown phase %d", key.msgType, key.phase)
+		}
+	}
+}
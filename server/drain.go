@@ -0,0 +1,49 @@
+package server
+
+import (
+	"github.com/tron_server/jsontypes"
+)
+
+// Drain shuts down the server gracefully. The listeners are closed, so no more
+// connections are accepted, and no more games are started, but the games in
+// progress are played to the end. The server shuts down when the last one is
+// over. Draining a server which is not running has no effect.
+func (s *Server) Drain() {
+	if !s.started.IsSet() {
+		return
+	}
+	select {
+	case s.drains <- true:
+	case <-s.done:
+	}
+}
+
+// handleDrain stops listening and tells every client that the server is
+// draining, then shuts down the server if no game is running.
+func (s *Server) handleDrain() {
+	if s.draining {
+		return
+	}
+	s.log.Info("Draining server")
+	s.draining = true
+	s.stopListening()
+	for _, p := range s.clients {
+		s.sendMessage(p.conn, jsontypes.SimpleData{Type: "draining"})
+	}
+	s.finishDrain()
+}
+
+// finishDrain shuts down the draining server once no game is running. It has
+// to be called whenever a game is over or a room is closed.
+func (s *Server) finishDrain() {
+	if !s.draining {
+		return
+	}
+	for _, r := range s.rooms {
+		if r.phase == phaseGame {
+			return
+		}
+	}
+	s.log.Info("Drained, no game is running")
+	s.shutdown()
+}
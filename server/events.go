@@ -0,0 +1,35 @@
+package server
+
+// EventHandler is notified about the lifecycle events of the server, see
+// Config.Events. The methods are called from the broker, so they must not
+// block, and they must not call methods of the server which wait for the
+// broker, like Stats.
+type EventHandler interface {
+	// OnConnect is called when a client connected and got its color.
+	OnConnect(color string)
+
+	// OnDisconnect is called when a client lost its connection, or was
+	// removed from the server.
+	OnDisconnect(color string)
+
+	// OnGameStart is called with the colors of the players when a game
+	// starts.
+	OnGameStart(colors []string)
+
+	// OnGameOver is called when a game is over. Winner is empty if nobody
+	// survived.
+	OnGameOver(winner string)
+
+	// OnChat is called with the chat messages after the chat filter is
+	// applied.
+	OnChat(from, message string)
+}
+
+// noEvents is the event handler used if none is configured.
+type noEvents struct{}
+
+func (noEvents) OnConnect(color string)      {}
+func (noEvents) OnDisconnect(color string)   {}
+func (noEvents) OnGameStart(colors []string) {}
+func (noEvents) OnGameOver(winner string)    {}
+func (noEvents) OnChat(from, message string) {}
@@ -0,0 +1,70 @@
+package server
+
+// Optional features of the protocol, which clients list in their hello
+// message, and the server in its connect message.
+const (
+	CompressionFeature = "compression"
+	PowerUpsFeature    = "powerups"
+	SpectateFeature    = "spectate"
+	TimestampsFeature  = "timestamps"
+)
+
+// features returns the optional features enabled on the server.
+func (s *Server) features() []string {
+	features := []string{SpectateFeature}
+	if s.cfg.Compression != NoCompression {
+		features = append(features, CompressionFeature)
+	}
+	if s.powerUpsEnabled() {
+		features = append(features, PowerUpsFeature)
+	}
+	if s.cfg.Timestamps {
+		features = append(features, TimestampsFeature)
+	}
+	return features
+}
+
+// powerUpsEnabled tells whether power-ups might be spawned, in the games
+// played with the settings of the server, or in any mode.
+func (s *Server) powerUpsEnabled() bool {
+	if s.cfg.PowerUpInterval > 0 {
+		return true
+	}
+	for name := range builtinModes {
+		if m, _ := s.mode(name); m.PowerUpInterval > 0 {
+			return true
+		}
+	}
+	for _, m := range s.cfg.Modes {
+		if m.PowerUpInterval > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// setFeatures stores the features the client supports.
+func (p *client) setFeatures(features []string) {
+	p.features = make(map[string]bool, len(features))
+	for _, f := range features {
+		p.features[f] = true
+	}
+}
+
+// supports tells whether the client supports the feature. Clients which did
+// not list their features are assumed to support every feature, like before
+// features were introduced.
+func (p *client) supports(feature string) bool {
+	return p.features == nil || p.features[feature]
+}
+
+// sendSupporting sends the message of an optional feature to everyone in the
+// room who supports the feature.
+func (r *room) sendSupporting(feature, message string) {
+	r.sendEachClient(func(p *client) string {
+		if !p.supports(feature) {
+			return ""
+		}
+		return message
+	}, -1)
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+)
+
+// Framings of the messages on the connections, see Config.Framing.
+const (
+	NewlineFraming        = ""
+	LengthPrefixedFraming = "length"
+)
+
+// lengthHeaderSize is the size of the length prefix of the messages, in bytes.
+const lengthHeaderSize = 4
+
+// errMessageTooLarge is returned by the message readers for messages over the
+// size limit.
+var errMessageTooLarge = errors.New("Message too large")
+
+// lengthPrefixedConn is a connection whose messages are prefixed with their
+// length as a 4 byte big-endian integer, instead of being terminated by a
+// newline.
+type lengthPrefixedConn struct {
+	net.Conn
+}
+
+// frame returns the message framed for the connection.
+func frame(c net.Conn, msg string) []byte {
+	if _, ok := c.(*lengthPrefixedConn); ok {
+		b := make([]byte, lengthHeaderSize, lengthHeaderSize+len(msg))
+		binary.BigEndian.PutUint32(b, uint32(len(msg)))
+		return append(b, msg...)
+	}
+	return []byte(msg + "\n")
+}
+
+// messageReader reads the messages of a connection one by one.
+type messageReader interface {
+	// readMessage returns the next message. The message is only valid
+	// until the next call.
+	readMessage() ([]byte, error)
+}
+
+// newMessageReader returns a reader of the messages of the connection in its
+// framing. Messages larger than maxSize are refused with errMessageTooLarge.
+// The reader has to be kept between messages, since it might have buffered
+// the beginning of the next one.
+func newMessageReader(c net.Conn, maxSize int) messageReader {
+	if _, ok := c.(*lengthPrefixedConn); ok {
+		return &lengthReader{reader: bufio.NewReader(c), maxSize: maxSize}
+	}
+	// the buffer bounds the size of a message
+	return newlineReader{bufio.NewReaderSize(c, maxSize)}
+}
+
+type newlineReader struct {
+	reader *bufio.Reader
+}
+
+func (r newlineReader) readMessage() ([]byte, error) {
+	line, err := r.reader.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, errMessageTooLarge
+	}
+	return line, err
+}
+
+type lengthReader struct {
+	reader  *bufio.Reader
+	maxSize int
+	buf     []byte
+}
+
+func (r *lengthReader) readMessage() ([]byte, error) {
+	header := make([]byte, lengthHeaderSize)
+	if _, err := io.ReadFull(r.reader, header); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header)
+	if uint64(length) > uint64(r.maxSize) {
+		return nil, errMessageTooLarge
+	}
+	if cap(r.buf) < int(length) {
+		r.buf = make([]byte, length)
+	}
+	r.buf = r.buf[:length]
+	if _, err := io.ReadFull(r.reader, r.buf); err != nil {
+		return nil, err
+	}
+	return r.buf, nil
+}
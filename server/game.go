@@ -0,0 +1,275 @@
+package server
+
+import (
+	"errors"
+	"math/rand"
+	"sort"
+)
+
+type point struct {
+	x, y int
+}
+
+const (
+	boostDuration = 20  // number of ticks a boost lasts
+	boostCooldown = 100 // number of ticks after a boost before the next one
+)
+
+type car struct {
+	color string
+	pos   point
+	dir   string
+	alive bool
+	// heading is the direction of the last move, the car cannot turn back
+	// against it
+	heading string
+	// boosted cars move two cells per tick
+	boostTicks int // ticks left of the running boost
+	cooldown   int // ticks left until the car may boost again
+	// invincible cars drive through trails and other cars
+	invincible int // ticks left of invincibility
+	team       int
+}
+
+// game is the server side model of a running match. It tracks the position
+// and heading of every car and the cells already covered by trails. All
+// methods are called from the broker goroutine.
+type game struct {
+	width  int
+	height int
+	cars   map[int]*car  // player id -> car
+	grid   map[point]int // occupied cell -> id of the player who left the trail
+	ticks  int           // number of steps done
+
+	powerUps   map[point]*powerUp // power-ups not collected yet
+	powerUpIds int
+	collected  []collected // power-ups collected in the last step
+	rnd        *rand.Rand  // shared with the server, see Config.Seed
+	// in team games cars drive through the trails of their teammates, and
+	// the game is over when one team is left
+	teams bool
+	// trails expire after trailTTL ticks, or never if it is 0
+	trailTTL int
+	laid     map[point]int // occupied cell -> tick the trail was left in
+	trail    []trailCell   // trail cells in the order they were covered
+	expired  []trailCell   // trail cells expired in the last step
+	// shrunk is the number of cells removed from each side of the map in
+	// sudden death
+	shrunk int
+}
+
+func newGame(players []*client, width, height int, rnd *rand.Rand) *game {
+	g := &game{
+		width:  width,
+		height: height,
+		cars:   make(map[int]*car, len(players)),
+		grid:   make(map[point]int),
+		laid:   make(map[point]int),
+
+		powerUps: make(map[point]*powerUp),
+		rnd:      rnd,
+	}
+	for i, p := range players {
+		pos, dir := g.spawn(i, len(players))
+		g.cars[p.id] = &car{color: p.color, pos: pos, dir: dir, heading: dir, alive: true, team: p.team}
+		g.cover(pos, p.id)
+	}
+	return g
+}
+
+// spawn returns the starting position and direction of the i-th player out of
+// n. Players are put alternately on the left and the right side of the map,
+// facing the other side. Every player starts in a different row, evenly
+// spaced, so nobody drives head-on into another car right away.
+func (g *game) spawn(i, n int) (point, string) {
+	y := g.height * (i + 1) / (n + 1)
+	if i%2 == 0 {
+		return point{g.width / 10, y}, "right"
+	}
+	return point{g.width - 1 - g.width/10, y}, "left"
+}
+
+// Errors of turn.
+var (
+	errUnknownDirection = errors.New("Unknown direction")
+	errReversal         = errors.New("Car cannot reverse into its own trail")
+)
+
+// turn changes the direction of a living car. Unknown directions and turning
+// back against the heading of the car are refused. Turns of dead cars are
+// ignored.
+func (g *game) turn(id int, dir string) error {
+	if _, ok := directions[dir]; !ok {
+		return errUnknownDirection
+	}
+	c, ok := g.cars[id]
+	if !ok || !c.alive {
+		return nil
+	}
+	if opposites[c.heading] == dir {
+		return errReversal
+	}
+	c.dir = dir
+	return nil
+}
+
+var directions = map[string]point{
+	"up":    {0, -1},
+	"down":  {0, 1},
+	"left":  {-1, 0},
+	"right": {1, 0},
+}
+
+var opposites = map[string]string{
+	"up":    "down",
+	"down":  "up",
+	"left":  "right",
+	"right": "left",
+}
+
+// isAlive tells whether the car of the player has not crashed yet.
+func (g *game) isAlive(id int) bool {
+	c, ok := g.cars[id]
+	return ok && c.alive
+}
+
+// boost speeds up the living car, unless it is boosted already or its
+// boost is cooling down. It tells whether the boost started.
+func (g *game) boost(id int) bool {
+	c, ok := g.cars[id]
+	if !ok || !c.alive || c.boostTicks > 0 || c.cooldown > 0 {
+		return false
+	}
+	c.boostTicks = boostDuration
+	return true
+}
+
+// tickTimers counts down the boost, cooldown and invincibility timers of the
+// cars after a step, and returns the ids of the players whose boost ended.
+func (g *game) tickTimers() []int {
+	ended := make([]int, 0)
+	for id, c := range g.cars {
+		if c.invincible > 0 {
+			c.invincible--
+		}
+		switch {
+		case c.boostTicks > 0:
+			c.boostTicks--
+			if c.boostTicks == 0 {
+				c.cooldown = boostCooldown
+				ended = append(ended, id)
+			}
+		case c.cooldown > 0:
+			c.cooldown--
+		}
+	}
+	sort.Ints(ended)
+	return ended
+}
+
+// step moves every living car by one cell, boosted cars by two cells, and
+// returns the ids of the players who crashed during this step. A car crashes
+// if it leaves the map, enters a cell covered by any trail (including its
+// own), or enters the same cell as another car at the same time. Trails of
+// teammates are driven through in team games. Invincible cars only crash when
+// leaving the map or entering an obstacle. Power-ups entered by the cars are
+// collected. Expired trails are removed before the cars move.
+func (g *game) step() []int {
+	g.ticks++
+	g.expireTrails()
+	g.collected = g.collected[:0]
+	dead := g.move(func(c *car) bool { return true })
+	dead = append(dead, g.move(func(c *car) bool { return c.boostTicks > 0 })...)
+	sort.Ints(dead)
+	return dead
+}
+
+// move moves the living cars selected by the filter by one cell, and returns
+// the ids of the players who crashed.
+func (g *game) move(filter func(c *car) bool) []int {
+	next := make(map[int]point, len(g.cars))
+	heads := make(map[point]int, len(g.cars))
+	for id, c := range g.cars {
+		if !c.alive || !filter(c) {
+			continue
+		}
+		d := directions[c.dir]
+		p := point{c.pos.x + d.x, c.pos.y + d.y}
+		next[id] = p
+		heads[p]++
+	}
+
+	dead := make([]int, 0)
+	for id, p := range next {
+		c := g.cars[id]
+		owner, occupied := g.grid[p]
+		if occupied && g.teammates(owner, id) {
+			occupied = false
+		}
+		// invincibility protects against trails and cars, not obstacles
+		if !g.inside(p) || owner == obstacleId || (occupied || heads[p] > 1) && c.invincible == 0 {
+			c.alive = false
+			dead = append(dead, id)
+			continue
+		}
+		c.pos = p
+		c.heading = c.dir
+		g.collect(id, p)
+	}
+	for id, p := range next {
+		if g.cars[id].alive {
+			g.cover(p, id)
+		}
+	}
+	return dead
+}
+
+// aliveCount returns the number of cars which have not crashed yet.
+func (g *game) aliveCount() int {
+	n := 0
+	for _, c := range g.cars {
+		if c.alive {
+			n++
+		}
+	}
+	return n
+}
+
+// cellsOf returns the cells of the grid covered by the trail of the player
+// with the given id, or by obstacles, ordered by row and column.
+func (g *game) cellsOf(id int) []point {
+	cells := make([]point, 0)
+	for p, owner := range g.grid {
+		if owner == id {
+			cells = append(cells, p)
+		}
+	}
+	sort.Slice(cells, func(i, j int) bool {
+		if cells[i].y != cells[j].y {
+			return cells[i].y < cells[j].y
+		}
+		return cells[i].x < cells[j].x
+	})
+	return cells
+}
+
+// over tells whether the game is over: at most one car is left alive, or in a
+// game of a single car, the car crashed. Team games are over when at most one
+// team is left, or in a game of a single team, every car crashed.
+func (g *game) over() bool {
+	if g.teams {
+		if g.teamCount() == 1 {
+			return g.aliveCount() == 0
+		}
+		return len(g.aliveTeams()) <= 1
+	}
+	if len(g.cars) == 1 {
+		return g.aliveCount() == 0
+	}
+	return g.aliveCount() <= 1
+}
+
+// inside tells whether the cell is in the playable area of the map.
+func (g *game) inside(p point) bool {
+	return p.x >= g.shrunk && p.y >= g.shrunk && p.x < g.width-g.shrunk && p.y < g.height-g.shrunk
+}
@@ -0,0 +1,329 @@
+package server
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func newTestGame(n int) *game {
+	players := make([]*client, n)
+	for i := range players {
+		players[i] = &client{id: i, color: "#00000" + string(rune('0'+i))}
+	}
+	return newGame(players, 100, 100, rand.New(rand.NewSource(1)))
+}
+
+func TestGameBoundaryCollision(t *testing.T) {
+	g := newTestGame(1)
+	g.turn(0, "up")
+	steps := g.cars[0].pos.y
+	for i := 0; i < steps; i++ {
+		if dead := g.step(); len(dead) != 0 {
+			t.Fatalf("car died too early, at step %d", i)
+		}
+	}
+	dead := g.step()
+	if len(dead) != 1 || dead[0] != 0 {
+		t.Fatalf("car should die when leaving the map, got %v", dead)
+	}
+}
+
+func TestGameSelfCollision(t *testing.T) {
+	g := newTestGame(1)
+	g.step()
+	g.turn(0, "down")
+	g.step()
+	g.turn(0, "left")
+	g.step()
+	g.turn(0, "up")
+	dead := g.step()
+	if len(dead) != 1 {
+		t.Fatal("car should die when running into its own trail")
+	}
+}
+
+func TestGameTrailCollision(t *testing.T) {
+	g := newTestGame(2)
+	g.cars[0].pos = point{10, 10}
+	g.cars[0].dir = "right"
+	g.cars[1].pos = point{12, 9}
+	g.cars[1].dir = "down"
+	g.grid = map[point]int{{10, 10}: 0, {12, 9}: 1}
+
+	g.step() // 0 -> (11,10), 1 -> (12,10)
+	dead := g.step()
+	if len(dead) != 1 || dead[0] != 0 {
+		t.Fatalf("player 0 should die in trail of player 1, got %v", dead)
+	}
+	if !g.cars[1].alive || g.aliveCount() != 1 {
+		t.Fatal("player 1 should survive")
+	}
+}
+
+func TestGameHeadOnCollision(t *testing.T) {
+	g := newTestGame(2)
+	g.cars[0].pos = point{10, 10}
+	g.cars[0].dir = "right"
+	g.cars[1].pos = point{12, 10}
+	g.cars[1].dir = "left"
+	g.grid = map[point]int{{10, 10}: 0, {12, 10}: 1}
+
+	dead := g.step()
+	if len(dead) != 2 {
+		t.Fatalf("both players should die, got %v", dead)
+	}
+	if g.aliveCount() != 0 {
+		t.Fatal("no cars should be left alive")
+	}
+}
+
+func TestGameSpawns(t *testing.T) {
+	g := newTestGame(4)
+	rows := make(map[int]bool)
+	for id, c := range g.cars {
+		if !g.inside(c.pos) {
+			t.Fatalf("player %d spawns outside of the map", id)
+		}
+		if rows[c.pos.y] {
+			t.Fatalf("player %d spawns in the row of another player", id)
+		}
+		rows[c.pos.y] = true
+	}
+	if g.cars[0].dir != "right" || g.cars[1].dir != "left" {
+		t.Fatal("players should face the other side of the map")
+	}
+	again := newTestGame(4)
+	for id, c := range g.cars {
+		if again.cars[id].pos != c.pos || again.cars[id].dir != c.dir {
+			t.Fatal("spawns should be deterministic")
+		}
+	}
+}
+
+func TestBotAvoidsWall(t *testing.T) {
+	g := newTestGame(1)
+	c := g.cars[0]
+	for i := 0; i < 500; i++ {
+		g.turn(0, g.botDirection(c))
+		g.step()
+		if !c.alive {
+			t.Fatalf("bot should avoid walls and trails, crashed at step %d", i)
+		}
+	}
+}
+
+func TestGameBoost(t *testing.T) {
+	g := newTestGame(1)
+	c := g.cars[0]
+	x := c.pos.x
+	if !g.boost(0) {
+		t.Fatal("boost should start")
+	}
+	if g.boost(0) {
+		t.Fatal("boost should not start again while running")
+	}
+	g.step()
+	if c.pos.x != x+2 {
+		t.Fatalf("boosted car should move two cells, moved %d", c.pos.x-x)
+	}
+	if _, ok := g.grid[point{x + 1, c.pos.y}]; !ok {
+		t.Fatal("boosted car should leave a continuous trail")
+	}
+	for i := 0; i < boostDuration-1; i++ {
+		if ended := g.tickTimers(); len(ended) != 0 {
+			t.Fatalf("boost ended too early, after %d ticks", i+1)
+		}
+	}
+	if ended := g.tickTimers(); len(ended) != 1 || ended[0] != 0 {
+		t.Fatalf("boost should end after %d ticks", boostDuration)
+	}
+	x = c.pos.x
+	g.step()
+	if c.pos.x != x+1 {
+		t.Fatal("car should move one cell after the boost")
+	}
+	if g.boost(0) {
+		t.Fatal("boost should not start during the cooldown")
+	}
+}
+
+func TestGameObstacles(t *testing.T) {
+	g := newTestGame(2)
+	g.addObstacles(RandomObstacles, rand.New(rand.NewSource(42)))
+	obstacles := g.obstacles()
+	if len(obstacles) == 0 {
+		t.Fatal("random layout should place obstacles")
+	}
+	again := newTestGame(2)
+	again.addObstacles(RandomObstacles, rand.New(rand.NewSource(42)))
+	if len(again.obstacles()) != len(obstacles) || again.obstacles()[0] != obstacles[0] {
+		t.Fatal("random layout should be deterministic for a seed")
+	}
+	for id, c := range g.cars {
+		d := directions[c.dir]
+		for i := 0; i <= spawnClearance; i++ {
+			if g.grid[point{c.pos.x + i*d.x, c.pos.y + i*d.y}] == obstacleId {
+				t.Fatalf("obstacle in front of the spawn of player %d", id)
+			}
+		}
+	}
+
+	g = newTestGame(1)
+	c := g.cars[0]
+	g.grid[point{c.pos.x + 1, c.pos.y}] = obstacleId
+	if dead := g.step(); len(dead) != 1 {
+		t.Fatal("car running into an obstacle should die")
+	}
+}
+
+func TestGamePowerUps(t *testing.T) {
+	g := newTestGame(1)
+	c := g.cars[0]
+	ahead := point{c.pos.x + 1, c.pos.y}
+	g.powerUps[ahead] = &powerUp{id: 1, kind: InvinciblePowerUp}
+	g.step()
+	if len(g.collected) != 1 || g.collected[0].powerUp.id != 1 {
+		t.Fatal("power-up should be collected")
+	}
+	g.grid[point{c.pos.x + 1, c.pos.y}] = 7
+	if dead := g.step(); len(dead) != 0 {
+		t.Fatal("invincible car should drive through trails")
+	}
+
+	g.powerUps[point{c.pos.x + 1, c.pos.y}] = &powerUp{id: 2, kind: ClearPowerUp}
+	g.step()
+	for cell, owner := range g.grid {
+		if owner == 0 && cell != c.pos {
+			t.Fatal("trail should be cleared")
+		}
+	}
+
+	obstacle := point{c.pos.x + 1, c.pos.y}
+	g.grid[obstacle] = obstacleId
+	if dead := g.step(); len(dead) != 1 {
+		t.Fatal("invincible car running into an obstacle should die")
+	}
+	if g.grid[obstacle] != obstacleId {
+		t.Fatal("obstacle should not be covered by the trail")
+	}
+
+	pu, p, ok := g.spawnPowerUp(SpeedPowerUp)
+	if !ok || g.powerUps[p] != pu {
+		t.Fatal("power-up should be spawned")
+	}
+	if _, occupied := g.grid[p]; occupied {
+		t.Fatal("power-up should be spawned on a free cell")
+	}
+}
+
+func TestGameReversal(t *testing.T) {
+	g := newTestGame(1)
+	if err := g.turn(0, "left"); err != errReversal {
+		t.Fatal("car should not reverse")
+	}
+	if err := g.turn(0, "sideways"); err != errUnknownDirection {
+		t.Fatal("unknown direction should be refused")
+	}
+	// turning twice within a tick must not reverse either
+	g.turn(0, "up")
+	if err := g.turn(0, "left"); err != errReversal {
+		t.Fatal("car should not reverse before it moved up")
+	}
+	g.step()
+	if err := g.turn(0, "left"); err != nil {
+		t.Fatalf("car should turn left after it moved up, got %v", err)
+	}
+}
+
+func TestGameOverSinglePlayer(t *testing.T) {
+	g := newTestGame(1)
+	if g.over() {
+		t.Fatal("game of a single car should go on while it is alive")
+	}
+	g.cars[0].alive = false
+	if !g.over() {
+		t.Fatal("game should be over when the single car crashed")
+	}
+}
+
+func TestGameTeams(t *testing.T) {
+	g := newTestGame(3)
+	g.teams = true
+	g.cars[0].team, g.cars[1].team, g.cars[2].team = 0, 0, 1
+	g.cars[0].pos = point{10, 10}
+	g.cars[0].dir = "right"
+	g.cars[1].pos = point{12, 9}
+	g.cars[1].dir = "down"
+	g.grid = map[point]int{{10, 10}: 0, {12, 9}: 1}
+
+	g.step() // 0 -> (11,10), 1 -> (12,10)
+	if dead := g.step(); len(dead) != 0 {
+		t.Fatalf("player 0 should drive through the trail of its teammate, got %v", dead)
+	}
+	if g.over() {
+		t.Fatal("game should go on while both teams have cars")
+	}
+	g.cars[2].alive = false
+	if !g.over() {
+		t.Fatal("game should be over when one team is left")
+	}
+}
+
+func TestGameTrailExpiry(t *testing.T) {
+	g := newTestGame(1)
+	g.trailTTL = 2
+	spawn := g.cars[0].pos
+	g.step()
+	g.turn(0, "down")
+	g.step()
+	g.turn(0, "left")
+	g.step()
+	g.turn(0, "up")
+	if dead := g.step(); len(dead) != 0 {
+		t.Fatal("car should drive through its expired trail")
+	}
+	if g.cars[0].pos != spawn {
+		t.Fatalf("car should be back at its spawn, got %v", g.cars[0].pos)
+	}
+	if len(g.expired) != 1 || g.expired[0].tick != 2 {
+		t.Fatalf("the cell covered two steps ago should expire, got %v", g.expired)
+	}
+	if _, ok := g.grid[g.expired[0].p]; ok {
+		t.Fatal("expired cells should be removed from the grid")
+	}
+}
+
+func TestGameTrailExpiryAfterClear(t *testing.T) {
+	g := newTestGame(1)
+	g.trailTTL = 3
+	c := g.cars[0]
+	g.step()
+	g.powerUps[point{c.pos.x + 1, c.pos.y}] = &powerUp{id: 1, kind: ClearPowerUp}
+	g.step()
+	for i := 0; i < 2; i++ {
+		g.step()
+		if len(g.expired) != 0 {
+			t.Fatalf("cleared cells should not expire, got %v", g.expired)
+		}
+	}
+	g.step()
+	if len(g.expired) != 1 || g.expired[0].tick != 2 {
+		t.Fatalf("the cell covered when clearing should expire, got %v", g.expired)
+	}
+}
+
+func TestGameShrink(t *testing.T) {
+	g := newTestGame(2)
+	margin := g.cars[0].pos.x
+	for i := 0; i < margin; i++ {
+		if dead := g.shrink(); len(dead) != 0 {
+			t.Fatalf("cars should survive shrink %d, got %v", i+1, dead)
+		}
+	}
+	if dead := g.shrink(); len(dead) != 2 {
+		t.Fatalf("cars next to the bounds should crash, got %v", dead)
+	}
+	if g.inside(point{margin, margin}) {
+		t.Fatal("removed cells should be outside the map")
+	}
+}
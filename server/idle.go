@@ -0,0 +1,39 @@
+package server
+
+import (
+	"github.com/tron_server/jsontypes"
+	"time"
+)
+
+// startIdleTimer starts the lobby idle timer, if the timeout is enabled. It
+// returns the channel of the timer, or nil if the timeout is disabled.
+func (s *Server) startIdleTimer() <-chan time.Time {
+	if s.cfg.LobbyIdleTimeout <= 0 {
+		return nil
+	}
+	s.idleTimer = time.NewTimer(s.cfg.LobbyIdleTimeout)
+	return s.idleTimer.C
+}
+
+// resetIdle restarts the lobby idle timeout after activity of a client.
+func (s *Server) resetIdle() {
+	if s.idleTimer != nil {
+		s.idleTimer.Reset(s.cfg.LobbyIdleTimeout)
+	}
+}
+
+// handleIdle shuts down the server if nobody sent a message within the lobby
+// idle timeout. Running games keep the server alive.
+func (s *Server) handleIdle() {
+	for _, r := range s.rooms {
+		if r.phase == phaseGame {
+			s.resetIdle()
+			return
+		}
+	}
+	s.log.Info("Lobby idle, shutting down", "timeout", s.cfg.LobbyIdleTimeout)
+	for _, p := range s.clients {
+		s.sendError(p.conn, jsontypes.CodeIdleTimeout, "")
+	}
+	s.shutdown()
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"github.com/tron_server/jsontypes"
+	"time"
+)
+
+// pinger asks the broker to ping the clients periodically, until the server
+// stops. It runs in every phase, independently of the ticker.
+func (s *Server) pinger() {
+	ticker := time.NewTicker(s.cfg.PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			select {
+			case s.pings <- true:
+			case <-s.done:
+				return
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// handlePing sends a ping to every connected client, and drops those who
+// missed too many pongs in a row.
+func (s *Server) handlePing() {
+	for id, p := range s.clients {
+		if p.missedPongs >= s.cfg.MaxMissedPongs {
+			s.log.Info("Client missed pongs", "id", id, "missed", p.missedPongs,
+				"last_pong", p.lastPong.Format(time.RFC3339))
+			// the reader of the connection notices the close and
+			// reports the disconnect
+			p.conn.Close()
+			continue
+		}
+		p.missedPongs++
+		if p.pingSent.IsZero() {
+			// the round trip is measured from the first ping
+			// unanswered
+			p.pingSent = time.Now()
+		}
+		s.sendMessage(p.conn, jsontypes.SimpleData{Type: "ping"})
+	}
+}
+
+// handlePong measures the round trip time of the client, and announces it to
+// the lobby if it is time to.
+func (s *Server) handlePong(p *client) {
+	p.lastPong = time.Now()
+	p.missedPongs = 0
+	if p.pingSent.IsZero() {
+		// not asked for
+		return
+	}
+	p.latency = p.lastPong.Sub(p.pingSent)
+	p.pingSent = time.Time{}
+	s.sendLatency(p)
+}
+
+// sendLatency announces the round trip time of the player to its room, at
+// most once per latency interval, and only in the lobby phase.
+func (s *Server) sendLatency(p *client) {
+	if s.cfg.LatencyInterval <= 0 || p.spectator || p.room == nil || p.room.phase != phaseLobby ||
+		time.Since(p.latencySent) < s.cfg.LatencyInterval {
+		return
+	}
+	p.latencySent = time.Now()
+	s.sendAll(p.room, jsontypes.Latency{Type: "latency", Color: p.color, Ms: p.latency.Milliseconds()})
+}
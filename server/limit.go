@@ -0,0 +1,39 @@
+package server
+
+import (
+	"github.com/tron_server/jsontypes"
+	"net"
+	"sync"
+)
+
+// reserveConn counts a new connection against MaxConnections. It tells
+// whether the connection is allowed, the count is not changed otherwise.
+func (s *Server) reserveConn() bool {
+	n := s.openConns.Add(1)
+	if s.cfg.MaxConnections > 0 && n > int64(s.cfg.MaxConnections) {
+		s.openConns.Add(-1)
+		return false
+	}
+	return true
+}
+
+// refuseFull tells the client that the server is full, and closes the
+// connection.
+func (s *Server) refuseFull(c net.Conn) {
+	s.log.Info("Too many connections, refusing", "addr", c.RemoteAddr().String())
+	s.replyError(c, jsontypes.CodeServerFull)
+	c.Close()
+}
+
+// countedConn is a connection counted against MaxConnections. Closing it
+// releases its place, once.
+type countedConn struct {
+	net.Conn
+	server *Server
+	once   sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() { c.server.openConns.Add(-1) })
+	return c.Conn.Close()
+}
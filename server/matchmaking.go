@@ -0,0 +1,116 @@
+package server
+
+import (
+	"github.com/tron_server/jsontypes"
+	"time"
+)
+
+// handleQuickMatch puts the player in the quick match queue. A match is formed
+// as soon as MatchSize players are queued. The wait for a full match starts
+// when the first player enters the empty queue.
+func (s *Server) handleQuickMatch(p *client) {
+	if p.queued {
+		return
+	}
+	s.pruneQueue()
+	p.queued = true
+	s.matchQueue = append(s.matchQueue, p)
+	s.log.Info("Player queued for quick match", "color", p.color, "queued", len(s.matchQueue))
+	if len(s.matchQueue) == 1 {
+		s.armMatchTimeout()
+	}
+	if len(s.matchQueue) < s.cfg.MatchSize {
+		return
+	}
+	players := s.matchQueue[:s.cfg.MatchSize]
+	s.matchQueue = append([]*client(nil), s.matchQueue[s.cfg.MatchSize:]...)
+	s.formMatch(players)
+	if len(s.matchQueue) > 0 {
+		s.armMatchTimeout()
+	}
+}
+
+// pruneQueue removes the players from the quick match queue who cannot be
+// matched anymore, since they left, lost their connection, or their room
+// started a game.
+func (s *Server) pruneQueue() {
+	queue := s.matchQueue[:0]
+	for _, p := range s.matchQueue {
+		if p.disconnected || p.room == nil || p.spectator || p.room.phase != phaseLobby {
+			p.queued = false
+			continue
+		}
+		queue = append(queue, p)
+	}
+	s.matchQueue = queue
+}
+
+// armMatchTimeout starts the wait for a full match. A wait already running is
+// replaced.
+func (s *Server) armMatchTimeout() {
+	s.matchWaits++
+	gen := s.matchWaits
+	time.AfterFunc(s.cfg.MatchTimeout, func() {
+		select {
+		case s.matchTimeouts <- gen:
+		case <-s.done:
+		}
+	})
+}
+
+// handleMatchTimeout forms a match of the players still queued, since the wait
+// for a full match is over.
+func (s *Server) handleMatchTimeout(gen int) {
+	if gen != s.matchWaits {
+		return
+	}
+	s.pruneQueue()
+	if len(s.matchQueue) == 0 {
+		return
+	}
+	players := s.matchQueue
+	s.matchQueue = nil
+	s.formMatch(players)
+}
+
+// formMatch moves the players to a new room, fills it with bots up to
+// MinPlayers, and tells them about the match. The players are ready, so the
+// game starts right away.
+func (s *Server) formMatch(players []*client) {
+	s.matches++
+	id := s.nextRoomId("match", &s.matches)
+	s.log.Info("Quick match formed", "room", id, "players", len(players))
+	for _, p := range players {
+		p.queued = false
+		s.leaveRoom(p)
+		if err := s.joinRoom(p, id); err != nil {
+			// cannot happen, MatchSize is at most MaxPlayers and the
+			// room is new
+			s.log.Error("Could not join match", "room", id, "err", err)
+			s.expel(p)
+			continue
+		}
+		p.ready = true
+	}
+	r, ok := s.rooms[id]
+	if !ok {
+		return
+	}
+	for len(r.players) < s.cfg.MinPlayers {
+		if _, err := s.addBot(r); err != nil {
+			s.log.Info("Cannot fill match with bots", "room", id, "err", err)
+			break
+		}
+	}
+	matched := jsontypes.Matched{Type: "matched", Room: id, Players: make([]string, 0, len(r.players))}
+	for _, p := range r.players {
+		matched.Players = append(matched.Players, p.color)
+	}
+	for _, p := range players {
+		if p.room == r {
+			s.welcome(p)
+		}
+	}
+	s.sendAll(r, matched)
+	s.maybeStart(r)
+}
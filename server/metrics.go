@@ -0,0 +1,87 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// countedType tells whether the message type is counted by its own label.
+// Other types are counted as "other", so that clients cannot flood the
+// metrics with new labels.
+func countedType(messageType string) bool {
+	for key := range handlers {
+		if key.msgType == messageType {
+			return true
+		}
+	}
+	return false
+}
+
+// Metrics counts the events of a server. It implements http.Handler and
+// serves the values in the Prometheus text format, so it can be scraped
+// without further dependencies:
+//
+//	http.Handle("/metrics", s.Metrics())
+type Metrics struct {
+	clients       atomic.Int64
+	ticks         atomic.Int64
+	gamesStarted  atomic.Int64
+	gamesFinished atomic.Int64
+	disconnects   atomic.Int64
+	leaves        atomic.Int64
+	// messages dropped for slow clients, see Config.SendQueuePolicy
+	droppedMessages atomic.Int64
+
+	mu       sync.Mutex
+	messages map[string]int64 // message type -> number of messages
+}
+
+func newMetrics() *Metrics {
+	return &Metrics{messages: make(map[string]int64)}
+}
+
+// Metrics returns the metrics of the server.
+func (s *Server) Metrics() *Metrics {
+	return s.metrics
+}
+
+func (m *Metrics) countMessage(messageType string) {
+	if !countedType(messageType) {
+		messageType = "other"
+	}
+	m.mu.Lock()
+	m.messages[messageType]++
+	m.mu.Unlock()
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetric(w, "tron_connected_clients", "gauge", "Number of connected clients.", m.clients.Load())
+	writeMetric(w, "tron_ticks_total", "counter", "Number of ticks of all games.", m.ticks.Load())
+	writeMetric(w, "tron_games_started_total", "counter", "Number of games started.", m.gamesStarted.Load())
+	writeMetric(w, "tron_games_finished_total", "counter", "Number of games finished.", m.gamesFinished.Load())
+	writeMetric(w, "tron_disconnects_total", "counter", "Number of client disconnects.", m.disconnects.Load())
+	writeMetric(w, "tron_leaves_total", "counter", "Number of clients who left with a leave message.", m.leaves.Load())
+	writeMetric(w, "tron_dropped_messages_total", "counter", "Number of messages dropped for slow clients.",
+		m.droppedMessages.Load())
+
+	m.mu.Lock()
+	types := make([]string, 0, len(m.messages))
+	for t := range m.messages {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	fmt.Fprintf(w, "# HELP tron_messages_total Number of messages received by type.\n")
+	fmt.Fprintf(w, "# TYPE tron_messages_total counter\n")
+	for _, t := range types {
+		fmt.Fprintf(w, "tron_messages_total{type=%q} %d\n", t, m.messages[t])
+	}
+	m.mu.Unlock()
+}
+
+func writeMetric(w http.ResponseWriter, name, kind, help string, value int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, kind, name, value)
+}
@@ -0,0 +1,37 @@
+package server
+
+import (
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	s := Create()
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	go io.Copy(io.Discard, peer)
+	p := &client{conn: conn}
+	s.joinRoom(p, defaultRoom)
+	s.clients[p.id] = p
+	s.metrics.clients.Store(1)
+	s.handleMessage(msgFormat{p.id, `{"type":"set_name","name":"alice"}`})
+	s.handleMessage(msgFormat{p.id, `{"type":"dance"}`})
+	s.handleMessage(msgFormat{p.id, `{"type":"joke"}`})
+
+	w := httptest.NewRecorder()
+	s.Metrics().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	for _, line := range []string{
+		"tron_connected_clients 1",
+		`tron_messages_total{type="set_name"} 1`,
+		`tron_messages_total{type="other"} 2`,
+		"tron_games_started_total 0",
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("missing metric %s in:\n%s", line, body)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"fmt"
+	"github.com/tron_server/jsontypes"
+	"time"
+)
+
+// GameMode is a preset of the gameplay settings, which the host of a room may
+// choose in the lobby. The settings replace the ones of the Config in the
+// games of the room. Teams are not part of a mode, since players are put in
+// teams when joining a room.
+type GameMode struct {
+	ObstacleLayout  string
+	PowerUpInterval int
+	TrailTTL        int
+	MaxGameDuration time.Duration
+}
+
+// builtinModes are the modes every server offers, unless Config.Modes
+// replaces them.
+var builtinModes = map[string]GameMode{
+	"classic":      {},
+	"powerups":     {PowerUpInterval: 50},
+	"arena":        {ObstacleLayout: PillarsObstacles},
+	"fading":       {TrailTTL: 50},
+	"sudden_death": {MaxGameDuration: time.Minute},
+}
+
+// mode returns the mode with the name, custom modes first.
+func (s *Server) mode(name string) (GameMode, bool) {
+	if m, ok := s.cfg.Modes[name]; ok {
+		return m, true
+	}
+	m, ok := builtinModes[name]
+	return m, ok
+}
+
+// settings returns the gameplay settings of the room: the ones of its mode,
+// or of the Config if no mode was chosen.
+func (r *room) settings() GameMode {
+	if m, ok := r.server.mode(r.mode); ok {
+		return m
+	}
+	cfg := r.server.cfg
+	return GameMode{ObstacleLayout: cfg.ObstacleLayout, PowerUpInterval: cfg.PowerUpInterval, TrailTTL: cfg.TrailTTL,
+		MaxGameDuration: cfg.MaxGameDuration}
+}
+
+// handleSetMode sets the mode of the room of the host, and announces it to the
+// room.
+func (s *Server) handleSetMode(host *client, name string) {
+	r := host.room
+	if host != r.host {
+		s.log.Warn("Mode set by player who is not the host", "color", host.color, "room", r.id)
+		s.sendError(host.conn, jsontypes.CodeNotHost, "")
+		return
+	}
+	if _, ok := s.mode(name); !ok {
+		s.log.Warn("Unknown mode", "mode", name, "room", r.id)
+		s.sendError(host.conn, jsontypes.CodeBadMessage, fmt.Sprintf("unknown mode '%s'", name))
+		return
+	}
+	r.mode = name
+	s.log.Info("Mode set", "room", r.id, "mode", name)
+	s.sendAll(r, jsontypes.ModeData{Type: "set_mode", Mode: name})
+}
+
+// validate checks the settings of the mode with the given name.
+func (m GameMode) validate(name string) error {
+	switch m.ObstacleLayout {
+	case NoObstacles, RandomObstacles, CrossObstacles, PillarsObstacles:
+	default:
+		return fmt.Errorf("Unknown obstacle layout '%s' in mode '%s'", m.ObstacleLayout, name)
+	}
+	if m.PowerUpInterval < 0 || m.TrailTTL < 0 || m.MaxGameDuration < 0 {
+		return fmt.Errorf("Settings of mode '%s' must not be negative", name)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"math/rand"
+)
+
+// obstacleId marks the cells of obstacles in the grid of the game.
+const obstacleId = -1
+
+// spawnClearance is the number of cells kept free in front of the cars at the
+// start.
+const spawnClearance = 3
+
+// Obstacle layouts, see Config.ObstacleLayout.
+const (
+	NoObstacles      = ""
+	RandomObstacles  = "random"
+	CrossObstacles   = "cross"
+	PillarsObstacles = "pillars"
+)
+
+// addObstacles places the obstacles of the layout on the map. Cells of the
+// spawns and the cells right in front of them are kept free. Random layouts
+// are drawn from rnd, so the same seed gives the same layout.
+func (g *game) addObstacles(layout string, rnd *rand.Rand) {
+	free := make(map[point]bool)
+	for _, c := range g.cars {
+		d := directions[c.dir]
+		for i := 0; i <= spawnClearance; i++ {
+			free[point{c.pos.x + i*d.x, c.pos.y + i*d.y}] = true
+		}
+	}
+	place := func(p point) {
+		if g.inside(p) && !free[p] {
+			g.grid[p] = obstacleId
+		}
+	}
+
+	switch layout {
+	case RandomObstacles:
+		for i := 0; i < g.width*g.height/100; i++ {
+			place(point{rnd.Intn(g.width), rnd.Intn(g.height)})
+		}
+	case CrossObstacles:
+		for x := g.width / 4; x < g.width*3/4; x++ {
+			place(point{x, g.height / 2})
+		}
+		for y := g.height / 4; y < g.height*3/4; y++ {
+			place(point{g.width / 2, y})
+		}
+	case PillarsObstacles:
+		for x := g.width / 5; x > 0 && x < g.width; x += g.width / 5 {
+			for y := g.height / 5; y > 0 && y < g.height; y += g.height / 5 {
+				place(point{x, y})
+				place(point{x + 1, y})
+				place(point{x, y + 1})
+				place(point{x + 1, y + 1})
+			}
+		}
+	}
+}
+
+// obstacles returns the cells of the obstacles, ordered by row and column.
+func (g *game) obstacles() []point {
+	return g.cellsOf(obstacleId)
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/tron_server/jsontypes"
+	"os"
+	"time"
+)
+
+// replayRoom is the id of the room the replays are played back in.
+const replayRoom = "replays"
+
+// playback is a replay being played back in the replay room.
+type playback struct {
+	replay   *jsontypes.Replay
+	interval time.Duration // time between two ticks
+	tick     int           // number of ticks played back
+	next     int           // index of the next event of the replay
+}
+
+// playbackStep is sent to the broker when the next tick of a playback is due.
+type playbackStep struct {
+	room     *room
+	playback *playback
+}
+
+// PlayReplay plays back the replay saved in the file to the clients watching
+// replays. The ticks follow each other at the tick interval of the recorded
+// game, scaled by speed, e.g. a speed of 2 plays back twice as fast. A replay
+// already playing is replaced. An error is returned if the replay cannot be
+// read, the speed is not positive, or the server is not running.
+func (s *Server) PlayReplay(path string, speed float64) error {
+	if speed <= 0 {
+		return errors.New("Speed must be positive")
+	}
+	if !s.started.IsSet() {
+		return errors.New("Server is not started")
+	}
+	jsonByte, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	replay := &jsontypes.Replay{}
+	if err := json.Unmarshal(jsonByte, replay); err != nil {
+		return err
+	}
+	interval := s.cfg.TickInterval
+	if replay.TickInterval > 0 {
+		interval = time.Duration(replay.TickInterval) * time.Millisecond
+	}
+	pb := &playback{replay: replay, interval: time.Duration(float64(interval) / speed)}
+	select {
+	case s.playbacks <- pb:
+		return nil
+	case <-s.done:
+		return errors.New("Server is stopped")
+	}
+}
+
+// getReplayRoom returns the replay room, it is created if it does not exist
+// yet.
+func (s *Server) getReplayRoom() *room {
+	r, ok := s.rooms[replayRoom]
+	if !ok {
+		r = newRoom(s, replayRoom)
+		r.replays = true
+		s.rooms[replayRoom] = r
+	}
+	return r
+}
+
+// handlePlayReplay starts the playback in the replay room with the start_game
+// message of the replay.
+func (s *Server) handlePlayReplay(pb *playback) {
+	r := s.getReplayRoom()
+	s.log.Info("Playing back replay", "room", pb.replay.Room, "ticks", pb.replay.Ticks)
+	r.playback = pb
+	s.sendAll(r, pb.replay.Start)
+	s.armPlayback(r, pb)
+}
+
+// armPlayback schedules the next tick of the playback.
+func (s *Server) armPlayback(r *room, pb *playback) {
+	time.AfterFunc(pb.interval, func() {
+		select {
+		case s.playbackSteps <- playbackStep{room: r, playback: pb}:
+		case <-s.done:
+		}
+	})
+}
+
+// handlePlaybackStep sends the events recorded before the next tick, and the
+// tick itself. The winner is announced after the last tick. Steps of replaced
+// playbacks and closed rooms are ignored.
+func (s *Server) handlePlaybackStep(e playbackStep) {
+	r, pb := e.room, e.playback
+	if s.rooms[r.id] != r || r.playback != pb {
+		return
+	}
+	events := pb.replay.Events
+	for ; pb.next < len(events) && events[pb.next].Tick <= pb.tick; pb.next++ {
+		s.playEvent(r, events[pb.next])
+	}
+	if pb.tick >= pb.replay.Ticks {
+		s.sendAll(r, jsontypes.GameOver{Type: "game_over", Winner: pb.replay.Winner})
+		r.playback = nil
+		s.closeIfEmpty(r)
+		return
+	}
+	pb.tick++
+	s.sendAll(r, jsontypes.Tick{Type: "tick", N: pb.tick})
+	s.armPlayback(r, pb)
+}
+
+// playEvent sends the recorded event as it was sent during the game.
+func (s *Server) playEvent(r *room, event jsontypes.ReplayEvent) {
+	if event.PowerUp != nil {
+		if m, ok := s.encode(event.PowerUp); ok {
+			r.sendSupporting(PowerUpsFeature, m)
+		}
+		return
+	}
+	s.sendAll(r, jsontypes.GameData{Type: "player_event", Color: event.Color,
+		Event: jsontypes.EventData{Direction: event.Direction, Boost: event.Boost}})
+}
+
+// handleWatchReplay makes the player a spectator of the replay room. Players
+// joining during a playback get its start_game message right away.
+func (s *Server) handleWatchReplay(p *client) {
+	r := s.getReplayRoom()
+	s.handleSpectate(p, r.id)
+	if p.room == r && r.playback != nil {
+		s.sendMessage(p.conn, r.playback.replay.Start)
+	}
+	// nobody might be watching, if the player could not become a
+	// spectator
+	s.closeIfEmpty(r)
+}
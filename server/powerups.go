@@ -0,0 +1,109 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/tron_server/jsontypes"
+)
+
+// Kinds of power-ups, see Config.PowerUpKinds.
+const (
+	SpeedPowerUp      = "speed"      // boosts the car
+	InvinciblePowerUp = "invincible" // lets the car drive through trails
+	ClearPowerUp      = "clear"      // removes the trail of the car
+)
+
+// invincibleTicks is the number of ticks invincibility lasts.
+const invincibleTicks = 20
+
+type powerUp struct {
+	id   int
+	kind string
+}
+
+// collected is a power-up collected by a car.
+type collected struct {
+	powerUp *powerUp
+	id      int // id of the player
+}
+
+// spawnPowerUp puts a power-up of the kind on a random free cell of the map.
+// It returns the cell, or false if no free cell was found.
+func (g *game) spawnPowerUp(kind string) (*powerUp, point, bool) {
+	for try := 0; try < 100; try++ {
+		p := point{g.rnd.Intn(g.width), g.rnd.Intn(g.height)}
+		_, occupied := g.grid[p]
+		if _, taken := g.powerUps[p]; occupied || taken || !g.inside(p) {
+			continue
+		}
+		g.powerUpIds++
+		pu := &powerUp{id: g.powerUpIds, kind: kind}
+		g.powerUps[p] = pu
+		return pu, p, true
+	}
+	return nil, point{}, false
+}
+
+// collect applies the effect of the power-up on the cell to the car of the
+// player who entered it.
+func (g *game) collect(id int, p point) {
+	pu, ok := g.powerUps[p]
+	if !ok {
+		return
+	}
+	delete(g.powerUps, p)
+	c := g.cars[id]
+	switch pu.kind {
+	case SpeedPowerUp:
+		c.boostTicks = boostDuration
+	case InvinciblePowerUp:
+		c.invincible = invincibleTicks
+	case ClearPowerUp:
+		for cell, owner := range g.grid {
+			if owner == id && cell != c.pos {
+				delete(g.grid, cell)
+				delete(g.laid, cell)
+			}
+		}
+	}
+	g.collected = append(g.collected, collected{powerUp: pu, id: id})
+}
+
+// spawnPowerUps puts a new power-up on the map every PowerUpInterval ticks of
+// the room settings, and announces it to the room.
+func (s *Server) spawnPowerUps(r *room) {
+	kinds := s.cfg.PowerUpKinds
+	interval := r.settings().PowerUpInterval
+	if interval <= 0 || len(kinds) == 0 || r.game.ticks%interval != 0 {
+		return
+	}
+	kind := kinds[r.game.rnd.Intn(len(kinds))]
+	pu, p, ok := r.game.spawnPowerUp(kind)
+	if !ok {
+		return
+	}
+	spawn := jsontypes.PowerUpSpawn{Type: "powerup_spawn", Id: pu.id, Kind: pu.kind, X: p.x, Y: p.y}
+	r.recordPowerUp(spawn)
+	jsonByte, err := json.Marshal(spawn)
+	if err != nil {
+		s.log.Error("Could not produce power-up json", "err", err)
+		return
+	}
+	r.sendSupporting(PowerUpsFeature, string(jsonByte))
+}
+
+// sendCollected announces the power-ups collected in the last step.
+func (s *Server) sendCollected(r *room) {
+	for _, c := range r.game.collected {
+		car := r.game.cars[c.id]
+		pc := jsontypes.PowerUpCollected{Type: "powerup_collected", Id: c.powerUp.id, Color: car.color}
+		jsonByte, err := json.Marshal(pc)
+		if err != nil {
+			s.log.Error("Could not produce power-up json", "err", err)
+			return
+		}
+		r.sendSupporting(PowerUpsFeature, string(jsonByte))
+		if c.powerUp.kind == SpeedPowerUp {
+			s.sendBoost(r, car.color, true)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"github.com/tron_server/jsontypes"
+	"time"
+)
+
+// rematchEvent is sent to the broker when the players of a room had enough
+// time to ask for a rematch.
+type rematchEvent struct {
+	room *room
+	gen  int // number of the game the rematch belongs to
+}
+
+// offerRematch lets the players of the room ask for a rematch of the game just
+// over, until the rematch timeout elapses.
+func (s *Server) offerRematch(r *room) {
+	r.rematchOpen = true
+	r.rematches++
+	for _, p := range r.players {
+		p.rematch = false
+	}
+	e := rematchEvent{room: r, gen: r.rematches}
+	time.AfterFunc(s.cfg.RematchTimeout, func() {
+		select {
+		case s.rematchTimeouts <- e:
+		case <-s.done:
+		}
+	})
+}
+
+// handleRematch makes the player ready for a rematch. The rematch starts like
+// any game, when everyone in the room is ready.
+func (s *Server) handleRematch(p *client) {
+	r := p.room
+	if !r.rematchOpen {
+		s.sendError(p.conn, jsontypes.CodeRematchUnavailable, "")
+		return
+	}
+	p.rematch = true
+	s.sendAll(r, jsontypes.ColorData{Type: "rematch", Color: p.color})
+	s.handleReady(p, true)
+}
+
+// handleRematchTimeout moves the players who did not ask for a rematch to the
+// default room, so the rematch can start with the others.
+func (s *Server) handleRematchTimeout(e rematchEvent) {
+	r := e.room
+	if s.rooms[r.id] != r || !r.rematchOpen || r.rematches != e.gen {
+		return
+	}
+	r.rematchOpen = false
+	for _, p := range append([]*client(nil), r.players...) {
+		if p.rematch || p.ready || p.disconnected || p.room != r {
+			continue
+		}
+		s.log.Info("Player did not ask for rematch", "color", p.color, "room", r.id)
+		s.sendAll(r, jsontypes.PlayerLeft{Type: "player_left", Color: p.color, Reason: "rematch_timeout"})
+		// leaving might start the rematch already
+		s.leaveRoom(p)
+		if err := s.joinRoom(p, defaultRoom); err != nil {
+			s.log.Info("Cannot move player to the default room", "color", p.color, "err", err)
+			s.expel(p)
+			continue
+		}
+		s.welcome(p)
+		s.maybeStart(p.room)
+	}
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/tron_server/jsontypes"
+	"os"
+	"path/filepath"
+)
+
+// recordTurn adds the direction change of the player to the replay of the
+// running game. Tick is the number of steps done before the turn.
+func (r *room) recordTurn(p *client, dir string) {
+	r.replay.Events = append(r.replay.Events,
+		jsontypes.ReplayEvent{Tick: r.game.ticks, Color: p.color, Direction: dir})
+}
+
+// recordBoost adds the boost of the player to the replay of the running game.
+func (r *room) recordBoost(p *client) {
+	r.replay.Events = append(r.replay.Events,
+		jsontypes.ReplayEvent{Tick: r.game.ticks, Color: p.color, Boost: true})
+}
+
+// recordPowerUp adds the spawn of a power-up to the replay of the running
+// game, since power-ups are placed randomly.
+func (r *room) recordPowerUp(spawn jsontypes.PowerUpSpawn) {
+	r.replay.Events = append(r.replay.Events,
+		jsontypes.ReplayEvent{Tick: r.game.ticks, PowerUp: &spawn})
+}
+
+// saveReplay completes the replay of the finished game. It becomes the last
+// replay of the server, and is written to the replay directory if one is
+// configured.
+func (s *Server) saveReplay(r *room, winner *string) {
+	replay := r.replay
+	r.replay = nil
+	replay.Ticks = r.game.ticks
+	replay.Winner = winner
+	s.lastReplay.Store(replay)
+	s.replays++
+
+	if s.cfg.ReplayDir == "" {
+		return
+	}
+	jsonByte, err := json.Marshal(replay)
+	if err != nil {
+		s.log.Error("Could not produce replay json", "err", err)
+		return
+	}
+	file := filepath.Join(s.cfg.ReplayDir, fmt.Sprintf("replay-%d.json", s.replays))
+	if err := os.WriteFile(file, jsonByte, 0644); err != nil {
+		s.log.Error("Could not write replay", "file", file, "err", err)
+		return
+	}
+	s.log.Info("Replay written", "file", file)
+}
+
+// LastReplay returns the replay of the last finished game, or nil if no game
+// finished yet. Replaying the direction changes of the events on the spawns
+// of the start_game message reproduces the game.
+func (s *Server) LastReplay() *jsontypes.Replay {
+	return s.lastReplay.Load()
+}
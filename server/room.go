@@ -0,0 +1,364 @@
+package server
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"github.com/tevino/abool"
+	"github.com/tron_server/jsontypes"
+	"sync"
+	"time"
+)
+
+// defaultRoom is the id of the room new connections are put in.
+const defaultRoom = ""
+
+const (
+	phaseLobby = iota
+	phaseGame
+)
+
+var phaseNames = map[int]string{phaseLobby: "lobby", phaseGame: "game"}
+
+// room is a lobby with its own players, colors and game. Messages of players
+// are only delivered to the players of the same room. Rooms are only touched
+// from the broker goroutine, except for the ticker.
+type room struct {
+	id          string
+	server      *Server
+	players     []*client
+	spectators  []*client
+	free_colors *list.List
+	colors      colorGenerator
+	phase       int
+	game        *game
+	gameStart   time.Time // start of the game, the reference of timestamps
+	ticking     *abool.AtomicBool
+	paused      *abool.AtomicBool // the ticker idles while the game is paused
+	stopTicker  func()            // stops the running ticker, nil if none was started
+	tickerDone  chan bool         // closed when the running ticker stopped
+	scores      map[string]int    // token of player -> number of wins
+	host        *client           // the only player who may start the game
+	replay      *jsontypes.Replay // record of the running game
+	// events are the player events waiting for the next tick, see
+	// Config.BatchEvents
+	events []jsontypes.GameData
+	// countingDown is set while the countdown before the first tick of the
+	// game is running
+	countingDown bool
+	// autoStarts is the number of waits for players started, see
+	// armAutoStart
+	autoStarts int
+	// rematchOpen is set while the players may ask for a rematch of the
+	// last game, rematches is the number of rematches offered
+	rematchOpen bool
+	rematches   int
+	// chats are the last broadcasted chat messages, oldest first, see
+	// Config.ChatHistory
+	chats []jsontypes.ChatData
+	// replays is set for the room replays are played back in, playback is
+	// the replay playing, nil if none
+	replays  bool
+	playback *playback
+	// mode is the name of the game mode chosen by the host, empty if none
+	mode string
+}
+
+// tickEvent is sent by the ticker of a room to the broker.
+type tickEvent struct {
+	room      *room
+	countdown int // seconds left before the game starts, 0 for a tick
+}
+
+func newRoom(s *Server, id string) *room {
+	return &room{
+		id:          id,
+		server:      s,
+		players:     make([]*client, 0, 5),
+		free_colors: list.New(),
+		colors:      colorGenerator{provider: s.cfg.Colors},
+		ticking:     abool.New(),
+		paused:      abool.New(),
+		scores:      make(map[string]int),
+	}
+}
+
+// joinable tells whether new players can join the room.
+func (r *room) joinable() bool {
+	return !r.replays && r.phase == phaseLobby && len(r.players) < r.server.cfg.MaxPlayers
+}
+
+// subscribe adds a new player to the room and gives it a color. Colors of
+// players who left are reused, new colors are generated only if there is no
+// free one.
+func (r *room) subscribe(p *client) error {
+	if len(r.players) >= r.server.cfg.MaxPlayers {
+		return errors.New("Room is full")
+	}
+	if r.phase != phaseLobby {
+		return errors.New("Game already started in room")
+	}
+	r.players = append(r.players, p)
+	p.room = r
+	p.ready = false
+	if r.host == nil {
+		r.host = p
+	}
+	if e := r.free_colors.Front(); e != nil {
+		p.color = e.Value.(string)
+		r.free_colors.Remove(e)
+	} else {
+		p.color = r.colors.next()
+	}
+	if r.server.cfg.Teams > 0 {
+		p.team = r.smallestTeam(p)
+	}
+	r.server.log.Info("Client subscribed", "room", r.id, "color", p.color)
+	// the new player gets the list after its connect message
+	r.sendLobbyUpdate(p.id)
+	return nil
+}
+
+// addSpectator adds a client to the room who gets every message of the room,
+// but does not play.
+func (r *room) addSpectator(p *client) {
+	r.spectators = append(r.spectators, p)
+	p.room = r
+	p.spectator = true
+	r.server.log.Info("Spectator joined", "room", r.id)
+}
+
+func (r *room) unsubscribe(p *client) {
+	if p.spectator {
+		for i, spectator := range r.spectators {
+			if p == spectator {
+				r.spectators = append(r.spectators[:i], r.spectators[i+1:]...)
+				p.room = nil
+				return
+			}
+		}
+		return
+	}
+	for i, player := range r.players {
+		if p == player {
+			r.server.log.Info("Client unsubscribed", "room", r.id, "color", p.color)
+			// put back color
+			r.free_colors.PushBack(p.color)
+			// remove player
+			r.players = append(r.players[:i], r.players[i+1:]...)
+			p.room = nil
+			if r.host == p {
+				r.transferHost()
+			}
+			r.sendLobbyUpdate(-1)
+			return
+		}
+	}
+}
+
+// transferHost gives the host role to the first connected player other than
+// the current host, and announces the new host. Bots cannot be hosts.
+func (r *room) transferHost() {
+	old := r.host
+	r.host = nil
+	for _, p := range r.players {
+		if p != old && !p.disconnected && !p.bot {
+			r.host = p
+			break
+		}
+	}
+	if r.host == nil {
+		return
+	}
+	r.server.log.Info("New host", "room", r.id, "color", r.host.color)
+	r.server.sendAll(r, jsontypes.ColorData{Type: "host", Color: r.host.color})
+}
+
+// lobbyUpdate produces the message listing the players of the room for the
+// recipient, whose entry is marked. It returns an empty string if the message
+// cannot be produced.
+func (r *room) lobbyUpdate(recipient *client) string {
+	update := jsontypes.LobbyUpdate{Type: "lobby_update", Players: make([]jsontypes.LobbyPlayer, 0, len(r.players)),
+		Waiting: make([]string, 0), Mode: r.mode}
+	for _, p := range r.players {
+		player := jsontypes.LobbyPlayer{Color: p.color, Name: p.name, Ready: p.ready, IsSelf: p == recipient}
+		if r.server.cfg.Teams > 0 {
+			team := p.team
+			player.Team = &team
+		}
+		update.Players = append(update.Players, player)
+		if !p.ready {
+			update.Waiting = append(update.Waiting, p.color)
+		}
+	}
+	jsonByte, err := json.Marshal(update)
+	if err != nil {
+		r.server.log.Error("Could not produce lobby update json", "err", err)
+		return ""
+	}
+	return string(jsonByte)
+}
+
+// sendLobbyUpdate sends the list of players to everyone in the room, except
+// the player with except_id. Nothing is sent once the game started.
+func (r *room) sendLobbyUpdate(except_id int) {
+	if r.phase != phaseLobby {
+		return
+	}
+	r.sendEachClient(r.lobbyUpdate, except_id)
+}
+
+// playerByColor returns the player of the room with the given color, or nil.
+// The color is matched in any case.
+func (r *room) playerByColor(color string) *client {
+	if normalized, err := jsontypes.NormalizeColor(color); err == nil {
+		color = normalized
+	}
+	for _, p := range r.players {
+		if p.color == color {
+			return p
+		}
+	}
+	return nil
+}
+
+// bots returns the number of bots in the room.
+func (r *room) bots() int {
+	n := 0
+	for _, p := range r.players {
+		if p.bot {
+			n++
+		}
+	}
+	return n
+}
+
+// empty tells whether there is nobody left in the room.
+func (r *room) empty() bool {
+	return len(r.players) == 0 && len(r.spectators) == 0
+}
+
+// close stops the ticker of the room, if it is running, and waits until it
+// stopped, so no tick of the game arrives afterwards and a new ticker can be
+// started right away.
+func (r *room) close() {
+	r.countingDown = false
+	r.playback = nil
+	if r.stopTicker != nil {
+		r.stopTicker()
+		<-r.tickerDone
+		r.stopTicker = nil
+	}
+}
+
+// startTicker starts the ticker of the room, unless it is running already.
+// The ticker is stopped by closing its stop channel, so stopping never blocks
+// and may be repeated.
+func (r *room) startTicker() {
+	if r.ticking.SetToIf(false, true) {
+		stop := make(chan bool)
+		var once sync.Once
+		r.stopTicker = func() { once.Do(func() { close(stop) }) }
+		r.tickerDone = make(chan bool)
+		go r.ticker(stop, r.tickerDone)
+	}
+}
+
+// ticker runs in its own goroutine until the game is over. It only sends
+// events to the broker, the players of the room must not be touched here.
+func (r *room) ticker(stop <-chan bool, stopped chan bool) {
+	r.server.log.Debug("Ticker started", "room", r.id)
+	defer func() {
+		r.ticking.UnSet()
+		close(stopped)
+	}()
+	done := false
+	// ticks are handled by the broker so that the game model is only
+	// touched from one goroutine
+	for sec := r.server.cfg.CountdownSeconds; sec > 0 && !done; {
+		if r.paused.IsSet() {
+			done = wait(stop, r.server.cfg.TickInterval)
+			continue
+		}
+		select {
+		case r.server.ticks <- tickEvent{r, sec}:
+		case <-stop:
+			done = true
+			continue
+		}
+		done = wait(stop, time.Second)
+		sec--
+	}
+	// a time.Ticker keeps the cadence, however long the broker takes to
+	// handle a tick, and the stop is noticed right away in every state
+	ticker := time.NewTicker(r.server.cfg.TickInterval)
+	defer ticker.Stop()
+	for !done {
+		select {
+		case <-ticker.C:
+			if r.paused.IsSet() {
+				continue
+			}
+			select {
+			case r.server.ticks <- tickEvent{room: r}:
+			case <-stop:
+				done = true
+			}
+		case <-stop:
+			done = true
+		}
+	}
+	r.server.log.Debug("Ticking stopped", "room", r.id)
+}
+
+// wait sleeps for the given duration in the ticker, and tells whether the
+// ticker was stopped in the meantime.
+func wait(stop <-chan bool, d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return false
+	case <-stop:
+		return true
+	}
+}
+
+// sendAllClients sends the message to everyone in the room, except the player
+// with except_id. Clients whose connection fails are reported as
+// disconnected.
+func (r *room) sendAllClients(message string, except_id int) {
+	r.sendEachClient(func(*client) string { return message }, except_id)
+}
+
+// sendEachClient sends a message of its own to everyone in the room, except
+// the player with except_id. The message of each recipient is produced by
+// the function, nothing is sent to recipients it returns an empty string for.
+func (r *room) sendEachClient(message func(p *client) string, except_id int) {
+	sendTo := func(p *client) {
+		if m := message(p); m != "" {
+			r.server.trace(p.conn, "out", m)
+			if err := send(p.conn, m); err != nil {
+				r.server.reportBroken(p, err)
+			}
+		}
+	}
+	for _, p := range r.players {
+		if p.id != except_id && !p.disconnected {
+			sendTo(p)
+		}
+	}
+	for _, p := range r.spectators {
+		sendTo(p)
+	}
+}
+
+func (r *room) isAllReady() bool {
+	if len(r.players) < r.server.cfg.MinPlayers {
+		return false
+	}
+	for i := range r.players {
+		if !r.players[i].ready {
+			return false
+		}
+	}
+	return true
+}
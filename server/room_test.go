@@ -0,0 +1,268 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/tron_server/jsontypes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRoomTickerStop(t *testing.T) {
+	s, _ := CreateWithConfig(Config{TickInterval: 5 * time.Millisecond, CountdownSeconds: -1})
+	r := newRoom(s, "test")
+	r.startTicker()
+	select {
+	case <-s.ticks:
+	case <-time.After(time.Second):
+		t.Fatal("ticker should tick")
+	}
+	r.close()
+	if r.ticking.IsSet() {
+		t.Fatal("ticker should be stopped when close returns")
+	}
+	select {
+	case <-s.ticks:
+		t.Fatal("no tick should arrive after the ticker stopped")
+	case <-time.After(10 * s.cfg.TickInterval):
+	}
+}
+
+func TestRoomBrokenConnection(t *testing.T) {
+	s, _ := CreateWithConfig(Config{})
+	conn, remote := net.Pipe()
+	remote.Close()
+	p := &client{id: 1, conn: conn}
+	s.clients[p.id] = p
+	s.joinRoom(p, defaultRoom)
+
+	p.room.sendAllClients(`{"type":"ping"}`, -1)
+	select {
+	case d := <-s.dconns:
+		if d.id != p.id || d.reason != "error" {
+			t.Fatalf("unexpected disconnect %+v", d)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("failing write should report a disconnect")
+	}
+	p.room.sendAllClients(`{"type":"ping"}`, -1)
+	select {
+	case d := <-s.dconns:
+		t.Fatalf("client should be reported once, got %+v", d)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// shortWriteConn writes at most a few bytes at once, like a connection with
+// a tiny write buffer.
+type shortWriteConn struct {
+	net.Conn
+}
+
+func (c shortWriteConn) Write(b []byte) (int, error) {
+	if len(b) > 3 {
+		b = b[:3]
+	}
+	return c.Conn.Write(b)
+}
+
+func TestRoomPartialWrites(t *testing.T) {
+	s, _ := CreateWithConfig(Config{})
+	conn, remote := net.Pipe()
+	defer remote.Close()
+	p := &client{id: 1, conn: shortWriteConn{conn}}
+	s.clients[p.id] = p
+	s.joinRoom(p, defaultRoom)
+
+	message := `{"type":"ping"}`
+	go p.room.sendAllClients(message, -1)
+	remote.SetReadDeadline(time.Now().Add(time.Second))
+	line, err := bufio.NewReader(remote).ReadString('\n')
+	if err != nil {
+		t.Fatalf("message should arrive, got %s", err.Error())
+	}
+	if line != message+"\n" {
+		t.Fatalf("message should arrive in one piece, got %q", line)
+	}
+	select {
+	case d := <-s.dconns:
+		t.Fatalf("partial writes should not disconnect, got %+v", d)
+	default:
+	}
+}
+
+func TestRoomUnreadConnection(t *testing.T) {
+	s, _ := CreateWithConfig(Config{SendQueueSize: 4, WriteTimeout: 50 * time.Millisecond})
+	conn, remote := net.Pipe()
+	defer remote.Close()
+	p := &client{id: 1, conn: newQueuedConn(conn, s.cfg, s.metrics)}
+	s.clients[p.id] = p
+	s.joinRoom(p, defaultRoom)
+
+	// nobody reads the other end of the pipe, so every write blocks
+	sent := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			p.room.sendAllClients(`{"type":"ping"}`, -1)
+		}
+		close(sent)
+	}()
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Fatal("sending should not block on a client which does not read")
+	}
+	select {
+	case d := <-s.dconns:
+		if d.id != p.id || d.reason != "error" {
+			t.Fatalf("unexpected disconnect %+v", d)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("client which does not read should be disconnected")
+	}
+}
+
+func TestRoomDropPolicy(t *testing.T) {
+	s, _ := CreateWithConfig(Config{SendQueueSize: 2, SendQueuePolicy: DropPolicy})
+	conn, remote := net.Pipe()
+	defer remote.Close()
+	q := newQueuedConn(conn, s.cfg, s.metrics)
+	defer q.Close()
+
+	send(q, `{"type":"start_game"}`)
+	// wait until the writer blocks on the pipe with the first message
+	for {
+		q.mu.Lock()
+		n := len(q.queue)
+		q.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for _, msg := range []string{`{"type":"tick","n":1}`, `{"type":"tick","n":2}`, `{"type":"game_over"}`,
+		`{"type":"tick","n":3}`} {
+		if err := send(q, msg); err != nil {
+			t.Fatalf("sending %s failed: %v", msg, err)
+		}
+	}
+	reader := bufio.NewReader(remote)
+	for _, expected := range []string{`{"type":"start_game"}`, `{"type":"game_over"}`, `{"type":"tick","n":3}`} {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != expected+"\n" {
+			t.Fatalf("expected %s, got %s", expected, line)
+		}
+	}
+	if n := q.dropped.Load(); n != 2 {
+		t.Fatalf("2 ticks should be dropped, got %d", n)
+	}
+	if n := s.metrics.droppedMessages.Load(); n != 2 {
+		t.Fatalf("drops should be counted in the metrics, got %d", n)
+	}
+
+	// critical messages are never dropped
+	for i := 0; i < 3; i++ {
+		send(q, `{"type":"game_over"}`)
+	}
+	if err := send(q, `{"type":"game_over"}`); err != errSlowClient {
+		t.Fatalf("client should be too slow, got %v", err)
+	}
+}
+
+func TestRoomBrokenPipe(t *testing.T) {
+	s, _ := CreateWithConfig(Config{})
+	conn, remote := net.Pipe()
+	p := &client{id: 1, conn: conn}
+	s.clients[p.id] = p
+	s.joinRoom(p, defaultRoom)
+
+	// the client is gone, but the server did not read from it yet
+	remote.Close()
+	s.handleBroadcast(`{"type":"broadcast","message":"hello"}`)
+	select {
+	case d := <-s.dconns:
+		if d.id != p.id || d.reason != "error" {
+			t.Fatalf("unexpected disconnect %+v", d)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("failed write should disconnect the client")
+	}
+	s.sendMessage(p.conn, `{"type":"ping"}`)
+	select {
+	case d := <-s.dconns:
+		t.Fatalf("client should be disconnected once, got %+v", d)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestRoomSendEachClient(t *testing.T) {
+	s, _ := CreateWithConfig(Config{})
+	r := newRoom(s, "test")
+	conns := make([]net.Conn, 0, 2)
+	for id := 1; id <= 2; id++ {
+		conn, remote := net.Pipe()
+		defer remote.Close()
+		conns = append(conns, remote)
+		// subscribing would send lobby updates to the pipes already
+		r.players = append(r.players, &client{id: id, conn: conn, room: r, color: r.colors.next()})
+	}
+
+	go r.sendEachClient(r.lobbyUpdate, -1)
+	for i, conn := range conns {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		update := jsontypes.LobbyUpdate{}
+		json.Unmarshal([]byte(line), &update)
+		for j, player := range update.Players {
+			if player.IsSelf != (i == j) {
+				t.Fatalf("only the entry of player %d should be marked, got %s", i+1, line)
+			}
+		}
+	}
+}
+
+func TestRoomSuddenDeathAnnouncesChanges(t *testing.T) {
+	s, _ := CreateWithConfig(Config{Width: 10, Height: 10, MaxGameDuration: time.Millisecond})
+	conn, remote := net.Pipe()
+	defer remote.Close()
+	lines := make(chan string, 100)
+	go func() {
+		scanner := bufio.NewScanner(remote)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+	p := &client{id: 1, conn: conn}
+	s.clients[p.id] = p
+	s.joinRoom(p, defaultRoom)
+	r := p.room
+	r.game = newGame(nil, s.cfg.Width, s.cfg.Height, s.rnd)
+
+	for i := 0; i < 10; i++ {
+		r.game.ticks++
+		s.suddenDeath(r)
+	}
+	shrinks := 0
+	for done := false; !done; {
+		select {
+		case line := <-lines:
+			data := &jsontypes.SimpleData{}
+			json.Unmarshal([]byte(line), data)
+			if data.Type == "shrink" {
+				shrinks++
+			}
+		case <-time.After(50 * time.Millisecond):
+			done = true
+		}
+	}
+	if shrinks != 4 {
+		t.Fatalf("only the 4 shrinks down to the minimum size should be announced, got %d", shrinks)
+	}
+}
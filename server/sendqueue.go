@@ -0,0 +1,178 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/tron_server/jsontypes"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Policies for clients whose send queue is full, see Config.SendQueuePolicy.
+const (
+	DisconnectPolicy = ""
+	DropPolicy       = "drop"
+)
+
+// droppableTypes are the types of the messages which may be dropped for slow
+// clients, since later messages supersede them. Every other message is
+// critical.
+var droppableTypes = map[string]bool{
+	"tick":         true,
+	"countdown":    true,
+	"latency":      true,
+	"lobby_update": true,
+	"auto_start":   true,
+}
+
+// errSlowClient is returned when writing to a client whose send queue is
+// full, since it does not read its messages fast enough.
+var errSlowClient = errors.New("Send queue is full")
+
+// queuedMessage is a message waiting in the send queue.
+type queuedMessage struct {
+	b         []byte
+	droppable bool
+}
+
+// queuedConn is a connection whose writes never block. Written messages are
+// queued, and written to the connection by a goroutine of their own, so the
+// broker is not stalled by a client which does not read. When the queue is
+// full, the oldest droppable message is dropped if the policy allows it,
+// otherwise the write fails. Writes fail as well once a write to the
+// connection failed or took longer than the write timeout. The connection is
+// closed then.
+type queuedConn struct {
+	net.Conn
+	timeout time.Duration
+	size    int
+	policy  string
+	metrics *Metrics
+	dropped atomic.Int64 // number of messages dropped
+
+	mu      sync.Mutex
+	cond    *sync.Cond // signalled when a message is queued or the queue is closed
+	queue   []queuedMessage
+	keepAll bool // whether nothing may be dropped, see keepEverything
+	closed  bool
+	err     error // error of the last write to the connection
+}
+
+func newQueuedConn(c net.Conn, cfg Config, m *Metrics) *queuedConn {
+	q := &queuedConn{Conn: c, timeout: cfg.WriteTimeout, size: cfg.SendQueueSize, policy: cfg.SendQueuePolicy,
+		metrics: m}
+	q.cond = sync.NewCond(&q.mu)
+	go q.writer()
+	return q
+}
+
+// keepEverything makes sure no message is dropped, e.g. because the messages
+// form a compressed stream.
+func (q *queuedConn) keepEverything() {
+	q.mu.Lock()
+	q.keepAll = true
+	q.mu.Unlock()
+}
+
+func (q *queuedConn) Write(b []byte) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return 0, q.err
+	}
+	if q.closed {
+		return 0, net.ErrClosed
+	}
+	m := queuedMessage{b: append([]byte(nil), b...)}
+	if q.policy == DropPolicy && !q.keepAll {
+		m.droppable = droppableTypes[messageType(b)]
+	}
+	if len(q.queue) >= q.size {
+		switch {
+		case q.dropOldest():
+		case m.droppable:
+			q.countDrop()
+			return len(b), nil
+		default:
+			q.err = errSlowClient
+			q.cond.Signal()
+			// unblock the reader of the connection
+			q.Conn.Close()
+			return 0, q.err
+		}
+	}
+	q.queue = append(q.queue, m)
+	q.cond.Signal()
+	return len(b), nil
+}
+
+// dropOldest removes the oldest droppable message from the queue. It tells
+// whether there was one.
+func (q *queuedConn) dropOldest() bool {
+	for i, m := range q.queue {
+		if m.droppable {
+			q.queue = append(q.queue[:i], q.queue[i+1:]...)
+			q.countDrop()
+			return true
+		}
+	}
+	return false
+}
+
+func (q *queuedConn) countDrop() {
+	q.dropped.Add(1)
+	q.metrics.droppedMessages.Add(1)
+}
+
+// Close closes the connection once the messages queued before are written.
+func (q *queuedConn) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.cond.Signal()
+	return nil
+}
+
+// writer writes the queued messages to the connection until the queue is
+// closed and empty, or a write failed, then closes the connection.
+func (q *queuedConn) writer() {
+	for {
+		q.mu.Lock()
+		for len(q.queue) == 0 && !q.closed && q.err == nil {
+			q.cond.Wait()
+		}
+		if len(q.queue) == 0 || q.err != nil {
+			q.mu.Unlock()
+			break
+		}
+		m := q.queue[0]
+		q.queue = q.queue[1:]
+		q.mu.Unlock()
+
+		q.Conn.SetWriteDeadline(time.Now().Add(q.timeout))
+		if err := writeAll(q.Conn, m.b); err != nil {
+			q.mu.Lock()
+			q.err = err
+			q.mu.Unlock()
+			break
+		}
+	}
+	q.Conn.Close()
+}
+
+// messageType returns the type of the framed message, or "" if it cannot be
+// read, e.g. because the message is compressed.
+func messageType(b []byte) string {
+	i := bytes.IndexByte(b, '{')
+	if i < 0 {
+		return ""
+	}
+	envelope := jsontypes.SimpleData{}
+	if err := json.Unmarshal(b[i:], &envelope); err != nil {
+		return ""
+	}
+	return envelope.Type
+}
@@ -1,4 +1,5 @@
-// Package server implements a TCP server for playing Tron.
+// Package server implements a TCP server for playing Tron. Browser clients may
+// connect over WebSocket with the same protocol, see StartWebSocket.
 //
 // The communication protocol is the following:
 //
@@ -6,316 +7,1747 @@
 // triggered:
 //	{ "type" : "connect", "color" : "#435654" }
 // Color is the color of the car given to the player, and type helps the client
-// interpret the message.
+// interpret the message. If the default room already has the maximum number of
+// players, the connection is closed after the message:
+//	{ "type" : "error", "code" : "SERVER_FULL" }
+// The same message is sent right away, before anything else, if the server is
+// configured with a maximum number of connections and has reached it.
+//
+// If the server is configured with a message of the day, it follows the first
+// connect message, before the lobby update:
+//	{ "type" : "motd", "message" : "Welcome! Be nice." }
+//
+// The connect message also contains the id of the player:
+//	{ "type" : "connect", "color" : "#435654", "player_id" : 0 }
+// The identity of the recipient is repeated in you_are, which only connect
+// messages contain:
+//	"you_are" : { "color" : "#435654", "player_id" : 0, "name" : "alice" }
+// Colors of players who left are given to new players, but ids are never
+// reused, and they are kept when reconnecting. The start_game message lists
+// the ids in the order of the colors:
+//	"player_ids" : [0, 1]
+// and relayed player_event messages carry the id of the sender:
+//	{ "type" : "player_event", "color" : "#435654", "player_id" : 0, "event" : { ... } }
+//
+// If the server is configured with authentication, clients have to
+// authenticate first, before they get their connect message:
+//	{ "type" : "auth", "token" : "<secret>" }
+// Clients sending an invalid token or anything else, or nothing within the
+// auth timeout, are disconnected after the message:
+//	{ "type" : "error", "code" : "UNAUTHORIZED" }
+//
+// The connect message also contains the version of the protocol spoken by the
+// server:
+//	{ "type" : "connect", "color" : "#435654", "protocol" : 2 }
+// Clients may tell the version they speak with:
+//	{ "type" : "hello", "protocol" : 2 }
+// Clients speaking another version are disconnected after the message:
+//	{ "type" : "error", "code" : "PROTOCOL_MISMATCH" }
+// The connect message lists the optional features enabled on the server, out
+// of compression, powerups, spectate and timestamps:
+//	"features" : ["spectate", "powerups"]
+// Clients may list the features they support in their hello message, the
+// protocol may be left out:
+//	{ "type" : "hello", "protocol" : 2, "features" : ["powerups"] }
+//	{ "type" : "hello", "features" : ["compression", "powerups"] }
+// The messages of a feature are only sent to clients supporting it, i.e.
+// powerup_spawn and powerup_collected only to clients supporting powerups.
+// Clients which do not list their features get every message.
 //
 // After that, the server might be given a chat or a ready message:
 //	{ "type" : "chat", "color" : "#453565", "message" : "my example message" }
 //	{ "type" : "ready" }
-// Ready indicates that the player is ready to move to the game phase.
-// Chat messages are broadcasted to all players except the sender.
+// Ready indicates that the player is ready to move to the game phase. The game
+// starts as soon as every player of the room is ready. Players may take back
+// their ready before that:
+//	{ "type" : "unready" }
+// Sending ready when ready already, or unready when not ready, has no effect.
+// Chat messages are broadcasted to all players except the sender, with the
+// color and name of the sender filled in by the server. Chat messages with a
+// recipient color are only delivered to the recipient, and echoed to the
+// sender:
+//	{ "type" : "chat", "to" : "#325465", "message" : "psst" }
+// Chat messages are at most 500 characters long by default, longer ones are
+// refused with:
+//	{ "type" : "error", "code" : "CHAT_TOO_LONG", "message" : "..." }
+// Clients may send 5 chat messages per second by default, messages over the
+// limit are refused with a RATE_LIMITED error.
+// If the server is configured with a chat history, players joining a room get
+// the last chat messages broadcasted in it, oldest first:
+//	{ "type" : "chat_history", "messages" : [{ "type" : "chat", "color" : "#453565",
+//	  "message" : "my example message" }]}
+//
+// The host may choose the mode of the games of the room in the lobby:
+//	{ "type" : "set_mode", "mode" : "classic" }
+// A mode is a preset of the obstacles, power-ups, trail expiry and sudden
+// death. The built-in modes are classic, powerups, arena, fading and
+// sudden_death, the server may be configured with more. The mode is announced
+// to the room with the same message, and it is listed in the lobby updates
+// and in the start_game message:
+//	"mode" : "classic"
+// Rooms without a mode play with the settings of the server. Unknown modes
+// are refused with a BAD_MESSAGE error.
+//
+// Players may choose a name in the lobby:
+//	{ "type" : "set_name", "name" : "alice" }
+// Names are at most 20 characters long. The name is announced to every player:
+//	{ "type" : "set_name", "color" : "#453565", "name" : "alice" }
 //
 // If all the connections sent a ready message, the server notifies the clients:
-//	{ "type" : "start_game", "colors" : ["#123456", "#325465"] }
-// Colors contain the color of players in game. The clients should render the
-// map, but the actual game should not start yet.
+//	{ "type" : "start_game", "colors" : ["#123456", "#325465"], "names" : ["alice", "bob"],
+//	  "width" : 100, "height" : 100 }
+// Colors contain the color of players in game, names contain their names in
+// the same order. Width and height are the size of the map in cells. Spawns
+// contain the starting position and direction of every car:
+//	"spawns" : [{ "color" : "#123456", "x" : 10, "y" : 33, "direction" : "right" }]
+// Obstacles contain the cells blocked on the map, if the server is configured
+// with obstacles:
+//	"obstacles" : [{ "x" : 30, "y" : 30 }]
+// Cars running into obstacles die like running into trails, even invincible
+// ones.
+// If the server is configured with a TTL of the trails, the cells of the trails
+// are removed after the given number of ticks, and cars may drive through them
+// again. The removed cells are announced before the tick message of the step
+// they are removed in:
+//	{ "type" : "trail_expire", "color" : "#ff0000", "x" : 5, "y" : 7 }
+// Coordinates start from the top left corner of the map. The clients should
+// render the map, but the actual game should not start yet.
 //
-// One of the players should start the game with the message:
+// The host of the room should start the game with the message:
 //	{"type" : "start"}
+// The first player joining a room is its host, which is marked in its connect
+// message with "host" : true. Start messages of other players are refused with:
+//	{ "type" : "error", "code" : "NOT_HOST" }
+// If the host leaves, the next player becomes the host, announced with:
+//	{ "type" : "host", "color" : "#325465" }
 //
-// Server starts ticking as a response. The message:
-//	{"type" : "tick"}
+// The server counts down as a response, sending every second:
+//	{ "type" : "countdown", "seconds" : 3 }
+// If a player disconnects during the countdown, it is cancelled with the
+// message below, and the game has to be started again:
+//	{"type" : "countdown_cancelled"}
+//
+// Server starts ticking after the countdown. The message:
+//	{"type" : "tick", "n" : 1}
 // is periodically sent to every client. Ticking indicates the elapse of time
-// and also keep the clients synchronized.
+// and also keep the clients synchronized. N is the number of the tick, it
+// starts from 1 in every game and increases by one with each tick, so clients
+// can detect missed ticks.
+//
+// If the server is configured with timestamps, the start_game, tick and
+// relayed player_event messages contain the time elapsed since the start of
+// the game in milliseconds, so clients can estimate the latency:
+//	{ "type" : "tick", "n" : 5, "ts" : 520 }
+// Start_game has the timestamp 0.
+//
+// If the server is configured to batch events, player_event messages are not
+// relayed right away. The events arriving between two ticks are sent in one
+// message right before the tick they are applied in, to every player including
+// the sender, with the color of the sender filled in:
+//	{ "type" : "events", "tick" : 42, "events" : [{ "type" : "player_event",
+//	  "color" : "#ff0000", "event" : { "direction" : "up", ... } }] }
+//
+// Any player may pause the game in progress with:
+//	{"type" : "pause"}
+// The server stops ticking and the players get the message:
+//	{"type" : "paused"}
+// Pings are still sent while paused. Ticking continues after the message:
+//	{"type" : "resume"}
+// which is announced to the players with:
+//	{"type" : "resumed"}
+//
+// Players may speed up their car in the game phase:
+//	{ "type" : "player_event", "event" : { "boost" : true } }
+// A boosted car moves two cells per tick for a while, after the boost it has
+// to cool down before the next one. Start and end of boosts are announced:
+//	{ "type" : "boost", "color" : "#ff0000", "active" : true }
+// Boosts during the cooldown are refused with:
+//	{ "type" : "error", "code" : "BOOST_UNAVAILABLE" }
+//
+// If the server is configured with power-ups, they appear on free cells of the
+// map during the game:
+//	{ "type" : "powerup_spawn", "id" : 1, "kind" : "speed", "x" : 12, "y" : 40 }
+// The car entering the cell collects the power-up, which is announced with:
+//	{ "type" : "powerup_collected", "id" : 1, "color" : "#ff0000" }
+// Speed boosts the car, invincible lets the car drive through trails for a
+// while, and clear removes the trail of the car.
+//
+// The server keeps track of the position and trail of every car. On each tick
+// cars move one cell in their current direction, which clients change with
+// player_event messages. Direction is one of up, down, left and right. Cars
+// cannot turn back against the direction of their last move, such turns are
+// not relayed, and the sender gets:
+//	{ "type" : "error", "code" : "ILLEGAL_MOVE" }
+// When a car leaves the map or runs into a trail, its death is announced to
+// every client:
+//	{ "type" : "player_dead", "color" : "#ff0000" }
+// The player of the car is told as well, so it can switch to spectating:
+//	{ "type" : "you_died" }
+// Dead players still get the messages of the game until it is over, but
+// their player_event messages are ignored.
+// If the server is configured with a maximum game duration, games running
+// longer are decided in sudden death: the map shrinks by one cell on every
+// side at a regular interval of ticks. The playable area is announced with
+// its top left cell and size before the tick message:
+//	{ "type" : "shrink", "bounds" : { "x" : 1, "y" : 1, "width" : 98, "height" : 98 } }
+// Cars outside the area crash.
+//
+// When a player loses its connection, the others in the room are told why:
+//	{ "type" : "player_left", "color" : "#0000ff", "reason" : "closed" }
+// Reason is closed if the client closed the connection, timeout if it stopped
+// answering, or error. Clients which do not read their messages fast enough
+// are disconnected with the reason error as well, so they cannot hold up the
+// others. If the server is configured to drop messages instead, tick,
+// countdown, latency, lobby_update and auto_start messages of slow clients
+// may be dropped, but no other message. During the game, the car of the
+// player crashes as well.
+// Clients may leave cleanly in any phase with:
+//	{ "type" : "leave" }
+// The server closes the connection, and the others are told with the reason
+// left. Players who left cannot reconnect.
+//
+// If the server is configured with teams, every player is put in the smallest
+// team when joining a room. Players may choose another team in the lobby:
+//	{ "type" : "set_team", "team" : 1 }
+// Teams are numbered from 0, and they are listed in the lobby updates:
+//	"players" : [{ "color" : "#ff0000", "ready" : false, "team" : 1 }]
+// and in the start_game message:
+//	"teams" : [{ "color" : "#ff0000", "team" : 1 }]
+// Cars of the same team drive through the trails of each other.
+//
+// The game is over when at most one car is left alive, or in a game of a
+// single player, when its car crashed. The server stops ticking and announces
+// the winner:
+//	{ "type" : "game_over", "winner" : "#00ff00" }
+// Winner is null if the last cars died in the same tick. Team games are over
+// when at most one team has cars left, which is announced with:
+//	{ "type" : "game_over", "winning_team" : 1 }
+// Winning team is null if the last cars died in the same tick. Every player of
+// the winning team gets a win. After that the room is back in the lobby phase,
+// and players have to send ready again to play another round. The number of
+// rounds won by each player of the room follows:
+//	{ "type" : "scoreboard", "scores" : [{ "color" : "#00ff00", "wins" : 2 }] }
+// Players may ask for a rematch, which makes them ready:
+//	{ "type" : "rematch" }
+// The request is announced to the room with the color of the player:
+//	{ "type" : "rematch", "color" : "#00ff00" }
+// The rematch starts when everyone in the room is ready. Players who do not
+// ask for a rematch or get ready within the rematch timeout are moved to the
+// default room, which the others are told with a player_left message with
+// the reason rematch_timeout. Rematch requests after the timeout are refused
+// with:
+//	{ "type" : "error", "code" : "REMATCH_UNAVAILABLE" }
+// Scores are kept as long as the room is open, players may reset them in the
+// lobby with:
+//	{ "type" : "reset_scores" }
+//
+// The server hosts several independent rooms. Every message above is only
+// delivered to players of the same room. New connections are put in the
+// default room. In the lobby phase a player may move to another room, which is
+// created if it does not exist yet:
+//	{ "type" : "join_room", "room" : "abc" }
+// The player gets a new color in the room, announced with a connect message:
+//	{ "type" : "connect", "color" : "#435654", "room" : "abc" }
+// If the room is full or its game already started, the player stays in the
+// original room and gets the message:
+//	{ "type" : "error", "code" : "ROOM_UNAVAILABLE" }
+// Clients may ask for the list of rooms in any phase, e.g. to choose one to
+// join:
+//	{ "type" : "list_rooms" }
+// The server answers with the id, number of players and phase of every room,
+// and whether new players can join it:
+//	{ "type" : "room_list", "rooms" : [{ "id" : "game-1", "players" : 2,
+//	  "phase" : "game", "joinable" : false }] }
+// Instead of playing, a client in the lobby phase may watch the games of a room
+// as a spectator. Room is optional, the default is the current room of the
+// client:
+//	{ "type" : "spectate", "room" : "game-1" }
+// Spectators give up their color and get every message of the room, also when
+// the game is already in progress. They are confirmed with the message:
+//	{ "type" : "spectate", "room" : "game-1" }
+// Other messages of spectators are ignored. If the server is configured with a
+// maximum number of spectators, in total or from the same IP address, clients
+// over the limit stay players, and get the message:
+//	{ "type" : "error", "code" : "SPECTATORS_FULL" }
+//
+// Clients in the lobby phase may watch the replays played back by the server,
+// see PlayReplay:
+//	{ "type" : "watch_replay" }
+// They become spectators of the room replays, which players cannot join. A
+// playback starts with the recorded start_game message, followed by the
+// recorded player_event and powerup_spawn messages, each before the tick
+// message of the tick they arrived in, and the game_over message. Clients
+// starting to watch during a playback get its start_game message right away,
+// then the messages of the next tick.
+//
+// Spectators joining during the game, and players reconnecting to a game get
+// the state of the game right away:
+//	{ "type" : "state", "tick" : 42, "cars" : [{ "color" : "#ff0000", "x" : 10, "y" : 20,
+//	  "direction" : "right", "alive" : true, "trail" : [{ "x" : 9, "y" : 20 }] }] }
+// Tick is the number of the last tick, trail contains every cell covered by
+// the trail of the car, including the cell of the car.
+//
+// If the server is configured with compression, the connect message tells the
+// compression mode of the connection:
+//	{ "type" : "connect", "color" : "#435654", "compression" : "flate" }
+// Everything after the first connect message is compressed with flate in both
+// directions, including the messages sent by the client, which should compress
+// its messages from the start. Messages are still delimited by newlines inside
+// the compressed stream, and the stream is flushed after every message.
+// WebSocket connections are not compressed.
+//
+// Messages are delimited by newlines by default. If the server is configured
+// with length-prefixed framing, the connect message tells the framing of the
+// connection:
+//	{ "type" : "connect", "color" : "#435654", "framing" : "length" }
+// Every message after the first connect message, in both directions, is
+// prefixed with its length in bytes as a 4 byte big-endian integer, and it is
+// not terminated by a newline. Messages may contain any bytes then. WebSocket
+// connections keep sending one message per frame.
+//
+// The connect message also contains a token:
+//	{ "type" : "connect", "color" : "#435654", "token" : "<uuid>" }
+// If the connection of a player drops, the server keeps its slot for a grace
+// period. In the meantime the player can open a new connection and reclaim its
+// slot with the message:
+//	{ "type" : "reconnect", "token" : "<uuid>" }
+// The server answers with a connect message containing the original color and
+// room of the player. Invalid tokens are refused with:
+//	{ "type" : "error", "code" : "INVALID_TOKEN" }
 //
-// End of game is not yet implemented. Clients handle all the game logic now.
+// The server pings every client periodically, in every phase:
+//	{"type" : "ping"}
+// Clients have to answer with:
+//	{"type" : "pong"}
+// Clients who miss several pongs in a row are disconnected. If the server is
+// configured with a latency interval, the round trip time of the pings of a
+// player is announced to its room in the lobby phase, at most once per
+// interval:
+//	{ "type" : "latency", "color" : "#ff0000", "ms" : 34 }
+//
+// If a lobby idle timeout is configured, and no client sends a message other
+// than pong within the timeout while no game is running, every client gets the
+// message below, and the server shuts down:
+//	{ "type" : "error", "code" : "IDLE_TIMEOUT" }
+//
+// Clients sending more messages than the rate limit have the messages over
+// the limit dropped, and get the message:
+//	{ "type" : "error", "code" : "RATE_LIMITED" }
+//
+// Malformed messages and messages of unknown type are answered with an error
+// describing the problem:
+//	{ "type" : "error", "code" : "BAD_MESSAGE", "message" : "..." }
+// Messages with fields unknown to their phase, or without the fields required
+// by their type, e.g. a chat without message, are answered with:
+//	{ "type" : "error", "code" : "INVALID_FIELDS", "message" : "..." }
+//
+// Messages may be at most 64KB long by default. Clients sending larger
+// messages are disconnected after the message:
+//	{ "type" : "error", "code" : "MESSAGE_TOO_LARGE" }
+//
+// In the lobby phase, every player of the room gets the list of players after
+// its connect message, and whenever a player joins, leaves or changes its
+// ready state:
+//	{ "type" : "lobby_update", "players" : [{ "color" : "#ff0000", "name" : "alice", "ready" : true }],
+//	  "waiting" : ["#00ff00"]}
+// The entry of the recipient is marked with:
+//	"is_self" : true
+// Waiting contains the colors of the players the game is waiting for. The game
+// starts when nobody is left to wait for, also if the last player not ready
+// leaves the room.
+//
+// The host may remove a player from the room in the lobby phase:
+//	{ "type" : "kick", "color" : "#325465" }
+// The kicked player gets the message below, and its connection is closed:
+//	{"type" : "kicked"}
+//
+// Instead of choosing a room, players in the lobby phase may ask for a quick
+// match:
+//	{ "type" : "quick_match" }
+// As soon as enough players asked for it, they are moved to a new room, and
+// told the colors of the players of the match, after their connect message:
+//	{ "type" : "matched", "room" : "match-1", "players" : ["#ff0000", "#00ff00"] }
+// The players of the match are ready, so the game starts right away. If not
+// enough players ask for a quick match in time, the players waiting are
+// matched anyway, and bots fill up the room to the minimum number of players.
+//
+// The host may fill the room with bots played by the server:
+//	{ "type" : "add_bot" }
+// Bots join like new players and they are always ready. They are removed
+// from the room when the game is over.
+//
+// If automatic starts are configured, lobbies do not wait for their players
+// forever. Shortly before the wait is over, the players get the message:
+//	{ "type" : "auto_start", "seconds" : 5 }
+// Then the lobby is filled up with bots if it has less than the minimum number
+// of players, two by default, and the game starts, ready or not.
+//
+// The server may be drained before shutting down. New connections are refused,
+// and every client gets the message below. Games in progress are played to the
+// end, but no new game is started, and the server shuts down after the last
+// game is over:
+//	{"type" : "draining"}
+//
+// When a game starts in the default room, the room is renamed and a new default
+// room is opened for new connections. Empty rooms are closed. The server keeps
+// running without rooms, unless it is configured to shut down when all rooms
+// are closed.
+//
+// If the server is configured with an admin address, operators may control it
+// over a separate listener, which players do not reach. The commands are JSON
+// messages, one per line, each answered on the same connection:
+//	{ "type" : "stats" }
+//	{ "type" : "broadcast", "message" : "Restarting in 5 minutes" }
+//	{ "type" : "kick", "room" : "game-1", "color" : "#325465" }
+//	{ "type" : "shutdown" }
+// Stats is answered with the uptime in milliseconds, the number of clients and
+// the rooms, like room_list:
+//	{ "type" : "stats", "uptime" : 60000, "clients" : 3, "rooms" : [...] }
+// Broadcast sends the message to every client:
+//	{ "type" : "broadcast", "message" : "Restarting in 5 minutes" }
+// Kick removes the player with the color from the room in any phase. The room
+// is required, the id of the default room is "". The player gets the kicked
+// message, and the others are told with the reason kicked, like a leave. The
+// other commands are answered with:
+//	{ "type" : "ok" }
+// Failing commands are answered with an error message, like the messages of
+// players.
 package server
 
 import (
-	"bufio"
-	"container/list"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/tevino/abool"
 	"github.com/tron_server/jsontypes"
+	"io"
+	"log/slog"
+	"math/rand"
 	"net"
+	"os"
+	"sort"
 	"strings"
+	"sync/atomic"
 	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
+// ProtocolVersion is the version of the protocol spoken by the server.
+const ProtocolVersion = 2
+
 type msgFormat struct {
-	senderId int
+	senderId int // connection id
 	msg      string
 }
 
 type Server struct {
-	players []*client
+	rooms   map[string]*room
+	clients map[int]*client    // connection id -> client
+	tokens  map[string]*client // reconnect token -> client
 	conns   chan net.Conn
 	msgs    chan msgFormat
-	dconns  chan int // id
+	dconns  chan disconnect
+	ticks   chan tickEvent
+	expired chan holdExpiry
+	pings   chan bool
+	// lobbies which waited long enough for their players
+	autoStarts chan autoStartEvent
+	// requests of a state snapshot, see Stats
+	statsReqs chan chan ServerStats
+	// requests of the list of rooms, see Rooms
+	roomsReqs chan chan []RoomInfo
+	drains    chan bool
+	// messages of Broadcast
+	broadcasts chan string
+	// rooms which waited long enough for rematches
+	rematchTimeouts chan rematchEvent
+	// waits for full quick matches which are over, see armMatchTimeout
+	matchTimeouts chan int
+	// replays to play back, see PlayReplay
+	playbacks     chan *playback
+	playbackSteps chan playbackStep
+	// players waiting for a quick match, in the order they asked for it
+	matchQueue []*client
+	matchWaits int // number of waits for a full match started
+	matches    int // number of quick matches formed, used for naming rooms
 
-	free_colors    *list.List
+	cfg            Config
+	log            *slog.Logger
+	tracer         *slog.Logger // logger of the messages, nil if they are not traced
+	traceFile      *os.File     // nil if the traces are not written to a file
+	metrics        *Metrics
+	lastReplay     atomic.Pointer[jsontypes.Replay]
+	replays        int // number of replays recorded
 	ids            int
-	phase          int
-	ticking        *abool.AtomicBool
-	stopTick       chan bool
+	games          int          // number of games started, used for naming rooms
+	rnd            *rand.Rand   // source of all randomness of the games, see Config.Seed
+	openConns      atomic.Int64 // number of open connections, see Config.MaxConnections
 	stopListen     chan bool
 	stopServer     chan bool
+	started        *abool.AtomicBool
+	done           chan bool // closed when the broker loop stopped
+	startTime      time.Time
 	serverListener net.Listener
+	addr           atomic.Value // net.Addr of serverListener, see Addr
+	wsListener     net.Listener
+	adminListener  net.Listener
+	adminCmds      chan adminRequest // commands of the admin listener
+	idleTimer      *time.Timer       // nil if the lobby idle timeout is disabled
+	// draining servers accept no connections and start no games, see
+	// Drain
+	draining bool
 }
 
 type client struct {
 	id    int
 	conn  net.Conn
+	queue *queuedConn // send queue of the connection, nil for bots
+	room  *room
 	color string
+	name  string
 	ready bool
+	// spectators get the messages of their room, but do not play
+	spectator bool
+	token     string
+	// disconnected players keep their slot for a while, so they can
+	// reconnect
+	disconnected bool
+	disconnects  int
+	lastPong     time.Time
+	missedPongs  int
+	pingSent     time.Time     // zero if no ping is waiting for a pong
+	latency      time.Duration // round trip time of the last ping
+	latencySent  time.Time     // last announcement of the latency
+	// bots are played by the server, they have no connection
+	bot bool
+	// rematch is set if the player asked for a rematch of the last game
+	rematch bool
+	// broken is set if writing to the connection failed
+	broken bool
+	team   int // team of the player in team games
+	// compression and framing of the connection, they are switched on
+	// after the first connect message
+	compression string
+	framing     string
+	upgraded    bool // whether they are switched on already
+	// features supported by the client, nil if it did not tell them
+	features map[string]bool
+	queued   bool // whether the client waits for a quick match
+	// chatLimiter limits the chat messages of the client, see
+	// Config.ChatRate
+	chatLimiter *rateLimiter
 }
 
-// Create initializes the server.
+const maxNameLength = 20 // in runes
+
+// sanitizeName removes control characters and surrounding spaces from a player
+// name, and truncates it to the maximum length.
+func sanitizeName(name string) string {
+	runes := make([]rune, 0, maxNameLength)
+	for _, r := range strings.TrimSpace(name) {
+		if unicode.IsControl(r) {
+			continue
+		}
+		if len(runes) == maxNameLength {
+			break
+		}
+		runes = append(runes, r)
+	}
+	return strings.TrimSpace(string(runes))
+}
+
+// Create initializes the server with the default configuration.
 func Create() *Server {
+	s, _ := CreateWithConfig(Config{}) // the defaults are valid
+	return s
+}
+
+// CreateWithConfig initializes the server with the given configuration. Unset
+// values of the configuration are replaced with the defaults. An error is
+// returned if the configuration is invalid.
+func CreateWithConfig(cfg Config) (*Server, error) {
+	cfg = cfg.withDefaults()
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	tracer, traceFile, err := newTracer(cfg)
+	if err != nil {
+		return nil, err
+	}
+	seed := cfg.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
 	s := Server{
-		players:     make([]*client, 0, 5),
-		conns:       make(chan net.Conn),
-		dconns:      make(chan int),
-		msgs:        make(chan msgFormat),
-		free_colors: list.New(),
-		stopTick:    make(chan bool, 1),
-		stopListen:  make(chan bool, 1),
-		stopServer:  make(chan bool, 1),
-		ticking:     abool.New(),
-	}
-	// TODO support more player
-	colors := []string{"#ff0000", "#00ff00", "#0000ff"}
-	for i := range colors {
-		s.free_colors.PushBack(colors[i])
-	}
-	return &s
-}
-
-func (s *Server) subscribe(p *client) {
-	s.players = append(s.players, p)
-	p.id = s.ids
-	s.ids++
-	e := s.free_colors.Front()
-	p.color = e.Value.(string)
-	fmt.Printf("Client subscribed. Color: %s\n", p.color)
-	s.free_colors.Remove(e)
-}
-
-func (s *Server) unsubscribe(p *client) {
-	for i, player := range s.players {
-		if p == player {
-			fmt.Printf("Client with color: %s unsubscribed\n", p.color)
-			// put back color
-			s.free_colors.PushBack(p.color)
-			// remove player
-			s.players = append(s.players[:i], s.players[i+1:]...)
+		cfg:        cfg,
+		rnd:        rand.New(rand.NewSource(seed)),
+		log:        cfg.Logger,
+		tracer:     tracer,
+		traceFile:  traceFile,
+		metrics:    newMetrics(),
+		rooms:      make(map[string]*room),
+		clients:    make(map[int]*client),
+		tokens:     make(map[string]*client),
+		conns:      make(chan net.Conn),
+		dconns:     make(chan disconnect),
+		msgs:       make(chan msgFormat),
+		ticks:      make(chan tickEvent),
+		expired:    make(chan holdExpiry),
+		pings:      make(chan bool),
+		statsReqs:  make(chan chan ServerStats),
+		roomsReqs:  make(chan chan []RoomInfo),
+		adminCmds:  make(chan adminRequest),
+		drains:     make(chan bool),
+		broadcasts: make(chan string),
+
+		rematchTimeouts: make(chan rematchEvent),
+		matchTimeouts:   make(chan int),
+		playbacks:       make(chan *playback),
+		playbackSteps:   make(chan playbackStep),
+		autoStarts:      make(chan autoStartEvent),
+		stopListen:      make(chan bool, 1),
+		stopServer:      make(chan bool, 1),
+		started:         abool.New(),
+		done:            make(chan bool),
+	}
+	return &s, nil
+}
+
+// joinRoom puts the player in the room with the given id. The room is created
+// if it does not exist yet.
+func (s *Server) joinRoom(p *client, id string) error {
+	r, ok := s.rooms[id]
+	if !ok {
+		r = newRoom(s, id)
+	}
+	if err := r.subscribe(p); err != nil {
+		return err
+	}
+	s.rooms[id] = r
+	if r.bots() == len(r.players)-1 && !p.bot {
+		// the first player to wait for
+		s.armAutoStart(r)
+	}
+	return nil
+}
+
+// nextRoomId returns the id of the prefix and the counter, which is advanced
+// as long as a room with the id exists, e.g. one a player created with
+// join_room.
+func (s *Server) nextRoomId(prefix string, counter *int) string {
+	for {
+		id := fmt.Sprintf("%s-%d", prefix, *counter)
+		if _, ok := s.rooms[id]; !ok {
+			return id
 		}
+		*counter++
+	}
+}
+
+// leaveRoom removes the player from its room, and closes the room if it became
+// empty.
+func (s *Server) leaveRoom(p *client) {
+	r := p.room
+	if r == nil {
+		return
+	}
+	r.unsubscribe(p)
+	if r.bots() == len(r.players) {
+		// bots do not play alone
+		s.removeBots(r)
+	}
+	s.closeIfEmpty(r)
+	// the player left might have been the only one not ready
+	s.maybeStart(r)
+}
+
+// maybeStart starts the game of the room if it is in the lobby phase and
+// every player is ready, unless the server is draining. It has to be called
+// whenever players join or leave the lobby, or change their ready state.
+func (s *Server) maybeStart(r *room) {
+	if r.phase == phaseLobby && r.isAllReady() && !s.draining {
+		s.startGame(r)
+	}
+}
+
+// closeIfEmpty closes the room if nobody is left in it, its chat history is
+// dropped with it.
+func (s *Server) closeIfEmpty(r *room) {
+	if r.empty() {
+		s.log.Info("Closing empty room", "room", r.id)
+		r.close()
+		r.chats = nil
+		delete(s.rooms, r.id)
+		s.finishDrain()
 	}
 }
 
 // Start starts the server. The server will listen on the port passed as an
-// argument.
-func (s *Server) Start(port string) {
+// argument, on all interfaces. An error is returned if the port cannot be
+// bound, otherwise Start returns when the server is shut down.
+func (s *Server) Start(port string) error {
+	return s.StartContext(context.Background(), port)
+}
+
+// StartAddr starts the server like Start, but listens on the given address,
+// e.g. "127.0.0.1:8765" or "[::1]:8765" to bind a single interface.
+func (s *Server) StartAddr(addr string) error {
+	return s.startAddr(context.Background(), addr)
+}
+
+// StartContext starts the server like Start. The server is shut down when the
+// context is cancelled, closing the listener and all connections.
+func (s *Server) StartContext(ctx context.Context, port string) error {
+	return s.startAddr(ctx, ":"+port)
+}
+
+func (s *Server) startAddr(ctx context.Context, addr string) error {
+	s.log.Info("Start hosting server", "addr", addr)
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	if err := s.startAdmin(); err != nil {
+		l.Close()
+		return err
+	}
+	s.serve(ctx, l)
+	return nil
+}
+
+// StartTLS starts the server like Start, but the connections are encrypted
+// with TLS. The certificate and key are loaded from the given PEM files. An
+// error is returned if they are invalid or the port cannot be bound, otherwise
+// StartTLS returns when the server is shut down.
+func (s *Server) StartTLS(port, certFile, keyFile string) error {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	l, err := tls.Listen("tcp", ":"+port, &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		return err
+	}
+	if err := s.startAdmin(); err != nil {
+		l.Close()
+		return err
+	}
+	s.log.Info("Start hosting TLS server", "port", port)
+	s.serve(context.Background(), l)
+	return nil
+}
+
+// Addr returns the address the server listens on, e.g. to find out the port
+// chosen by the system when started on port 0. It returns nil until the server
+// is listening.
+func (s *Server) Addr() net.Addr {
+	addr, _ := s.addr.Load().(net.Addr)
+	return addr
+}
+
+// serve accepts the connections of the listener and runs the broker loop
+// until the server is shut down.
+func (s *Server) serve(ctx context.Context, l net.Listener) {
+	s.addr.Store(l.Addr())
+	s.started.Set()
+	s.serverListener = l
 	// start accepting connections. Connection objects will be pushed to
 	// a channel.
-	go s.hostServer(port)
+	go s.acceptConnections(l)
+	s.run(ctx)
+}
+
+// run is the broker loop of the server. It stops when the server is shut down
+// or the context is cancelled.
+func (s *Server) run(ctx context.Context) {
+	s.startTime = time.Now()
+	go s.pinger()
+	idle := s.startIdleTimer()
 
 	// All events are handled here in a centralized
 	// "Broker" loop.
 	for stop := false; !stop; {
 		select {
 		case conn := <-s.conns:
-			go s.handleConnect(conn)
+			s.handleConnect(conn)
 		case msg := <-s.msgs:
 			s.handleMessage(msg)
 		case dconn := <-s.dconns:
 			s.handleDisconnect(dconn)
+		case e := <-s.ticks:
+			s.handleTick(e)
+		case e := <-s.expired:
+			s.handleExpired(e)
+		case <-s.pings:
+			s.handlePing()
+		case <-idle:
+			s.handleIdle()
+		case e := <-s.autoStarts:
+			s.handleAutoStart(e)
+		case reply := <-s.statsReqs:
+			s.handleStats(reply)
+		case reply := <-s.roomsReqs:
+			reply <- s.roomInfos()
+		case req := <-s.adminCmds:
+			req.reply <- s.handleAdmin(req.command)
+		case <-s.drains:
+			s.handleDrain()
+		case m := <-s.broadcasts:
+			s.handleBroadcast(m)
+		case e := <-s.rematchTimeouts:
+			s.handleRematchTimeout(e)
+		case gen := <-s.matchTimeouts:
+			s.handleMatchTimeout(gen)
+		case pb := <-s.playbacks:
+			s.handlePlayReplay(pb)
+		case e := <-s.playbackSteps:
+			s.handlePlaybackStep(e)
 		case <-s.stopServer:
 			stop = true
+		case <-ctx.Done():
+			s.log.Info("Context cancelled")
+			stop = true
 		}
 	}
-	fmt.Printf("Server shutdown\n")
+	s.closeAll()
+	s.log.Info("Server shutdown")
 }
 
+// Stop shuts down the running server. Ticking is stopped, and the listener and
+// connections of all players are closed. Calling Stop on a server which is
+// already stopped has no effect.
+func (s *Server) Stop() error {
+	if !s.started.IsSet() {
+		return errors.New("Server is not started")
+	}
+	s.shutdown()
+	return nil
+}
+
+// findById returns the client of the connection with the given id.
 func (s *Server) findById(id int) (*client, error) {
-	for _, i := range s.players {
-		if i.id == id {
-			return i, nil
-		}
+	if p, ok := s.clients[id]; ok {
+		return p, nil
 	}
 	return nil, errors.New("No player with id")
 }
 
-func (s *Server) ticker() {
-	fmt.Printf("Ticker started with %d players\n", len(s.players))
-	defer func() {
-		s.ticking.UnSet()
-	}()
-	for done := false; !done; {
-		s.sendAllClients(`{"type" : "tick"}`, -1)
-		select {
-		case <-s.stopTick:
-			fmt.Println("Ticking stopping")
-			done = true
-		default:
-			time.Sleep(50 * time.Millisecond)
+// handleTick moves the cars of the game and notifies the clients about the
+// elapse of time and about the players who died in this step. Before the first
+// tick, the countdown is broadcasted.
+func (s *Server) handleTick(e tickEvent) {
+	r := e.room
+	if r.game == nil || r.paused.IsSet() {
+		// the ticker might have sent the event before the game was
+		// paused
+		return
+	}
+	if e.countdown > 0 {
+		r.countingDown = true
+		countdown := jsontypes.Countdown{Type: "countdown", Seconds: e.countdown}
+		jsonByte, err := json.Marshal(countdown)
+		if err != nil {
+			s.log.Error("Could not produce countdown json", "err", err)
+			return
 		}
+		r.sendAllClients(string(jsonByte), -1)
+		return
+	}
+	r.countingDown = false
+	s.metrics.ticks.Add(1)
+	s.moveBots(r)
+	dead := r.game.step()
+	dead = append(dead, s.suddenDeath(r)...)
+	for _, id := range r.game.tickTimers() {
+		s.sendBoost(r, r.game.cars[id].color, false)
+	}
+	s.sendExpired(r)
+	s.flushEvents(r)
+	tick := jsontypes.Tick{Type: "tick", N: r.game.ticks, Ts: s.timestamp(r)}
+	jsonByte, err := json.Marshal(tick)
+	if err != nil {
+		s.log.Error("Could not produce tick json", "err", err)
+		return
+	}
+	r.sendAllClients(string(jsonByte), -1)
+	s.sendCollected(r)
+	s.spawnPowerUps(r)
+	for _, id := range dead {
+		s.sendPlayerDead(r, r.game.cars[id].color)
+		s.sendYouDied(r, id)
 	}
-	fmt.Println("Ticking stopped")
+
+	if r.game.over() {
+		s.gameOver(r)
+	}
+}
+
+// timestamp returns the time elapsed since the start of the game in the room,
+// in milliseconds, or nil if the server does not send timestamps. The clock is
+// monotonic, so the timestamps are not affected by changes of the wall clock.
+func (s *Server) timestamp(r *room) *int64 {
+	if !s.cfg.Timestamps {
+		return nil
+	}
+	ts := time.Since(r.gameStart).Milliseconds()
+	return &ts
 }
 
-func (s *Server) handleMessage(mf msgFormat) {
-	m := strings.TrimSpace(mf.msg)
-	p, err := s.findById(mf.senderId)
+// startGame announces the start of the game and moves the room to the game
+// phase.
+func (s *Server) startGame(r *room) {
+	g := newGame(r.players, s.cfg.Width, s.cfg.Height, s.rnd)
+	settings := r.settings()
+	g.teams = s.cfg.Teams > 0
+	g.trailTTL = settings.TrailTTL
+	r.gameStart = time.Now()
+	obstacleRnd := s.rnd
+	if s.cfg.ObstacleSeed != 0 {
+		obstacleRnd = rand.New(rand.NewSource(s.cfg.ObstacleSeed))
+	}
+	g.addObstacles(settings.ObstacleLayout, obstacleRnd)
+	sg := jsontypes.StartGame{Type: "start_game", Colors: make([]string, 0, 5),
+		Names: make([]string, 0, 5), PlayerIds: make([]int, 0, 5), Width: s.cfg.Width, Height: s.cfg.Height,
+		Mode: r.mode, Spawns: make([]jsontypes.Spawn, 0, 5), Ts: s.timestamp(r)}
+	for _, p := range r.players {
+		sg.Colors = append(sg.Colors, p.color)
+		sg.Names = append(sg.Names, p.name)
+		sg.PlayerIds = append(sg.PlayerIds, p.id)
+		c := g.cars[p.id]
+		sg.Spawns = append(sg.Spawns,
+			jsontypes.Spawn{Color: p.color, X: c.pos.x, Y: c.pos.y, Direction: c.dir})
+		if g.teams {
+			sg.Teams = append(sg.Teams, jsontypes.TeamMember{Color: p.color, Team: p.team})
+		}
+	}
+	for _, o := range g.obstacles() {
+		sg.Obstacles = append(sg.Obstacles, jsontypes.Point{X: o.x, Y: o.y})
+	}
+	jsonByte, err := json.Marshal(sg)
 	if err != nil {
-		fmt.Println("Error: Player not found in list.")
+		s.log.Error("Could not produce start game json", "err", err)
+		return
 	}
+	r.sendAllClients(string(jsonByte), -1)
+	r.game = g
+	r.events = nil
+	r.rematchOpen = false
+	r.phase = phaseGame
+	r.paused.UnSet()
+	s.games++
+	s.metrics.gamesStarted.Add(1)
 
-	switch s.phase {
-	case 0: // lobby
-		data := &jsontypes.ChatData{}
+	// new connections need a room in the lobby phase
+	if r.id == defaultRoom {
+		delete(s.rooms, r.id)
+		r.id = s.nextRoomId("game", &s.games)
+		s.rooms[r.id] = r
+	}
+	r.replay = &jsontypes.Replay{Room: r.id, Start: sg, Events: make([]jsontypes.ReplayEvent, 0),
+		TickInterval: int(s.cfg.TickInterval.Milliseconds())}
+	s.cfg.Events.OnGameStart(append([]string(nil), sg.Colors...))
+}
 
-		if err := json.Unmarshal([]byte(m), data); err != nil {
-			fmt.Printf("Error processing chat message: '%s': %s\n", m, err.Error())
-		}
-		switch data.Type {
-		case "chat":
-			s.sendAllClients(m, p.id) // broadcast chat message
-		case "ready":
-			p.ready = true
-			// check on all ready
-			if s.isAllReady() {
-				sg := jsontypes.StartGame{Type: "start_game", Colors: make([]string, 0, 5)}
-				for _, p := range s.players {
-					sg.Colors = append(sg.Colors, p.color)
-				}
-				jsonByte, err := json.Marshal(sg)
-				if err != nil {
-					fmt.Printf("Fatal: could not produce start game json: %s\n", err.Error())
-					return
+// gameOver stops the running game, announces the winner and moves the room
+// back to the lobby phase.
+func (s *Server) gameOver(r *room) {
+	r.close()
+	s.metrics.gamesFinished.Add(1)
+	var message interface{}
+	gameOver := jsontypes.GameOver{Type: "game_over"}
+	if r.game.teams {
+		message = s.teamGameOver(r)
+	} else {
+		for id, c := range r.game.cars {
+			if c.alive {
+				color := c.color
+				gameOver.Winner = &color
+				for _, p := range r.players {
+					if p.id == id {
+						r.scores[p.token]++
+					}
 				}
-				s.sendAllClients(string(jsonByte), -1)
-				s.phase = 1
 			}
+		}
+		message = gameOver
+	}
+	s.saveReplay(r, gameOver.Winner)
+	if gameOver.Winner != nil {
+		s.cfg.Events.OnGameOver(*gameOver.Winner)
+	} else {
+		s.cfg.Events.OnGameOver("")
+	}
+	r.game = nil
+	r.phase = phaseLobby
+	for _, p := range r.players {
+		p.ready = false
+	}
+
+	s.sendAll(r, message)
+	s.sendScoreboard(r)
+	s.removeBots(r)
+	// nobody is ready after the game
+	r.sendLobbyUpdate(-1)
+	s.offerRematch(r)
+	s.armAutoStart(r)
+	s.finishDrain()
+}
+
+// sendScoreboard sends the number of wins of every player in the room.
+func (s *Server) sendScoreboard(r *room) {
+	scoreboard := jsontypes.Scoreboard{Type: "scoreboard", Scores: make([]jsontypes.Score, 0, len(r.players))}
+	for _, p := range r.players {
+		scoreboard.Scores = append(scoreboard.Scores,
+			jsontypes.Score{Color: p.color, Name: p.name, Wins: r.scores[p.token]})
+	}
+	jsonByte, err := json.Marshal(scoreboard)
+	if err != nil {
+		s.log.Error("Could not produce scoreboard json", "err", err)
+		return
+	}
+	r.sendAllClients(string(jsonByte), -1)
+}
+
+// handleSetName gives the player a new name, and announces it to the room.
+// Invalid names are ignored.
+func (s *Server) handleSetName(p *client, name string) {
+	name = sanitizeName(name)
+	if name == "" {
+		s.log.Warn("Invalid name", "color", p.color)
+		return
+	}
+	p.name = name
+	nameData := jsontypes.ColorData{Type: "set_name", Color: p.color, Name: p.name}
+	jsonByte, err := json.Marshal(nameData)
+	if err != nil {
+		s.log.Error("Could not produce name json", "err", err)
+		return
+	}
+	p.room.sendAllClients(string(jsonByte), -1)
+}
+
+// handleResetScores forgets the wins in the room of the player.
+func (s *Server) handleResetScores(p *client) {
+	r := p.room
+	r.scores = make(map[string]int)
+	s.sendScoreboard(r)
+}
+
+// handleReady sets the ready state of the player, and starts the game if
+// everyone is ready. Repeated ready or unready messages change nothing, so
+// nothing is announced.
+func (s *Server) handleReady(p *client, ready bool) {
+	if p.ready == ready {
+		return
+	}
+	r := p.room
+	p.ready = ready
+	r.sendLobbyUpdate(-1)
+	s.maybeStart(r)
+}
+
+// handleStart starts ticking in the room of the host.
+func (s *Server) handleStart(p *client) {
+	r := p.room
+	if p != r.host {
+		s.log.Warn("Start from player who is not the host", "color", p.color, "room", r.id)
+		s.sendError(p.conn, jsontypes.CodeNotHost, "")
+		return
+	}
+	r.startTicker()
+}
+
+// handlePause pauses or resumes the game in the room of the player.
+func (s *Server) handlePause(p *client, pause bool) {
+	r := p.room
+	if !r.paused.SetToIf(!pause, pause) {
+		return
+	}
+	if pause {
+		s.log.Info("Game paused", "room", r.id, "color", p.color)
+		s.sendAll(r, jsontypes.SimpleData{Type: "paused"})
+	} else {
+		s.log.Info("Game resumed", "room", r.id, "color", p.color)
+		s.sendAll(r, jsontypes.SimpleData{Type: "resumed"})
+	}
+}
+
+// handlePlayerEvent turns or boosts the car of the player. Turns are relayed
+// to the room with the color of the player, unless events are batched. Events
+// of dead players are ignored, they only spectate the rest of the game.
+func (s *Server) handlePlayerEvent(p *client, msg *message) {
+	r := p.room
+	if !r.game.isAlive(p.id) {
+		return
+	}
+	event := msg.game.Event
+	// Player changing direction
+	if dir := event.Direction; dir != "" {
+		switch err := r.game.turn(p.id, dir); err {
+		case nil:
+			r.recordTurn(p, dir)
+		case errReversal:
+			s.sendError(p.conn, jsontypes.CodeIllegalMove, "")
+			return
 		default:
-			fmt.Printf("Error: unknown message type in lobby phase\n")
+			s.log.Warn("Malformed player event", "id", p.id, "direction", dir)
+			s.sendError(p.conn, jsontypes.CodeBadMessage, fmt.Sprintf("unknown direction '%s'", dir))
+			return
 		}
-	case 1: // game
-		// accept no more connections
-		s.stopListen <- true
-		s.serverListener.Close()
+	}
+	relayed := jsontypes.GameData{Type: "player_event", Color: p.color, PlayerId: &p.id, Event: event}
+	s.relayEvent(r, relayed, p.id) // broadcast
+	if event.Boost {
+		s.handleBoost(p)
+	}
+}
+
+// handleChat broadcasts the chat message to the room of the sender. Messages
+// with a recipient are only delivered to the recipient, and echoed to the
+// sender. Messages over the length or rate limit of the chat are refused.
+func (s *Server) handleChat(p *client, data *jsontypes.ChatData) {
+	r := p.room
+	if n := utf8.RuneCountInString(data.Message); n > s.cfg.MaxChatLength {
+		s.log.Warn("Chat message too long", "color", p.color, "length", n)
+		s.sendError(p.conn, jsontypes.CodeChatTooLong, fmt.Sprintf("at most %d characters are allowed", s.cfg.MaxChatLength))
+		return
+	}
+	if p.chatLimiter == nil {
+		p.chatLimiter = newRateLimiter(s.cfg.ChatRate)
+	}
+	if !p.chatLimiter.allow() {
+		s.sendError(p.conn, jsontypes.CodeRateLimited, "too many chat messages")
+		return
+	}
+	var target *client
+	if data.To != "" {
+		if target = r.playerByColor(data.To); target == nil || target.disconnected {
+			s.log.Warn("Chat to unknown player", "color", data.To, "room", r.id)
+			s.sendError(p.conn, jsontypes.CodeBadMessage, fmt.Sprintf("no player with color '%s'", data.To))
+			return
+		}
+	}
+	chat := jsontypes.ChatData{Type: "chat", Color: p.color, Name: p.name,
+		Message: s.cfg.ChatFilter(data.Message)}
+	if target != nil {
+		chat.To = target.color
+	}
+	jsonByte, err := json.Marshal(chat)
+	if err != nil {
+		s.log.Error("Could not produce chat json", "err", err)
+		return
+	}
+	s.cfg.Events.OnChat(p.color, chat.Message)
+	if target == nil {
+		r.recordChat(chat)
+		r.sendAllClients(string(jsonByte), p.id) // broadcast chat message
+		return
+	}
+	s.write(target.conn, string(jsonByte))
+	if target != p {
+		s.write(p.conn, string(jsonByte))
+	}
+}
+
+// handleBoost speeds up the car of the player, if its boost is available.
+func (s *Server) handleBoost(p *client) {
+	r := p.room
+	if !r.game.boost(p.id) {
+		s.sendError(p.conn, jsontypes.CodeBoostUnavailable, "")
+		return
+	}
+	r.recordBoost(p)
+	s.sendBoost(r, p.color, true)
+}
+
+// sendBoost announces the start or the end of the boost of a car.
+func (s *Server) sendBoost(r *room, color string, active bool) {
+	boost := jsontypes.Boost{Type: "boost", Color: color, Active: active}
+	jsonByte, err := json.Marshal(boost)
+	if err != nil {
+		s.log.Error("Could not produce boost json", "err", err)
+		return
+	}
+	r.sendAllClients(string(jsonByte), -1)
+}
+
+// handleJoinRoom moves the player from its current room to the room with the
+// given id.
+func (s *Server) handleJoinRoom(p *client, id string) {
+	old := p.room
+	if old.id == id {
+		return
+	}
+	if target, ok := s.rooms[id]; id == replayRoom || ok && !target.joinable() {
+		s.log.Info("Player cannot join room", "color", p.color, "room", id)
+		s.sendError(p.conn, jsontypes.CodeRoomUnavailable, "")
+		return
+	}
+	s.leaveRoom(p)
+	if err := s.joinRoom(p, id); err != nil {
+		// cannot happen, the room was checked to be joinable
+		s.log.Error("Could not join room", "room", id, "err", err)
+		return
+	}
+	s.welcome(p)
+	s.maybeStart(p.room)
+}
 
-		data := &jsontypes.GameData{}
+// handleSpectate turns the player into a spectator of the room with the given
+// id, or of its current room if id is empty. Games in progress can also be
+// watched.
+func (s *Server) handleSpectate(p *client, id string) {
+	old := p.room
+	if id == "" {
+		id = old.id
+	}
+	target, ok := s.rooms[id]
+	if !ok {
+		s.log.Info("Player cannot spectate room", "color", p.color, "room", id)
+		s.sendError(p.conn, jsontypes.CodeRoomUnavailable, "")
+		return
+	}
+	if s.spectatorsFull(p) {
+		s.log.Info("Too many spectators", "color", p.color, "addr", p.conn.RemoteAddr().String())
+		s.sendError(p.conn, jsontypes.CodeSpectatorsFull, "")
+		return
+	}
+	old.unsubscribe(p)
+	target.addSpectator(p)
+	if old != target {
+		s.closeIfEmpty(old)
+	}
+
+	spectate := jsontypes.RoomData{Type: "spectate", Room: target.id}
+	jsonByte, err := json.Marshal(spectate)
+	if err != nil {
+		s.log.Error("Could not produce spectate json", "err", err)
+		return
+	}
+	s.write(p.conn, string(jsonByte))
+	if target.phase == phaseGame {
+		s.sendState(p)
+	}
+}
 
-		if err := json.Unmarshal([]byte(m), data); err != nil {
-			fmt.Printf("Error processing chat message: '%s'", m)
+// sendState sends the state of the game in the room of the client, so that
+// clients joining during the game can render the board. Cars of players who
+// left the room are listed as well, since their trails stay on the board.
+func (s *Server) sendState(p *client) {
+	g := p.room.game
+	ids := make([]int, 0, len(g.cars))
+	for id := range g.cars {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	state := jsontypes.State{Type: "state", Tick: g.ticks, Cars: make([]jsontypes.CarState, 0, len(g.cars))}
+	for _, id := range ids {
+		c := g.cars[id]
+		car := jsontypes.CarState{Color: c.color, X: c.pos.x, Y: c.pos.y, Direction: c.dir, Alive: c.alive,
+			Trail: make([]jsontypes.Point, 0)}
+		for _, cell := range g.cellsOf(id) {
+			car.Trail = append(car.Trail, jsontypes.Point{X: cell.x, Y: cell.y})
 		}
-		switch data.Type {
-		case "start":
-			// Start ticking
-			if s.ticking.SetToIf(false, true) {
-				go s.ticker()
-			}
-		case "player_event":
-			// Player changing direction
-			s.sendAllClients(m, p.id) // broadcast
-		default:
-			fmt.Printf("Error: unknown message type in game phase")
+		state.Cars = append(state.Cars, car)
+	}
+	s.sendMessage(p.conn, state)
+}
+
+// handleKick removes the player with the given color from the room of the
+// host, and closes its connection. The kicked player cannot reconnect.
+func (s *Server) handleKick(host *client, color string) {
+	r := host.room
+	if host != r.host {
+		s.log.Warn("Kick from player who is not the host", "color", host.color, "room", r.id)
+		s.sendError(host.conn, jsontypes.CodeNotHost, "")
+		return
+	}
+	target := r.playerByColor(color)
+	if target == nil || target == host {
+		s.log.Warn("Invalid kick", "color", color, "room", r.id)
+		s.sendError(host.conn, jsontypes.CodeBadMessage, fmt.Sprintf("no other player with color '%s'", color))
+		return
+	}
+	s.log.Info("Kicking player", "color", color, "room", r.id)
+	if !target.disconnected {
+		s.sendMessage(target.conn, jsontypes.SimpleData{Type: "kicked"})
+	}
+	s.expel(target)
+}
+
+// handleHello checks that the client speaks the protocol of the server.
+// Clients with another protocol version are removed.
+func (s *Server) handleHello(p *client, m string) {
+	hello := &jsontypes.Hello{}
+	if !s.decode(p, m, hello) {
+		return
+	}
+	if hello.Protocol != nil && *hello.Protocol != ProtocolVersion {
+		s.log.Info("Protocol mismatch", "color", p.color, "protocol", *hello.Protocol)
+		s.sendError(p.conn, jsontypes.CodeProtocolMismatch,
+			fmt.Sprintf("server speaks protocol %d", ProtocolVersion))
+		s.expel(p)
+		return
+	}
+	if hello.Features != nil {
+		p.setFeatures(hello.Features)
+	}
+}
+
+// handleLeave removes the client who asked to leave, like a disconnect, but
+// the player cannot reconnect.
+func (s *Server) handleLeave(p *client) {
+	s.log.Info("Client left", "color", p.color)
+	s.metrics.leaves.Add(1)
+	s.cancelCountdown(p.room)
+	if !p.spectator {
+		s.playerLeft(p, "left")
+	}
+	s.expel(p)
+}
+
+// cancelCountdown stops the countdown of the room, if it is counting down,
+// since a player left.
+func (s *Server) cancelCountdown(r *room) {
+	if !r.countingDown {
+		return
+	}
+	s.log.Info("Cancelling countdown", "room", r.id)
+	r.close()
+	s.sendAll(r, jsontypes.SimpleData{Type: "countdown_cancelled"})
+}
+
+// expel removes the client from the server for good, and closes its
+// connection. The disconnect reported by the reader of the connection is
+// ignored afterwards.
+func (s *Server) expel(p *client) {
+	for id, c := range s.clients {
+		if c == p {
+			delete(s.clients, id)
 		}
 	}
+	s.metrics.clients.Store(int64(len(s.clients)))
+	if !p.disconnected {
+		p.conn.Close()
+		s.cfg.Events.OnDisconnect(p.color)
+	}
+	s.removeClient(p)
+}
+
+// welcome tells the player its color in its room, and notifies the others in
+// the room about the new player. The compression and framing of the
+// connection are switched on after the connect message. New connections get
+// the message of the day as well, and every player the chat history of the
+// room.
+func (s *Server) welcome(p *client) {
+	s.sendConnect(p)
+	// connections are upgraded in their first welcome
+	first := !p.upgraded
+	s.upgradeConn(p)
+	if first && s.cfg.MOTD != "" {
+		s.sendMessage(p.conn, jsontypes.Motd{Type: "motd", Message: s.cfg.MOTD})
+	}
+	if update := p.room.lobbyUpdate(p); update != "" {
+		s.write(p.conn, update)
+	}
+	s.sendChatHistory(p)
+
+	chat := jsontypes.ChatData{Type: "chat", Color: p.color, Message: p.color + " has connected"}
+	if m, ok := s.encode(chat); ok {
+		p.room.sendAllClients(m, p.id)
+	}
+}
 
+// sendConnect tells the player its color, token and room, and what the server
+// supports.
+func (s *Server) sendConnect(p *client) {
+	connect := jsontypes.ColorData{Type: "connect", Color: p.color, PlayerId: &p.id, Room: p.room.id,
+		Token: p.token, Host: p.room.host == p, Protocol: ProtocolVersion, Features: s.features(),
+		Compression: p.compression, Framing: p.framing,
+		YouAre: &jsontypes.Identity{Color: p.color, PlayerId: p.id, Name: p.name}}
+	jsonByte, err := json.Marshal(connect)
+	if err != nil {
+		s.log.Error("Could not produce connect json", "err", err)
+		return
+	}
+	s.write(p.conn, string(jsonByte))
+}
+
+// upgradeConn switches on the compression and framing of the connection of
+// the client. The framing is applied first, then the framed messages are
+// compressed.
+func (s *Server) upgradeConn(p *client) {
+	if p.upgraded {
+		return
+	}
+	p.upgraded = true
+	if p.compression == FlateCompression {
+		if p.queue != nil {
+			// dropping a message would corrupt the compressed stream
+			p.queue.keepEverything()
+		}
+		p.conn = newFlateConn(p.conn)
+	}
+	if p.framing == LengthPrefixedFraming {
+		p.conn = &lengthPrefixedConn{Conn: p.conn}
+	}
 }
 
-func (s *Server) handleDisconnect(id int) {
+// handleDisconnect holds the slot of the player who lost its connection, and
+// removes spectators.
+func (s *Server) handleDisconnect(d disconnect) {
+	id := d.id
 	p, err := s.findById(id)
 	if err != nil {
-		fmt.Printf("Error during disconnect")
+		// kicked clients are removed before their connection is closed
+		s.log.Info("Disconnect of removed connection", "id", id)
+		return
+	}
+	delete(s.clients, id)
+	s.metrics.clients.Store(int64(len(s.clients)))
+	s.metrics.disconnects.Add(1)
+	s.log.Info("Client disconnected", "id", id, "reason", d.reason)
+	s.cfg.Events.OnDisconnect(p.color)
+	if p.spectator {
+		s.removeClient(p)
+		return
 	}
-	s.unsubscribe(p)
-	fmt.Printf("Client with id: %d disconnected\n", id)
+	s.cancelCountdown(p.room)
+	s.hold(p)
+	if p.room.host == p {
+		p.room.transferHost()
+	}
+	s.playerLeft(p, d.reason)
+}
 
-	// shutdown server if no more player
-	if len(s.players) < 1 {
-		if s.ticking.IsSet() {
-			s.stopTick <- true
+// playerLeft tells the room that the player lost its connection. The car of a
+// player leaving during the game crashes, so the game can be over.
+func (s *Server) playerLeft(p *client, reason string) {
+	r := p.room
+	left := jsontypes.PlayerLeft{Type: "player_left", Color: p.color, Reason: reason}
+	jsonByte, err := json.Marshal(left)
+	if err != nil {
+		s.log.Error("Could not produce player left json", "err", err)
+		return
+	}
+	r.sendAllClients(string(jsonByte), p.id)
+	if r.phase != phaseGame {
+		return
+	}
+	if c := r.game.cars[p.id]; c != nil && c.alive {
+		c.alive = false
+		s.sendPlayerDead(r, c.color)
+	}
+}
+
+// sendPlayerDead announces the crash of a car.
+func (s *Server) sendPlayerDead(r *room, color string) {
+	pd := jsontypes.PlayerDead{Type: "player_dead", Color: color}
+	jsonByte, err := json.Marshal(pd)
+	if err != nil {
+		s.log.Error("Could not produce player dead json", "err", err)
+		return
+	}
+	r.sendAllClients(string(jsonByte), -1)
+}
+
+// sendYouDied tells the player of the crashed car that it spectates the rest
+// of the game.
+func (s *Server) sendYouDied(r *room, id int) {
+	for _, p := range r.players {
+		if p.id == id && !p.bot && !p.disconnected {
+			s.sendMessage(p.conn, jsontypes.SimpleData{Type: "you_died"})
 		}
+	}
+}
+
+// removeClient removes the client from the server for good. The server is
+// shut down when the last room closed, if it is configured so.
+func (s *Server) removeClient(p *client) {
+	delete(s.tokens, p.token)
+	s.leaveRoom(p)
+
+	if s.cfg.ShutdownWhenEmpty && len(s.rooms) < 1 {
+		s.log.Info("No player left")
 		s.shutdown()
 	}
 }
 
+// shutdown makes the broker loop stop. It does not block, so it is safe to
+// call from the broker itself, and calling it more than once is harmless.
 func (s *Server) shutdown() {
-	fmt.Printf("Initiating shutdown\n")
-	s.stopListen <- true // indicates normal close
-	s.serverListener.Close()
-	s.stopServer <- true
+	select {
+	case s.stopServer <- true:
+		s.log.Info("Initiating shutdown")
+	default: // shutdown already initiated
+	}
 }
 
-func (s *Server) sendAllClients(message string, except_id int) {
-	message += "\n"
-	for i := range s.players {
-		if s.players[i].id == except_id {
-			continue
+// stopListening closes the listener, so no more connections are accepted.
+func (s *Server) stopListening() {
+	select {
+	case s.stopListen <- true: // indicates normal close
+	default: // already stopping
+	}
+	if s.serverListener != nil {
+		s.serverListener.Close()
+	}
+	if s.wsListener != nil {
+		s.wsListener.Close()
+	}
+}
+
+// closeAll releases the resources of the server after the broker loop stopped.
+func (s *Server) closeAll() {
+	s.stopListening()
+	if s.adminListener != nil {
+		s.adminListener.Close()
+	}
+	for _, r := range s.rooms {
+		r.close()
+	}
+	for _, p := range s.clients {
+		p.conn.Close()
+	}
+	if s.traceFile != nil {
+		s.traceFile.Close()
+	}
+	close(s.done)
+}
+
+// encode produces the JSON of an outgoing message. Messages are always
+// marshalled, never put together by hand, so any string is escaped properly.
+// If the message cannot be produced, the error is logged and false is
+// returned.
+func (s *Server) encode(v interface{}) (string, bool) {
+	jsonByte, err := json.Marshal(v)
+	if err != nil {
+		s.log.Error("Could not produce json", "type", fmt.Sprintf("%T", v), "err", err)
+		return "", false
+	}
+	return string(jsonByte), true
+}
+
+// sendMessage marshals the message and sends it to the connection.
+func (s *Server) sendMessage(c net.Conn, v interface{}) {
+	if m, ok := s.encode(v); ok {
+		s.write(c, m)
+	}
+}
+
+// sendAll marshals the message and sends it to everyone in the room.
+func (s *Server) sendAll(r *room, v interface{}) {
+	if m, ok := s.encode(v); ok {
+		r.sendAllClients(m, -1)
+	}
+}
+
+// write sends the message to the connection. A failed write disconnects the
+// client of the connection right away, instead of waiting for its reader to
+// fail as well. It must only be called by the broker.
+func (s *Server) write(c net.Conn, msg string) {
+	s.trace(c, "out", msg)
+	err := send(c, msg)
+	if err == nil {
+		return
+	}
+	for _, p := range s.clients {
+		if p.conn == c {
+			s.reportBroken(p, err)
+			return
 		}
-		s.players[i].conn.Write([]byte(message))
 	}
 }
 
-func send(c net.Conn, msg string) {
-	msg += "\n"
-	c.Write([]byte(msg))
+// send writes the message to the connection in the framing of the
+// connection.
+func send(c net.Conn, msg string) error {
+	return writeAll(c, frame(c, msg))
 }
 
-func (s *Server) isAllReady() bool {
-	if len(s.players) < 2 {
-		return false
+// writeAll writes every byte to the connection, so a partial write does not
+// break the framing of the messages. Connections should not return short
+// writes without an error, but wrapped connections might do so.
+func writeAll(c net.Conn, b []byte) error {
+	for len(b) > 0 {
+		n, err := c.Write(b)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return io.ErrShortWrite
+		}
+		b = b[n:]
 	}
-	for i := range s.players {
-		if !s.players[i].ready {
-			return false
+	return nil
+}
+
+// reportBroken reports the client as disconnected after writing to its
+// connection failed, without waiting for its reader to notice. The report goes
+// through the broker loop like the ones of the readers, since the caller is
+// the broker itself. The reader reports the connection again later, which is
+// ignored.
+func (s *Server) reportBroken(p *client, err error) {
+	if p.broken {
+		return
+	}
+	p.broken = true
+	for id, c := range s.clients {
+		if c != p {
+			continue
 		}
+		s.log.Info("Error while writing to client", "id", id, "err", err)
+		go func(id int) {
+			select {
+			case s.dconns <- disconnect{id: id, reason: "error"}:
+			case <-s.done:
+			}
+		}(id)
 	}
-	return true
 }
 
-func (s *Server) handleConnect(c net.Conn) {
-	fmt.Printf("Serving %s\n", c.RemoteAddr().String())
+// sendError tells the client that something went wrong. The message is
+// optional. It must only be called by the broker, like write, see replyError.
+func (s *Server) sendError(c net.Conn, code, msg string) {
+	errorData := jsontypes.NewError(code, msg)
+	jsonByte, err := json.Marshal(errorData)
+	if err != nil {
+		s.log.Error("Could not produce error json", "err", err)
+		return
+	}
+	s.write(c, string(jsonByte))
+}
 
-	// subscribe new player
-	p := client{conn: c}
-	s.subscribe(&p)
+// replyError sends the error from the goroutines reading or accepting the
+// connection. They must not touch the clients of the broker, so a failed
+// write is not reported, the reader of the connection notices it.
+func (s *Server) replyError(c net.Conn, code string) {
+	errorData := jsontypes.NewError(code, "")
+	jsonByte, err := json.Marshal(errorData)
+	if err != nil {
+		s.log.Error("Could not produce error json", "err", err)
+		return
+	}
+	s.trace(c, "out", string(jsonByte))
+	send(c, string(jsonByte))
+}
 
-	// send color to new connection
-	m := fmt.Sprintf(`{ "type" : "connect", "color" : "%s" }`, p.color)
-	send(c, m)
+// handleConnect subscribes the new connection to the default room, and starts
+// reading its messages.
+func (s *Server) handleConnect(c net.Conn) {
+	if s.draining {
+		// accepted right before the listener was closed
+		s.log.Info("Rejecting client while draining", "addr", c.RemoteAddr().String())
+		s.sendMessage(c, jsontypes.SimpleData{Type: "draining"})
+		c.Close()
+		return
+	}
+	s.log.Info("Serving client", "addr", c.RemoteAddr().String())
 
-	m = fmt.Sprintf(`{ "type" : "chat", "color" : "%s", "message" : "%s has connected" }`, p.color, p.color)
-	s.sendAllClients(m, p.id)
+	// subscribe new player
+	ws := isWebSocket(c)
+	q := newQueuedConn(c, s.cfg, s.metrics)
+	c = q
+	p := &client{conn: c, queue: q, id: s.ids, token: newToken(), lastPong: time.Now()}
+	if !ws {
+		// WebSocket frames are neither compressed nor framed further
+		p.compression = s.cfg.Compression
+		p.framing = s.cfg.Framing
+	}
+	s.ids++
+	if err := s.joinRoom(p, defaultRoom); err != nil {
+		s.log.Info("Rejecting client", "addr", c.RemoteAddr().String(), "err", err)
+		s.sendError(c, jsontypes.CodeServerFull, "")
+		c.Close()
+		return
+	}
+	s.clients[p.id] = p
+	s.metrics.clients.Store(int64(len(s.clients)))
+	s.tokens[p.token] = p
+	s.welcome(p)
+	s.cfg.Events.OnConnect(p.color)
+	s.resetIdle()
+	s.maybeStart(p.room)
+	go s.readClient(p.id, p.conn)
+}
 
-	// read for messages
+// readClient pushes the messages of the connection to the broker until the
+// connection is closed, or no message arrives within the read timeout.
+// Messages over the rate limit are dropped. Clients sending messages larger
+// than the size limit are disconnected.
+func (s *Server) readClient(id int, c net.Conn) {
+	defer c.Close()
+	limiter := newRateLimiter(s.cfg.MessageRate)
+	reader := newMessageReader(c, s.cfg.MaxMessageSize)
+	var reason string
 	for {
-		netData, err := bufio.NewReader(c).ReadString('\n')
+		c.SetReadDeadline(time.Now().Add(s.cfg.ReadTimeout))
+		line, err := reader.readMessage()
+		if err == errMessageTooLarge {
+			s.log.Warn("Message too large", "id", id)
+			s.replyError(c, jsontypes.CodeMessageTooLarge)
+			reason = "message_too_large"
+			break
+		}
 		if err != nil {
-			fmt.Printf("Error while reading from player: %s with Id %d: %s\n",
-				p.color, p.id, err.Error())
+			if errors.Is(err, net.ErrClosed) {
+				// closed by the server, e.g. after a leave message
+				s.log.Info("Connection closed by the server", "id", id)
+			} else {
+				s.log.Info("Error while reading from client", "id", id, "err", err)
+			}
+			reason = disconnectReason(err)
 			break
 		}
-		s.msgs <- msgFormat{p.id, netData}
+		netData := string(line)
+		// without the delimiter of the newline framing, like outgoing messages
+		s.trace(c, "in", strings.TrimSuffix(netData, "\n"))
+		if !limiter.allow() {
+			s.replyError(c, jsontypes.CodeRateLimited)
+			continue
+		}
+		select {
+		case s.msgs <- msgFormat{id, netData}:
+		case <-s.done:
+			return
+		}
+	}
+	select {
+	case s.dconns <- disconnect{id: id, reason: reason}:
+	case <-s.done:
 	}
-	s.dconns <- p.id
-	fmt.Printf("Serving client with color: %s stopped\n", p.color)
+	s.log.Info("Serving client stopped", "id", id)
 }
 
-// hostServer accepts connections on "port" and push connection objects into a channel.
-func (s *Server) hostServer(port string) {
-	fmt.Println("Start hosting server")
-	PORT := ":" + port
-	l, err := net.Listen("tcp4", PORT)
-	s.serverListener = l
-	if err != nil {
-		fmt.Println(err.Error())
-		return
+// disconnect is sent to the broker when the connection of a client is lost.
+type disconnect struct {
+	id     int    // connection id
+	reason string // "closed", "timeout", "message_too_large" or "error"
+}
+
+// disconnectReason tells why reading from a connection failed. Connections
+// closed by the client are told apart from timeouts and other errors.
+func disconnectReason(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, io.EOF):
+		return "closed"
+	case errors.Is(err, net.ErrClosed):
+		// the server closes the connections of clients missing pongs
+		return "timeout"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	default:
+		return "error"
 	}
+}
+
+// acceptConnections pushes connections accepted on the listener into a
+// channel, until the listener is closed. Failed accepts are skipped.
+func (s *Server) acceptConnections(l net.Listener) {
 	defer l.Close()
 
 	for stop := false; !stop; {
@@ -324,14 +1756,28 @@ func (s *Server) hostServer(port string) {
 		if err != nil {
 			select {
 			case <-s.stopListen:
-				fmt.Println("Stop listening")
+				s.log.Info("Stop listening")
 				stop = true
 			default:
-				fmt.Printf("Error while listening: %s\n", err.Error())
+				s.log.Error("Error while listening", "err", err)
+				// a listener closed by someone else never
+				// accepts again
+				stop = errors.Is(err, net.ErrClosed)
 			}
+			// there is no connection to pass on
+			continue
+		}
+		if !s.reserveConn() {
+			// refusing must not block accepting
+			go s.refuseFull(c)
+			continue
 		}
-		if !stop {
-			s.conns <- c
+		c = &countedConn{Conn: c, server: s}
+		if s.cfg.Authenticator != nil {
+			// authenticating must not block accepting
+			go s.admit(c)
+		} else {
+			s.admit(c)
 		}
 	}
 }
@@ -11,6 +11,14 @@ import (
     "regexp"
     "fmt"
     "strings"
+    "path/filepath"
+    "context"
+    "compress/flate"
+    "encoding/binary"
+    "io"
+    "bytes"
+    "log/slog"
+    "sync"
 )
 
 const port = "8765"
@@ -36,14 +44,39 @@ func assertColorFormat(t *testing.T, color string) {
 
 func TestMain(m *testing.M) {
     s := Create()
-    var exitCode int
-    go func() {
-	exitCode = m.Run()
-    }()
     // server should shut down if client's disconnected successfully. No need to
     // shut down server manually.
-    s.Start(port)
-    os.Exit(exitCode)
+    go s.Start(port)
+    os.Exit(m.Run())
+}
+
+// startServer starts a new server on the given port for a single test.
+func startServer(t *testing.T, port string) *Server {
+    return startServerWithConfig(t, port, Config{})
+}
+
+func startServerWithConfig(t *testing.T, port string, cfg Config) *Server {
+    s, err := CreateWithConfig(cfg)
+    if err != nil {
+	t.Fatalf("Invalid config: %s", err.Error())
+    }
+    go s.Start(port)
+    return s
+}
+
+// dial connects to the server listening on port. It retries for a while, since
+// the server might not be listening yet.
+func dial(t *testing.T, port string) net.Conn {
+    for i := 0; i < 50; i++ {
+	c, err := net.Dial("tcp", ":" + port)
+	if err == nil {
+	    c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	    return c
+	}
+	time.Sleep(10 * time.Millisecond)
+    }
+    t.Fatal("connection failed.")
+    return nil
 }
 
 func sendMessage(t *testing.T, c net.Conn, message string) {
@@ -71,9 +104,9 @@ func receiveObject(t *testing.T, c net.Conn, jsonData interface{}) {
     }
 }
 
-func assertStartGameReceived(t *testing.T, c net.Conn, colors []string) {
+func assertStartGameReceived(t *testing.T, reader *bufio.Reader, colors []string) {
     startData := &jsontypes.StartGame{}
-    receiveObject(t, c, startData)
+    receiveType(t, reader, "start_game", startData)
     assertEqual(t, startData.Type, "start_game", "")
 
     colorsOk := make([]bool, len(colors))
@@ -92,16 +125,13 @@ func assertStartGameReceived(t *testing.T, c net.Conn, colors []string) {
 }
 
 func TestServerTwoPlayers(t *testing.T) {
-    conn1, err := net.Dial("tcp", ":" + port)
     t.Logf("Player 1: connect..")
-    if err != nil {
-	t.Error("connection failed.")
-    }
+    conn1 := dial(t, port)
     defer conn1.Close()
-    conn1.SetReadDeadline(time.Now().Add(5 * time.Second))
+    reader1 := bufio.NewReader(conn1)
     t.Logf("Player 1: receiving color message..")
     jsonData := &jsontypes.ColorData{}
-    receiveObject(t, conn1, jsonData)
+    receiveType(t, reader1, "connect", jsonData)
     color1 := jsonData.Color
     assertEqual(t, jsonData.Type, "connect", "Malformed message type")
     t.Logf("Player 1: color: %s", color1)
@@ -114,11 +144,12 @@ func TestServerTwoPlayers(t *testing.T) {
     }
     conn2.SetReadDeadline(time.Now().Add(5 * time.Second))
     defer conn2.Close()
+    reader2 := bufio.NewReader(conn2)
 
-    receiveObject(t, conn2, jsonData)
+    receiveType(t, reader2, "connect", jsonData)
     // Ignore player connected message
     t.Logf("Player 1: Ignore connection received message")
-    bufio.NewReader(conn1).ReadString('\n')
+    receiveType(t, reader1, "chat", &jsontypes.ChatData{})
 
     color2 := jsonData.Color
     if color1 == color2 {
@@ -132,7 +163,11 @@ func TestServerTwoPlayers(t *testing.T) {
     message := fmt.Sprintf(`{"type": "chat", "color" : "%s", "message": "hello player 2"}`,
 	jsonData.Color)
     sendMessage(t, conn1, message)
-    assertReceive(t, conn2, message)
+    chatData := &jsontypes.ChatData{}
+    receiveType(t, reader2, "chat", chatData)
+    assertEqual(t, chatData.Type, "chat", "")
+    assertEqual(t, chatData.Color, color1, "Chat message should have the color of the sender")
+    assertEqual(t, chatData.Message, "hello player 2", "")
 
     t.Logf("Player 1: Send ready")
     sendMessage(t, conn1, `{"type":"ready"}`)
@@ -142,22 +177,2394 @@ func TestServerTwoPlayers(t *testing.T) {
 
     colors := []string{color1, color2}
     t.Logf("Player 1: Receive start game..")
-    assertStartGameReceived(t, conn1, colors)
-    assertStartGameReceived(t, conn2, colors)
+    assertStartGameReceived(t, reader1, colors)
+    assertStartGameReceived(t, reader2, colors)
 
     t.Logf("Player 1: indicate start game")
     sendMessage(t, conn1, `{"type":"start"}`)
+    for seconds := 3; seconds > 0; seconds-- {
+	t.Logf("Player 1: Receive countdown %d", seconds)
+	countdown := &jsontypes.Countdown{}
+	receiveType(t, reader1, "countdown", countdown)
+	assertEqual(t, countdown.Type, "countdown", "")
+	assertEqual(t, countdown.Seconds, seconds, "")
+	receiveType(t, reader2, "countdown", countdown)
+	assertEqual(t, countdown.Seconds, seconds, "")
+    }
     // both connections receive ticks from now on. Let's assert for one.
     jsonTick := &jsontypes.SimpleData{}
     t.Logf("Player 1: Receive tick")
-    receiveObject(t, conn1, jsonTick)
+    receiveType(t, reader1, "tick", jsonTick)
     assertEqual(t, jsonTick.Type, "tick", "")
     t.Logf("Player 2: Receive tick")
-    receiveObject(t, conn2, jsonTick)
+    receiveType(t, reader2, "tick", jsonTick)
     assertEqual(t, jsonTick.Type, "tick", "")
 
 }
 
+// Messages arriving in the same packet should all be processed
+func TestServerPipelinedMessages(t *testing.T) {
+    const port = "8766"
+    startServer(t, port)
+
+    conn1 := dial(t, port)
+    defer conn1.Close()
+    reader1 := bufio.NewReader(conn1)
+    receiveType(t, reader1, "connect", &jsontypes.ColorData{})
+
+    conn2 := dial(t, port)
+    defer conn2.Close()
+    reader2 := bufio.NewReader(conn2)
+    receiveType(t, reader2, "connect", &jsontypes.ColorData{})
+    receiveType(t, reader1, "chat", &jsontypes.ChatData{}) // player 2 connected
+
+    message1 := `{"type": "chat", "message": "first"}`
+    message2 := `{"type": "chat", "message": "second"}`
+    conn1.Write([]byte(message1 + "\n" + message2 + "\n"))
+
+    for _, message := range []string{"first", "second"} {
+	chatData := &jsontypes.ChatData{}
+	receiveType(t, reader2, "chat", chatData)
+	assertEqual(t, chatData.Message, message, "")
+    }
+}
+
+func TestServerStop(t *testing.T) {
+    const port = "8767"
+    assertEqual(t, Create().Stop() != nil, true, "Stopping a server which is not started should fail")
+
+    s := startServer(t, port)
+    conn := dial(t, port)
+    defer conn.Close()
+    reader := bufio.NewReader(conn)
+    receiveType(t, reader, "connect", &jsontypes.ColorData{})
+    receiveType(t, reader, "lobby_update", &jsontypes.LobbyUpdate{})
+
+    if err := s.Stop(); err != nil {
+	t.Fatalf("Stop failed: %s", err.Error())
+    }
+    if _, err := reader.ReadString('\n'); err == nil {
+	t.Fatal("Connection should be closed by Stop")
+    }
+    if err := s.Stop(); err != nil {
+	t.Fatalf("Second Stop failed: %s", err.Error())
+    }
+}
+
+// receiveType reads messages until one with the given type arrives, and
+// unpacks it into jsonData.
+func receiveType(t *testing.T, reader *bufio.Reader, messageType string, jsonData interface{}) {
+    for {
+	msg, err := reader.ReadString('\n')
+	if err != nil {
+	    t.Fatalf("Message of type %s not received: %s", messageType, err.Error())
+	}
+	envelope := &jsontypes.SimpleData{}
+	if json.Unmarshal([]byte(msg), envelope) == nil && envelope.Type == messageType {
+	    if err := json.Unmarshal([]byte(msg), jsonData); err != nil {
+		t.Fatalf("Malformed %s message", messageType)
+	    }
+	    return
+	}
+    }
+}
+
+// connectPlayers connects two players to the server on port. The connect
+// messages are already consumed.
+func connectPlayers(t *testing.T, port string) (net.Conn, *bufio.Reader, net.Conn, *bufio.Reader) {
+    conn1 := dial(t, port)
+    reader1 := bufio.NewReader(conn1)
+    receiveType(t, reader1, "connect", &jsontypes.ColorData{})
+    conn2 := dial(t, port)
+    reader2 := bufio.NewReader(conn2)
+    receiveType(t, reader2, "connect", &jsontypes.ColorData{})
+    receiveType(t, reader1, "chat", &jsontypes.ChatData{}) // player 2 connected
+    return conn1, reader1, conn2, reader2
+}
+
+// startTwoPlayerGame connects two players to the server on port and gets them
+// to the game phase. The start_game message is already consumed.
+func startTwoPlayerGame(t *testing.T, port string) (net.Conn, *bufio.Reader, net.Conn, *bufio.Reader) {
+    conn1, reader1, conn2, reader2 := connectPlayers(t, port)
+    sendMessage(t, conn1, `{"type":"ready"}`)
+    sendMessage(t, conn2, `{"type":"ready"}`)
+    receiveType(t, reader1, "start_game", &jsontypes.StartGame{})
+    receiveType(t, reader2, "start_game", &jsontypes.StartGame{})
+    return conn1, reader1, conn2, reader2
+}
+
+// Broker should keep working when several messages arrive in game phase
+func TestServerGamePhaseMessages(t *testing.T) {
+    const port = "8768"
+    startServer(t, port)
+    conn1, _, conn2, reader2 := startTwoPlayerGame(t, port)
+    defer conn1.Close()
+    defer conn2.Close()
+
+    directions := []string{"up", "right", "down"}
+    for _, d := range directions {
+	sendMessage(t, conn1, fmt.Sprintf(`{"type":"player_event","event":{"direction":"%s"}}`, d))
+    }
+    for range directions {
+	data := &jsontypes.GameData{}
+	if msg, err := reader2.ReadString('\n'); err != nil {
+	    t.Fatalf("Player 2: player event not received: %s", err.Error())
+	} else if err := json.Unmarshal([]byte(msg), data); err != nil {
+	    t.Fatal("Malformed player event")
+	}
+	assertEqual(t, data.Type, "player_event", "")
+    }
+}
+
+// A message queued before the sender disconnected should be dropped
+func TestServerMessageFromRemovedPlayer(t *testing.T) {
+    s := Create()
+    p := &client{}
+    s.joinRoom(p, defaultRoom)
+    s.leaveRoom(p)
+    s.handleMessage(msgFormat{p.id, `{"type":"chat","message":"too late"}`})
+    s.handleMessage(msgFormat{p.id, `{"type":"player_event"}`})
+}
+
+func TestSanitizeName(t *testing.T) {
+    assertEqual(t, sanitizeName("  alice "), "alice", "")
+    assertEqual(t, sanitizeName("bo\x00b\n"), "bob", "")
+    assertEqual(t, sanitizeName("ááááááááááááááááááááááá"), "áááááááááááááááááááá", "")
+    assertEqual(t, sanitizeName("\t\x07"), "", "")
+}
+
+func TestServerPlayerNames(t *testing.T) {
+    const port = "8769"
+    startServer(t, port)
+    conn1 := dial(t, port)
+    defer conn1.Close()
+    reader1 := bufio.NewReader(conn1)
+    receiveType(t, reader1, "connect", &jsontypes.ColorData{})
+    conn2 := dial(t, port)
+    defer conn2.Close()
+    reader2 := bufio.NewReader(conn2)
+    receiveType(t, reader2, "connect", &jsontypes.ColorData{})
+    receiveType(t, reader1, "chat", &jsontypes.ChatData{}) // player 2 connected
+
+    sendMessage(t, conn1, `{"type":"set_name","name":"alice\u0007"}`)
+    nameData := &jsontypes.ColorData{}
+    receiveType(t, reader2, "set_name", nameData)
+    assertEqual(t, nameData.Name, "alice", "")
+    receiveType(t, reader1, "set_name", &jsontypes.ColorData{}) // own name
+
+    sendMessage(t, conn1, `{"type":"chat","message":"hi"}`)
+    chatData := &jsontypes.ChatData{}
+    receiveType(t, reader2, "chat", chatData)
+    assertEqual(t, chatData.Name, "alice", "Chat should contain the name of the sender")
+
+    sendMessage(t, conn1, `{"type":"ready"}`)
+    sendMessage(t, conn2, `{"type":"ready"}`)
+    startData := &jsontypes.StartGame{}
+    receiveType(t, reader2, "start_game", startData)
+    assertEqual(t, len(startData.Names), 2, "")
+    assertEqual(t, startData.Names[0], "alice", "")
+    assertEqual(t, startData.Width, 100, "")
+    assertEqual(t, startData.Height, 100, "")
+}
+
+// Messages should only be delivered inside the room of the sender
+func TestServerRooms(t *testing.T) {
+    const port = "8770"
+    startServer(t, port)
+    conn1, reader1, conn2, reader2 := connectPlayers(t, port)
+    defer conn1.Close()
+    defer conn2.Close()
+
+    sendMessage(t, conn1, `{"type":"join_room","room":"abc"}`)
+    colorData := &jsontypes.ColorData{}
+    receiveType(t, reader1, "connect", colorData)
+    assertEqual(t, colorData.Room, "abc", "")
+    receiveType(t, reader2, "host", &jsontypes.ColorData{}) // player 1 left
+
+    conn3 := dial(t, port)
+    defer conn3.Close()
+    reader3 := bufio.NewReader(conn3)
+    receiveType(t, reader3, "connect", &jsontypes.ColorData{})
+    receiveType(t, reader2, "chat", &jsontypes.ChatData{}) // player 3 connected
+
+    sendMessage(t, conn3, `{"type":"join_room","room":"abc"}`)
+    receiveType(t, reader3, "connect", &jsontypes.ColorData{})
+    receiveType(t, reader1, "chat", &jsontypes.ChatData{}) // player 3 connected
+    receiveType(t, reader2, "lobby_update", &jsontypes.LobbyUpdate{}) // player 3 left
+
+    sendMessage(t, conn1, `{"type":"chat","message":"only for abc"}`)
+    chatData := &jsontypes.ChatData{}
+    receiveType(t, reader3, "chat", chatData)
+    assertEqual(t, chatData.Message, "only for abc", "")
+
+    // player 2 alone in the default room should not get anything, not even
+    // the start of the game in room abc
+    sendMessage(t, conn1, `{"type":"ready"}`)
+    sendMessage(t, conn3, `{"type":"ready"}`)
+    startData := &jsontypes.StartGame{}
+    receiveType(t, reader1, "start_game", startData)
+    assertEqual(t, len(startData.Colors), 2, "")
+    conn2.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+    if msg, err := reader2.ReadString('\n'); err == nil {
+	t.Fatalf("Player 2 should not receive messages of room abc, got: %s", msg)
+    }
+
+    // room abc is in game, nobody can join it
+    sendMessage(t, conn2, `{"type":"join_room","room":"abc"}`)
+    conn2.SetReadDeadline(time.Now().Add(5 * time.Second))
+    errorData := &jsontypes.ErrorData{}
+    receiveType(t, reader2, "error", errorData)
+    assertEqual(t, errorData.Code, "ROOM_UNAVAILABLE", "")
+}
+
+// Spectators should be able to watch a game in progress
+func TestServerSpectator(t *testing.T) {
+    const port = "8771"
+    startServerWithConfig(t, port, Config{CountdownSeconds: -1})
+    conn1, reader1, conn2, _ := startTwoPlayerGame(t, port)
+    defer conn1.Close()
+    defer conn2.Close()
+
+    conn3 := dial(t, port)
+    defer conn3.Close()
+    reader3 := bufio.NewReader(conn3)
+    receiveType(t, reader3, "connect", &jsontypes.ColorData{})
+    sendMessage(t, conn3, `{"type":"spectate","room":"game-1"}`)
+    roomData := &jsontypes.RoomData{}
+    receiveType(t, reader3, "spectate", roomData)
+    assertEqual(t, roomData.Room, "game-1", "")
+
+    // player events of the spectator are ignored
+    sendMessage(t, conn3, `{"type":"player_event","event":{"direction":"up"}}`)
+    sendMessage(t, conn1, `{"type":"start"}`)
+    tick := &jsontypes.SimpleData{}
+    receiveType(t, reader3, "tick", tick)
+    msg, _ := reader1.ReadString('\n')
+    json.Unmarshal([]byte(msg), tick)
+    assertEqual(t, tick.Type, "tick", "Player should not receive events of the spectator")
+}
+
+// A dropped player should be able to reclaim its slot with its token
+func TestServerReconnect(t *testing.T) {
+    const port = "8772"
+    startServer(t, port)
+    conn1 := dial(t, port)
+    reader1 := bufio.NewReader(conn1)
+    connectData := &jsontypes.ColorData{}
+    receiveType(t, reader1, "connect", connectData)
+    if connectData.Token == "" {
+	t.Fatal("Connect message should contain a token")
+    }
+    conn2 := dial(t, port)
+    defer conn2.Close()
+    reader2 := bufio.NewReader(conn2)
+    receiveType(t, reader2, "connect", &jsontypes.ColorData{})
+    conn1.Close()
+
+    conn3 := dial(t, port)
+    defer conn3.Close()
+    reader3 := bufio.NewReader(conn3)
+    receiveType(t, reader3, "connect", &jsontypes.ColorData{})
+    sendMessage(t, conn3, `{"type":"reconnect","token":"invalid"}`)
+    errorData := &jsontypes.ErrorData{}
+    receiveType(t, reader3, "error", errorData)
+    assertEqual(t, errorData.Code, "INVALID_TOKEN", "")
+
+    sendMessage(t, conn3, fmt.Sprintf(`{"type":"reconnect","token":"%s"}`, connectData.Token))
+    reconnectData := &jsontypes.ColorData{}
+    receiveType(t, reader3, "connect", reconnectData)
+    assertEqual(t, reconnectData.Color, connectData.Color, "Player should get back its color")
+
+    // chat of the reconnected player reaches player 2 with the original color
+    sendMessage(t, conn3, `{"type":"chat","message":"back"}`)
+    chatData := &jsontypes.ChatData{}
+    for chatData.Message != "back" {
+	msg, err := reader2.ReadString('\n')
+	if err != nil {
+	    t.Fatal("Chat of reconnected player not received")
+	}
+	json.Unmarshal([]byte(msg), chatData)
+    }
+    assertEqual(t, chatData.Color, connectData.Color, "")
+}
+
+// Players dropped for missed pongs should not be dropped again right after
+// reconnecting
+func TestServerReconnectAfterMissedPongs(t *testing.T) {
+    const port = "8852"
+    startServerWithConfig(t, port, Config{PingInterval: 20 * time.Millisecond, MaxMissedPongs: 2})
+    conn1 := dial(t, port)
+    defer conn1.Close()
+    reader1 := bufio.NewReader(conn1)
+    connectData := &jsontypes.ColorData{}
+    receiveType(t, reader1, "connect", connectData)
+    // player 1 never answers
+    for {
+	if _, err := reader1.ReadString('\n'); err != nil {
+	    break
+	}
+    }
+
+    conn2 := dial(t, port)
+    defer conn2.Close()
+    reader2 := bufio.NewReader(conn2)
+    receiveType(t, reader2, "connect", &jsontypes.ColorData{})
+    sendMessage(t, conn2, fmt.Sprintf(`{"type":"reconnect","token":"%s"}`, connectData.Token))
+    receiveType(t, reader2, "connect", &jsontypes.ColorData{})
+    for pings := 0; pings < 5; {
+	msg, err := reader2.ReadString('\n')
+	if err != nil {
+	    t.Fatal("Reconnected player answering pings should not be dropped")
+	}
+	if strings.Contains(msg, `"ping"`) {
+	    pings++
+	    sendMessage(t, conn2, `{"type":"pong"}`)
+	}
+    }
+}
+
+// Start should fail if the port is already in use
+func TestServerStartPortInUse(t *testing.T) {
+    l, err := net.Listen("tcp4", ":8777")
+    if err != nil {
+	t.Fatalf("Cannot bind port: %s", err.Error())
+    }
+    defer l.Close()
+    if err := Create().Start("8777"); err == nil {
+	t.Fatal("Start should fail on a port in use")
+    }
+}
+
+// Silent clients should be disconnected after the read timeout
+func TestServerReadTimeout(t *testing.T) {
+    const port = "8778"
+    startServerWithConfig(t, port, Config{ReadTimeout: 100 * time.Millisecond})
+    conn := dial(t, port)
+    defer conn.Close()
+    reader := bufio.NewReader(conn)
+    receiveType(t, reader, "connect", &jsontypes.ColorData{})
+    receiveType(t, reader, "lobby_update", &jsontypes.LobbyUpdate{})
+
+    start := time.Now()
+    if _, err := reader.ReadString('\n'); err == nil {
+	t.Fatal("Connection should be closed")
+    }
+    if time.Since(start) > 3 * time.Second {
+	t.Fatal("Connection should be closed after the read timeout")
+    }
+}
+
+// Clients answering pings should stay, the others should be dropped
+func TestServerPingPong(t *testing.T) {
+    const port = "8779"
+    startServerWithConfig(t, port, Config{PingInterval: 20 * time.Millisecond, MaxMissedPongs: 2})
+    conn1 := dial(t, port)
+    defer conn1.Close()
+    reader1 := bufio.NewReader(conn1)
+    receiveType(t, reader1, "connect", &jsontypes.ColorData{})
+    conn2 := dial(t, port)
+    defer conn2.Close()
+    reader2 := bufio.NewReader(conn2)
+    receiveType(t, reader2, "connect", &jsontypes.ColorData{})
+
+    // player 2 never answers
+    dropped := make(chan bool)
+    go func() {
+	for {
+	    if _, err := reader2.ReadString('\n'); err != nil {
+		dropped <- true
+		return
+	    }
+	}
+    }()
+
+    // player 1 keeps answering while player 2 is dropped
+    for pings := 0; pings < 8; {
+	msg, err := reader1.ReadString('\n')
+	if err != nil {
+	    t.Fatal("Player answering pings should not be dropped")
+	}
+	if strings.Contains(msg, `"ping"`) {
+	    pings++
+	    sendMessage(t, conn1, `{"type":"pong"}`)
+	}
+    }
+    select {
+    case <-dropped:
+    case <-time.After(time.Second):
+	t.Fatal("Player not answering pings should be dropped")
+    }
+}
+
+// Flooding client should be limited without blocking the others
+func TestServerRateLimit(t *testing.T) {
+    const port = "8780"
+    startServerWithConfig(t, port, Config{MessageRate: 10})
+    conn1, reader1, conn2, _ := connectPlayers(t, port)
+    defer conn1.Close()
+    defer conn2.Close()
+    conn3 := dial(t, port)
+    defer conn3.Close()
+    reader3 := bufio.NewReader(conn3)
+    receiveType(t, reader3, "connect", &jsontypes.ColorData{})
+
+    flood := ""
+    for i := 0; i < 200; i++ {
+	flood += `{"type":"chat","message":"spam"}` + "\n"
+    }
+    conn1.Write([]byte(flood))
+    limited := false
+    for !limited {
+	msg, err := reader1.ReadString('\n')
+	if err != nil {
+	    t.Fatal("Flooding client should get a rate limit error")
+	}
+	limited = strings.Contains(msg, "RATE_LIMITED")
+    }
+
+    sendMessage(t, conn2, `{"type":"chat","message":"still here"}`)
+    spam := 0
+    for {
+	msg, err := reader3.ReadString('\n')
+	if err != nil {
+	    t.Fatal("Chat of player 2 not received")
+	}
+	if strings.Contains(msg, "still here") {
+	    break
+	}
+	if strings.Contains(msg, "spam") {
+	    spam++
+	}
+    }
+    if spam > 20 {
+	t.Fatalf("Too many messages of the flooding client got through: %d", spam)
+    }
+}
+
+// Malformed and unknown messages should be answered with an error
+func TestServerBadMessage(t *testing.T) {
+    const port = "8781"
+    startServer(t, port)
+    conn1, reader1, conn2, reader2 := connectPlayers(t, port)
+    defer conn1.Close()
+    defer conn2.Close()
+
+    assertBadMessage := func(conn net.Conn, reader *bufio.Reader, message string) {
+	sendMessage(t, conn, message)
+	errorData := &jsontypes.ErrorData{}
+	receiveType(t, reader, "error", errorData)
+	assertEqual(t, errorData.Code, "BAD_MESSAGE", "")
+	if errorData.Message == "" {
+	    t.Fatal("Error should have a message")
+	}
+    }
+    assertBadMessage(conn1, reader1, `{"type": "chat", `)
+    assertBadMessage(conn1, reader1, `{"type": "dance"}`)
+
+    sendMessage(t, conn1, `{"type":"ready"}`)
+    sendMessage(t, conn2, `{"type":"ready"}`)
+    receiveType(t, reader1, "start_game", &jsontypes.StartGame{})
+    receiveType(t, reader2, "start_game", &jsontypes.StartGame{})
+    assertBadMessage(conn2, reader2, `not json`)
+    assertBadMessage(conn2, reader2, `{"type": "chat", "message": "lobby only"}`)
+}
+
+// Clients sending huge messages should be disconnected
+func TestServerMessageTooLarge(t *testing.T) {
+    const port = "8782"
+    startServer(t, port)
+    conn1 := dial(t, port)
+    defer conn1.Close()
+    reader1 := bufio.NewReader(conn1)
+    receiveType(t, reader1, "connect", &jsontypes.ColorData{})
+
+    go conn1.Write([]byte(`{"type":"chat","message":"` + strings.Repeat("a", 1 << 20) + "\"}\n"))
+    errorData := &jsontypes.ErrorData{}
+    receiveType(t, reader1, "error", errorData)
+    assertEqual(t, errorData.Code, "MESSAGE_TOO_LARGE", "")
+    if _, err := reader1.ReadString('\n'); err == nil {
+	t.Fatal("Connection should be closed")
+    }
+
+    // server should still accept players
+    conn2 := dial(t, port)
+    defer conn2.Close()
+    receiveObject(t, conn2, &jsontypes.ColorData{})
+}
+
+// Winner of a round should get a point on the scoreboard
+func TestServerScoreboard(t *testing.T) {
+    const port = "8783"
+    startServerWithConfig(t, port, Config{TickInterval: 5 * time.Millisecond, CountdownSeconds: -1})
+    conn1, reader1, conn2, reader2 := startTwoPlayerGame(t, port)
+    defer conn1.Close()
+    defer conn2.Close()
+
+    // player 1 drives into the wall while player 2 goes straight
+    sendMessage(t, conn1, `{"type":"player_event","event":{"direction":"up"}}`)
+    sendMessage(t, conn1, `{"type":"start"}`)
+    gameOver := &jsontypes.GameOver{}
+    receiveType(t, reader2, "game_over", gameOver)
+    if gameOver.Winner == nil {
+	t.Fatal("Game should have a winner")
+    }
+    scoreboard := &jsontypes.Scoreboard{}
+    receiveType(t, reader2, "scoreboard", scoreboard)
+    assertEqual(t, len(scoreboard.Scores), 2, "")
+    for _, score := range scoreboard.Scores {
+	if score.Color == *gameOver.Winner {
+	    assertEqual(t, score.Wins, 1, "Winner should have one win")
+	} else {
+	    assertEqual(t, score.Wins, 0, "Loser should have no wins")
+	}
+    }
+
+    receiveType(t, reader1, "scoreboard", scoreboard)
+    sendMessage(t, conn1, `{"type":"reset_scores"}`)
+    receiveType(t, reader2, "scoreboard", scoreboard)
+    for _, score := range scoreboard.Scores {
+	assertEqual(t, score.Wins, 0, "Scores should be reset")
+    }
+}
+
+// Disconnect during the countdown should cancel it
+func TestServerCountdownCancelled(t *testing.T) {
+    const port = "8784"
+    startServerWithConfig(t, port, Config{CountdownSeconds: 2})
+    conn1, reader1, conn2, _ := startTwoPlayerGame(t, port)
+    defer conn1.Close()
+
+    sendMessage(t, conn1, `{"type":"start"}`)
+    countdown := &jsontypes.Countdown{}
+    receiveType(t, reader1, "countdown", countdown)
+    assertEqual(t, countdown.Seconds, 2, "")
+    conn2.Close()
+
+    msg, err := reader1.ReadString('\n')
+    if err != nil {
+	t.Fatal("Countdown cancel not received")
+    }
+    assertEqual(t, strings.TrimSpace(msg), `{"type":"countdown_cancelled"}`, "")
+    conn1.SetReadDeadline(time.Now().Add(2500 * time.Millisecond))
+    for {
+	msg, err := reader1.ReadString('\n')
+	if err != nil {
+	    break
+	}
+	if strings.Contains(msg, "tick") || strings.Contains(msg, "countdown") {
+	    t.Fatalf("No countdown or tick should arrive after cancel, got %s", msg)
+	}
+    }
+}
+
+// Only the host should be able to start the game
+func TestServerHostStart(t *testing.T) {
+    const port = "8785"
+    startServerWithConfig(t, port, Config{CountdownSeconds: -1})
+    conn1, reader1, conn2, reader2 := startTwoPlayerGame(t, port)
+    defer conn1.Close()
+    defer conn2.Close()
+
+    sendMessage(t, conn2, `{"type":"start"}`)
+    errorData := &jsontypes.ErrorData{}
+    receiveType(t, reader2, "error", errorData)
+    assertEqual(t, errorData.Code, "NOT_HOST", "")
+    conn1.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+    if msg, err := reader1.ReadString('\n'); err == nil {
+	t.Fatalf("Start of non-host should be ignored, got %s", msg)
+    }
+
+    conn1.SetReadDeadline(time.Now().Add(5 * time.Second))
+    sendMessage(t, conn1, `{"type":"start"}`)
+    receiveType(t, reader1, "tick", &jsontypes.SimpleData{})
+}
+
+// Host role should pass on when the host leaves
+func TestServerHostTransfer(t *testing.T) {
+    const port = "8786"
+    startServer(t, port)
+    conn1 := dial(t, port)
+    reader1 := bufio.NewReader(conn1)
+    connectData := &jsontypes.ColorData{}
+    receiveType(t, reader1, "connect", connectData)
+    assertEqual(t, connectData.Host, true, "First player should be the host")
+
+    conn2 := dial(t, port)
+    defer conn2.Close()
+    reader2 := bufio.NewReader(conn2)
+    connectData = &jsontypes.ColorData{}
+    receiveType(t, reader2, "connect", connectData)
+    assertEqual(t, connectData.Host, false, "Second player should not be the host")
+
+    conn1.Close()
+    hostData := &jsontypes.ColorData{}
+    receiveType(t, reader2, "host", hostData)
+    assertEqual(t, hostData.Color, connectData.Color, "")
+}
+
+// Players in the lobby should get the list of players
+func TestServerLobbyUpdate(t *testing.T) {
+    const port = "8787"
+    startServer(t, port)
+    conn1 := dial(t, port)
+    defer conn1.Close()
+    reader1 := bufio.NewReader(conn1)
+    connectData := &jsontypes.ColorData{}
+    receiveType(t, reader1, "connect", connectData)
+    update := &jsontypes.LobbyUpdate{}
+    receiveType(t, reader1, "lobby_update", update)
+    assertEqual(t, len(update.Players), 1, "")
+    assertEqual(t, update.Players[0].Color, connectData.Color, "")
+
+    conn2 := dial(t, port)
+    defer conn2.Close()
+    reader2 := bufio.NewReader(conn2)
+    receiveType(t, reader2, "lobby_update", update)
+    assertEqual(t, len(update.Players), 2, "New player should get the list")
+    receiveType(t, reader1, "lobby_update", update)
+    assertEqual(t, len(update.Players), 2, "Others should be notified about the new player")
+
+    sendMessage(t, conn1, `{"type":"set_name","name":"alice"}`)
+    sendMessage(t, conn1, `{"type":"ready"}`)
+    update = &jsontypes.LobbyUpdate{}
+    receiveType(t, reader2, "lobby_update", update)
+    assertEqual(t, update.Players[0].Name, "alice", "")
+    assertEqual(t, update.Players[0].Ready, true, "")
+    assertEqual(t, update.Players[1].Ready, false, "")
+    receiveType(t, reader1, "lobby_update", update) // own ready
+
+    // players moving to another room leave the list
+    sendMessage(t, conn2, `{"type":"join_room","room":"abc"}`)
+    receiveType(t, reader1, "lobby_update", update)
+    assertEqual(t, len(update.Players), 1, "Others should be notified about the player leaving")
+}
+
+// Renamed default room should not take the id of a room created by a player
+func TestServerGameRoomIdTaken(t *testing.T) {
+    const port = "8854"
+    s := startServer(t, port)
+    conn := dial(t, port)
+    defer conn.Close()
+    reader := bufio.NewReader(conn)
+    receiveType(t, reader, "connect", &jsontypes.ColorData{})
+    sendMessage(t, conn, `{"type":"join_room","room":"game-1"}`)
+    receiveType(t, reader, "connect", &jsontypes.ColorData{})
+
+    conn1, _, conn2, _ := startTwoPlayerGame(t, port)
+    defer conn1.Close()
+    defer conn2.Close()
+    sendMessage(t, conn, `{"type":"leave"}`)
+    for i := 0; i < 100 && len(s.Stats().Rooms) > 1; i++ {
+	time.Sleep(10 * time.Millisecond)
+    }
+    stats := s.Stats()
+    assertEqual(t, len(stats.Rooms), 1, "Room of the player who left should be closed")
+    assertEqual(t, stats.Rooms[0].Id, "game-2", "")
+    assertEqual(t, stats.Rooms[0].Phase, "game", "")
+}
+
+// Stats should report the state of the broker
+func TestServerStats(t *testing.T) {
+    const port = "8788"
+    assertEqual(t, Create().Stats().Running, false, "Server which is not started should not be running")
+
+    s := startServer(t, port)
+    conn1, _, conn2, _ := startTwoPlayerGame(t, port)
+    defer conn1.Close()
+    defer conn2.Close()
+    stats := s.Stats()
+    assertEqual(t, stats.Running, true, "")
+    assertEqual(t, stats.Clients, 2, "")
+    assertEqual(t, len(stats.Rooms), 1, "")
+    assertEqual(t, stats.Rooms[0].Id, "game-1", "")
+    assertEqual(t, stats.Rooms[0].Phase, "game", "")
+    assertEqual(t, stats.Rooms[0].Players, 2, "")
+    assertEqual(t, stats.Rooms[0].Ticking, false, "Ticker should wait for the host")
+
+    s.Stop()
+    // the broker might still handle events queued before the stop
+    for i := 0; i < 100 && s.Stats().Running; i++ {
+	time.Sleep(10 * time.Millisecond)
+    }
+    assertEqual(t, s.Stats().Running, false, "Stopped server should not be running")
+}
+
+// Concurrent connections should not race on the state of the broker. Run
+// with -race to detect data races.
+func TestServerConcurrentConnections(t *testing.T) {
+    const port = "8789"
+    const players = 6
+    startServer(t, port)
+    dial(t, port).Close() // wait for the server
+
+    colors := make(chan string, players)
+    for i := 0; i < players; i++ {
+	go func() {
+	    conn := dial(t, port)
+	    defer conn.Close()
+	    connectData := &jsontypes.ColorData{}
+	    reader := bufio.NewReader(conn)
+	    msg, err := reader.ReadString('\n')
+	    if err == nil {
+		json.Unmarshal([]byte(msg), connectData)
+	    }
+	    sendMessage(t, conn, `{"type":"chat","message":"hello"}`)
+	    conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	    for err == nil {
+		_, err = reader.ReadString('\n')
+	    }
+	    colors <- connectData.Color
+	}()
+    }
+    seen := make(map[string]bool)
+    for i := 0; i < players; i++ {
+	color := <-colors
+	if color == "" || seen[color] {
+	    t.Fatalf("Player should get a unique color, got '%s'", color)
+	}
+	seen[color] = true
+    }
+}
+
+// Host should be able to remove a player from the room
+func TestServerKick(t *testing.T) {
+    const port = "8790"
+    startServer(t, port)
+    conn1, reader1, conn2, reader2 := connectPlayers(t, port)
+    defer conn1.Close()
+    defer conn2.Close()
+    conn3 := dial(t, port)
+    defer conn3.Close()
+    reader3 := bufio.NewReader(conn3)
+    connectData := &jsontypes.ColorData{}
+    receiveType(t, reader3, "connect", connectData)
+
+    sendMessage(t, conn2, fmt.Sprintf(`{"type":"kick","color":"%s"}`, connectData.Color))
+    errorData := &jsontypes.ErrorData{}
+    receiveType(t, reader2, "error", errorData)
+    assertEqual(t, errorData.Code, "NOT_HOST", "Only the host should kick")
+
+    sendMessage(t, conn1, fmt.Sprintf(`{"type":"kick","color":"%s"}`, connectData.Color))
+    receiveType(t, reader3, "kicked", &jsontypes.SimpleData{})
+    for {
+	if _, err := reader3.ReadString('\n'); err != nil {
+	    break // connection of the kicked player is closed
+	}
+    }
+    update := &jsontypes.LobbyUpdate{}
+    for len(update.Players) != 2 {
+	receiveType(t, reader1, "lobby_update", update)
+    }
+    for _, p := range update.Players {
+	if p.Color == connectData.Color {
+	    t.Fatal("Kicked player should not be in the lobby")
+	}
+    }
+}
+
+// Chat with a recipient should only reach the recipient and the sender
+func TestServerWhisper(t *testing.T) {
+    const port = "8791"
+    startServer(t, port)
+    conn1, reader1, conn2, reader2 := connectPlayers(t, port)
+    defer conn1.Close()
+    defer conn2.Close()
+    conn3 := dial(t, port)
+    defer conn3.Close()
+    reader3 := bufio.NewReader(conn3)
+    connectData := &jsontypes.ColorData{}
+    receiveType(t, reader3, "connect", connectData)
+
+    sendMessage(t, conn1, fmt.Sprintf(`{"type":"chat","to":"%s","message":"psst"}`, connectData.Color))
+    chatData := &jsontypes.ChatData{}
+    receiveType(t, reader3, "chat", chatData)
+    assertEqual(t, chatData.Message, "psst", "")
+    assertEqual(t, chatData.To, connectData.Color, "")
+    chatData = &jsontypes.ChatData{}
+    for chatData.Message != "psst" {
+	receiveType(t, reader1, "chat", chatData) // echo, after player 3 connected
+    }
+
+    sendMessage(t, conn1, `{"type":"chat","to":"#123456","message":"hello?"}`)
+    errorData := &jsontypes.ErrorData{}
+    receiveType(t, reader1, "error", errorData)
+    assertEqual(t, errorData.Code, "BAD_MESSAGE", "")
+
+    sendMessage(t, conn1, `{"type":"chat","message":"everyone"}`)
+    chatData = &jsontypes.ChatData{}
+    receiveType(t, reader2, "chat", chatData)
+    for chatData.Message != "everyone" {
+	if chatData.Message == "psst" {
+	    t.Fatal("Whisper should not reach other players")
+	}
+	receiveType(t, reader2, "chat", chatData)
+    }
+}
+
+// Chat filter should be applied to the broadcasted chat
+func TestServerChatFilter(t *testing.T) {
+    const port = "8792"
+    startServerWithConfig(t, port, Config{ChatFilter: strings.ToUpper})
+    conn1, _, conn2, reader2 := connectPlayers(t, port)
+    defer conn1.Close()
+    defer conn2.Close()
+
+    sendMessage(t, conn1, `{"type":"chat","message":"quiet please"}`)
+    chatData := &jsontypes.ChatData{}
+    receiveType(t, reader2, "chat", chatData)
+    assertEqual(t, chatData.Message, "QUIET PLEASE", "")
+}
+
+// Clients speaking another protocol version should be disconnected
+func TestServerProtocolVersion(t *testing.T) {
+    const port = "8793"
+    startServer(t, port)
+    conn1, reader1, conn2, reader2 := connectPlayers(t, port)
+    defer conn1.Close()
+    defer conn2.Close()
+
+    sendMessage(t, conn1, fmt.Sprintf(`{"type":"hello","protocol":%d}`, ProtocolVersion))
+    sendMessage(t, conn2, `{"type":"hello","protocol":1}`)
+    errorData := &jsontypes.ErrorData{}
+    receiveType(t, reader2, "error", errorData)
+    assertEqual(t, errorData.Code, "PROTOCOL_MISMATCH", "")
+    if _, err := reader2.ReadString('\n'); err == nil {
+	t.Fatal("Connection should be closed")
+    }
+
+    // compatible client stays
+    conn3 := dial(t, port)
+    defer conn3.Close()
+    connectData := &jsontypes.ColorData{}
+    receiveType(t, bufio.NewReader(conn3), "connect", connectData)
+    assertEqual(t, connectData.Protocol, ProtocolVersion, "")
+    receiveType(t, reader1, "chat", &jsontypes.ChatData{}) // player 3 connected
+}
+
+// Ticking should stop while the game is paused
+func TestServerPause(t *testing.T) {
+    const port = "8794"
+    startServerWithConfig(t, port, Config{TickInterval: 20 * time.Millisecond, CountdownSeconds: -1})
+    conn1, reader1, conn2, reader2 := startTwoPlayerGame(t, port)
+    defer conn1.Close()
+    defer conn2.Close()
+
+    sendMessage(t, conn1, `{"type":"start"}`)
+    receiveType(t, reader2, "tick", &jsontypes.SimpleData{})
+    sendMessage(t, conn2, `{"type":"pause"}`)
+    receiveType(t, reader1, "paused", &jsontypes.SimpleData{})
+    conn1.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+    if msg, err := reader1.ReadString('\n'); err == nil {
+	t.Fatalf("No message should arrive while paused, got %s", msg)
+    }
+
+    conn1.SetReadDeadline(time.Now().Add(5 * time.Second))
+    sendMessage(t, conn1, `{"type":"resume"}`)
+    receiveType(t, reader1, "resumed", &jsontypes.SimpleData{})
+    receiveType(t, reader1, "tick", &jsontypes.SimpleData{})
+}
+
+// Finished games should be recorded
+func TestServerReplay(t *testing.T) {
+    const port = "8795"
+    dir := t.TempDir()
+    s := startServerWithConfig(t, port, Config{TickInterval: 5 * time.Millisecond, CountdownSeconds: -1,
+	ReplayDir: dir})
+    conn1, _, conn2, reader2 := startTwoPlayerGame(t, port)
+    defer conn1.Close()
+    defer conn2.Close()
+    if s.LastReplay() != nil {
+	t.Fatal("There should be no replay before the end of the game")
+    }
+
+    sendMessage(t, conn1, `{"type":"player_event","event":{"direction":"up"}}`)
+    sendMessage(t, conn1, `{"type":"start"}`)
+    gameOver := &jsontypes.GameOver{}
+    receiveType(t, reader2, "game_over", gameOver)
+
+    replay := s.LastReplay()
+    if replay == nil {
+	t.Fatal("Game should be recorded")
+    }
+    assertEqual(t, replay.Room, "game-1", "")
+    assertEqual(t, len(replay.Start.Spawns), 2, "")
+    assertEqual(t, len(replay.Events), 1, "")
+    assertEqual(t, replay.Events[0].Tick, 0, "")
+    assertEqual(t, replay.Events[0].Direction, "up", "")
+    assertEqual(t, *replay.Winner, *gameOver.Winner, "")
+    if replay.Ticks == 0 {
+	t.Fatal("Replay should contain the number of ticks")
+    }
+
+    data, err := os.ReadFile(filepath.Join(dir, "replay-1.json"))
+    if err != nil {
+	t.Fatalf("Replay should be written: %s", err.Error())
+    }
+    written := &jsontypes.Replay{}
+    json.Unmarshal(data, written)
+    assertEqual(t, written.Ticks, replay.Ticks, "")
+}
+
+// Ticks should be numbered from the start of the game
+func TestServerTickCounter(t *testing.T) {
+    const port = "8796"
+    startServerWithConfig(t, port, Config{TickInterval: 5 * time.Millisecond, CountdownSeconds: -1})
+    conn1, reader1, conn2, _ := startTwoPlayerGame(t, port)
+    defer conn1.Close()
+    defer conn2.Close()
+
+    sendMessage(t, conn1, `{"type":"start"}`)
+    for n := 1; n <= 5; n++ {
+	tick := &jsontypes.Tick{}
+	receiveType(t, reader1, "tick", tick)
+	assertEqual(t, tick.N, n, "")
+    }
+}
+
+// Host should be able to play against a bot
+func TestServerBot(t *testing.T) {
+    const port = "8797"
+    startServerWithConfig(t, port, Config{TickInterval: 2 * time.Millisecond, CountdownSeconds: -1, MaxBots: 1})
+    conn := dial(t, port)
+    defer conn.Close()
+    reader := bufio.NewReader(conn)
+    connectData := &jsontypes.ColorData{}
+    receiveType(t, reader, "connect", connectData)
+
+    sendMessage(t, conn, `{"type":"add_bot"}`)
+    update := &jsontypes.LobbyUpdate{}
+    for len(update.Players) != 2 || !update.Players[1].Ready {
+	receiveType(t, reader, "lobby_update", update)
+    }
+    sendMessage(t, conn, `{"type":"add_bot"}`)
+    errorData := &jsontypes.ErrorData{}
+    receiveType(t, reader, "error", errorData)
+    assertEqual(t, errorData.Code, "ROOM_UNAVAILABLE", "Number of bots should be limited")
+
+    sendMessage(t, conn, `{"type":"ready"}`)
+    startData := &jsontypes.StartGame{}
+    receiveType(t, reader, "start_game", startData)
+    assertEqual(t, len(startData.Colors), 2, "")
+    sendMessage(t, conn, `{"type":"start"}`)
+
+    // player drives into the wall, the bot does not
+    gameOver := &jsontypes.GameOver{}
+    receiveType(t, reader, "game_over", gameOver)
+    if gameOver.Winner == nil || *gameOver.Winner == connectData.Color {
+	t.Fatal("Bot should win")
+    }
+    update = &jsontypes.LobbyUpdate{}
+    for len(update.Players) != 1 {
+	receiveType(t, reader, "lobby_update", update)
+    }
+    assertEqual(t, update.Players[0].Color, connectData.Color, "Bot should be removed after the game")
+}
+
+// Power-ups should be announced when configured
+func TestServerPowerUps(t *testing.T) {
+    const port = "8798"
+    startServerWithConfig(t, port, Config{TickInterval: 5 * time.Millisecond, CountdownSeconds: -1,
+	PowerUpInterval: 2, PowerUpKinds: []string{ClearPowerUp}})
+    conn1, reader1, conn2, _ := startTwoPlayerGame(t, port)
+    defer conn1.Close()
+    defer conn2.Close()
+
+    sendMessage(t, conn1, `{"type":"start"}`)
+    spawn := &jsontypes.PowerUpSpawn{}
+    receiveType(t, reader1, "powerup_spawn", spawn)
+    assertEqual(t, spawn.Id, 1, "")
+    assertEqual(t, spawn.Kind, ClearPowerUp, "")
+}
+
+// Cancelling the context should shut down the server
+func TestServerStartContext(t *testing.T) {
+    const port = "8799"
+    ctx, cancel := context.WithCancel(context.Background())
+    s := Create()
+    stopped := make(chan error)
+    go func() {
+	stopped <- s.StartContext(ctx, port)
+    }()
+    conn := dial(t, port)
+    defer conn.Close()
+    reader := bufio.NewReader(conn)
+    receiveType(t, reader, "connect", &jsontypes.ColorData{})
+
+    cancel()
+    select {
+    case err := <-stopped:
+	if err != nil {
+	    t.Fatalf("StartContext failed: %s", err.Error())
+	}
+    case <-time.After(time.Second):
+	t.Fatal("Server should stop when the context is cancelled")
+    }
+    for {
+	if _, err := reader.ReadString('\n'); err != nil {
+	    break // connection closed
+	}
+    }
+}
+
+// eventRecorder is an EventHandler which records the events as strings.
+type eventRecorder struct {
+    events chan string
+}
+
+func (e eventRecorder) OnConnect(color string)      { e.events <- "connect" }
+func (e eventRecorder) OnDisconnect(color string)   { e.events <- "disconnect" }
+func (e eventRecorder) OnGameStart(colors []string) { e.events <- fmt.Sprintf("start %d", len(colors)) }
+func (e eventRecorder) OnGameOver(winner string)    { e.events <- "game_over" }
+func (e eventRecorder) OnChat(from, message string) { e.events <- "chat " + message }
+
+// Lifecycle events should be passed to the event handler
+func TestServerEvents(t *testing.T) {
+    const port = "8800"
+    recorder := eventRecorder{events: make(chan string, 100)}
+    startServerWithConfig(t, port, Config{TickInterval: 5 * time.Millisecond, CountdownSeconds: -1,
+	Events: recorder})
+    conn1, reader1, conn2, reader2 := connectPlayers(t, port)
+    defer conn1.Close()
+
+    sendMessage(t, conn1, `{"type":"chat","message":"hi"}`)
+    receiveType(t, reader2, "chat", &jsontypes.ChatData{})
+    sendMessage(t, conn1, `{"type":"ready"}`)
+    sendMessage(t, conn2, `{"type":"ready"}`)
+    receiveType(t, reader1, "start_game", &jsontypes.StartGame{})
+    sendMessage(t, conn1, `{"type":"start"}`)
+    receiveType(t, reader1, "game_over", &jsontypes.GameOver{})
+    conn2.Close()
+
+    for _, expected := range []string{"connect", "connect", "chat hi", "start 2", "game_over", "disconnect"} {
+	select {
+	case event := <-recorder.events:
+	    assertEqual(t, event, expected, "")
+	case <-time.After(time.Second):
+	    t.Fatalf("Event %s not received", expected)
+	}
+    }
+}
+
+// Players should get the colors of the configured palette
+func TestServerColorProvider(t *testing.T) {
+    const port = "8801"
+    startServerWithConfig(t, port, Config{Colors: Palette{"#111111", "#222222"}})
+    for _, expected := range []string{"#111111", "#222222"} {
+	conn := dial(t, port)
+	defer conn.Close()
+	connectData := &jsontypes.ColorData{}
+	receiveType(t, bufio.NewReader(conn), "connect", connectData)
+	assertEqual(t, connectData.Color, expected, "")
+    }
+}
+
+// Game should not start when a ready player takes it back
+func TestServerUnready(t *testing.T) {
+    const port = "8802"
+    startServer(t, port)
+    conn1, reader1, conn2, _ := connectPlayers(t, port)
+    defer conn1.Close()
+    defer conn2.Close()
+    conn3 := dial(t, port)
+    defer conn3.Close()
+    receiveType(t, bufio.NewReader(conn3), "connect", &jsontypes.ColorData{})
+
+    // messages of different connections may arrive in any order, so wait
+    // for every change to be announced before the next one
+    waitReady := func(n int) {
+	for {
+	    update := &jsontypes.LobbyUpdate{}
+	    receiveType(t, reader1, "lobby_update", update)
+	    readyCount := 0
+	    for _, p := range update.Players {
+		if p.Ready {
+		    readyCount++
+		}
+	    }
+	    if len(update.Players) == 3 && readyCount == n {
+		return
+	    }
+	}
+    }
+    sendMessage(t, conn1, `{"type":"ready"}`)
+    waitReady(1)
+    sendMessage(t, conn2, `{"type":"ready"}`)
+    waitReady(2)
+    sendMessage(t, conn1, `{"type":"unready"}`)
+    waitReady(1)
+    sendMessage(t, conn3, `{"type":"ready"}`)
+    waitReady(2)
+
+    conn1.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+    if msg, err := reader1.ReadString('\n'); err == nil {
+	t.Fatalf("Game should not start while a player is not ready, got %s", msg)
+    }
+}
+
+// Game should start when the only player not ready leaves the room
+func TestServerStartWhenWaitingLeaves(t *testing.T) {
+    const port = "8803"
+    startServer(t, port)
+    conn1, reader1, conn2, _ := connectPlayers(t, port)
+    defer conn1.Close()
+    defer conn2.Close()
+    conn3 := dial(t, port)
+    defer conn3.Close()
+    connectData := &jsontypes.ColorData{}
+    receiveType(t, bufio.NewReader(conn3), "connect", connectData)
+
+    sendMessage(t, conn1, `{"type":"ready"}`)
+    sendMessage(t, conn2, `{"type":"ready"}`)
+    for {
+	update := &jsontypes.LobbyUpdate{}
+	receiveType(t, reader1, "lobby_update", update)
+	if len(update.Waiting) == 1 {
+	    assertEqual(t, update.Waiting[0], connectData.Color, "Lobby should wait for player 3")
+	    break
+	}
+    }
+    sendMessage(t, conn3, `{"type":"join_room","room":"elsewhere"}`)
+    receiveType(t, reader1, "start_game", &jsontypes.StartGame{})
+}
+
+// Server should shut down when nobody sends a message in the lobby
+func TestServerLobbyIdleTimeout(t *testing.T) {
+    const port = "8804"
+    s := startServerWithConfig(t, port, Config{LobbyIdleTimeout: 300 * time.Millisecond})
+    conn1, reader1, conn2, _ := connectPlayers(t, port)
+    defer conn1.Close()
+    defer conn2.Close()
+
+    time.Sleep(200 * time.Millisecond)
+    sendMessage(t, conn1, `{"type":"set_name","name":"alice"}`)
+    time.Sleep(200 * time.Millisecond)
+    if !s.Stats().Running {
+	t.Fatal("Messages should reset the idle timeout")
+    }
+    errorData := &jsontypes.ErrorData{}
+    receiveType(t, reader1, "error", errorData)
+    assertEqual(t, errorData.Code, "IDLE_TIMEOUT", "")
+    if _, err := reader1.ReadString('\n'); err == nil {
+	t.Fatal("Connection should be closed")
+    }
+}
+
+// Server should listen on the given address only
+func TestServerStartAddr(t *testing.T) {
+    const addr = "127.0.0.1:8805"
+    s := Create()
+    go s.StartAddr(addr)
+    defer s.Stop()
+    var conn net.Conn
+    var err error
+    for i := 0; i < 50; i++ {
+	if conn, err = net.Dial("tcp", addr); err == nil {
+	    break
+	}
+	time.Sleep(10 * time.Millisecond)
+    }
+    if err != nil {
+	t.Fatalf("Connection failed: %s", err.Error())
+    }
+    defer conn.Close()
+    receiveType(t, bufio.NewReader(conn), "connect", &jsontypes.ColorData{})
+
+    if err := Create().StartAddr("not an address"); err == nil {
+	t.Fatal("Invalid address should be refused")
+    }
+}
+
+// Lonely players should play against a bot after the lobby wait
+func TestServerAutoStart(t *testing.T) {
+    const port = "8806"
+    startServerWithConfig(t, port, Config{AutoStartWait: 200 * time.Millisecond})
+    conn := dial(t, port)
+    defer conn.Close()
+    reader := bufio.NewReader(conn)
+    receiveType(t, reader, "connect", &jsontypes.ColorData{})
+
+    warning := &jsontypes.AutoStart{}
+    receiveType(t, reader, "auto_start", warning)
+    if warning.Seconds > 1 {
+	t.Fatalf("Warning should not promise more than the wait, got %d seconds", warning.Seconds)
+    }
+    startGame := &jsontypes.StartGame{}
+    receiveType(t, reader, "start_game", startGame)
+    assertEqual(t, len(startGame.Colors), 2, "Lobby should be filled up with a bot")
+}
+
+// Players should be told when an opponent leaves the game
+func TestServerPlayerLeft(t *testing.T) {
+    const port = "8807"
+    startServerWithConfig(t, port, Config{CountdownSeconds: -1})
+    conn1, reader1, conn2, _ := startTwoPlayerGame(t, port)
+    defer conn1.Close()
+    conn2.Close()
+
+    left := &jsontypes.PlayerLeft{}
+    receiveType(t, reader1, "player_left", left)
+    assertEqual(t, left.Reason, "closed", "")
+    dead := &jsontypes.PlayerDead{}
+    receiveType(t, reader1, "player_dead", dead)
+    assertEqual(t, dead.Color, left.Color, "Car of the player who left should crash")
+
+    sendMessage(t, conn1, `{"type":"start"}`)
+    gameOver := &jsontypes.GameOver{}
+    receiveType(t, reader1, "game_over", gameOver)
+    if gameOver.Winner == nil || *gameOver.Winner == left.Color {
+	t.Fatal("Remaining player should win")
+    }
+}
+
+// Reversals should be refused and not relayed
+func TestServerIllegalMove(t *testing.T) {
+    const port = "8808"
+    startServer(t, port)
+    conn1, reader1, conn2, reader2 := startTwoPlayerGame(t, port)
+    defer conn1.Close()
+    defer conn2.Close()
+
+    sendMessage(t, conn1, `{"type":"player_event","event":{"direction":"left"}}`)
+    errorData := &jsontypes.ErrorData{}
+    receiveType(t, reader1, "error", errorData)
+    assertEqual(t, errorData.Code, "ILLEGAL_MOVE", "")
+    sendMessage(t, conn1, `{"type":"player_event","event":{"direction":"nowhere"}}`)
+    receiveType(t, reader1, "error", errorData)
+    assertEqual(t, errorData.Code, "BAD_MESSAGE", "")
+
+    sendMessage(t, conn1, `{"type":"player_event","event":{"direction":"up"}}`)
+    event := &jsontypes.GameData{}
+    receiveType(t, reader2, "player_event", event)
+    assertEqual(t, event.Event.Direction, "up", "Only the legal move should be relayed")
+}
+
+// Messages with unknown or missing fields should be refused
+func TestServerInvalidFields(t *testing.T) {
+    const port = "8809"
+    startServer(t, port)
+    conn1, reader1, conn2, _ := connectPlayers(t, port)
+    defer conn1.Close()
+    defer conn2.Close()
+
+    for _, message := range []string{`{"type":"chat"}`, `{"type":"ready","mood":"eager"}`} {
+	sendMessage(t, conn1, message)
+	errorData := &jsontypes.ErrorData{}
+	receiveType(t, reader1, "error", errorData)
+	assertEqual(t, errorData.Code, "INVALID_FIELDS", message)
+    }
+}
+
+// Draining server should refuse new connections, and shut down after the game
+func TestServerDrain(t *testing.T) {
+    const port = "8810"
+    s := startServerWithConfig(t, port, Config{CountdownSeconds: -1})
+    conn1, reader1, conn2, reader2 := startTwoPlayerGame(t, port)
+    defer conn1.Close()
+
+    s.Drain()
+    receiveType(t, reader1, "draining", &jsontypes.SimpleData{})
+    receiveType(t, reader2, "draining", &jsontypes.SimpleData{})
+    if conn, err := net.Dial("tcp", ":" + port); err == nil {
+	conn.Close()
+	t.Fatal("Draining server should not accept connections")
+    }
+    if !s.Stats().Running {
+	t.Fatal("Server should keep running until the game is over")
+    }
+
+    conn2.Close()
+    sendMessage(t, conn1, `{"type":"start"}`)
+    receiveType(t, reader1, "game_over", &jsontypes.GameOver{})
+    // the scoreboard and the lobby update still follow
+    for {
+	if _, err := reader1.ReadString('\n'); err != nil {
+	    break
+	}
+    }
+    if s.Stats().Running {
+	t.Fatal("Server should shut down after the game")
+    }
+}
+
+// Messages after the connect message should be compressed in both directions
+func TestServerCompression(t *testing.T) {
+    const port = "8811"
+    startServerWithConfig(t, port, Config{Compression: FlateCompression})
+    conn := dial(t, port)
+    defer conn.Close()
+    raw := bufio.NewReader(conn)
+    connect := &jsontypes.ColorData{}
+    receiveType(t, raw, "connect", connect)
+    assertEqual(t, connect.Compression, FlateCompression, "")
+
+    writer, _ := flate.NewWriter(conn, flate.BestSpeed)
+    writer.Write([]byte(`{"type":"set_name","name":"alice"}` + "\n"))
+    writer.Flush()
+    reader := bufio.NewReader(flate.NewReader(raw))
+    name := &jsontypes.ColorData{}
+    receiveType(t, reader, "set_name", name)
+    assertEqual(t, name.Name, "alice", "")
+}
+
+// Batched events should be sent to everyone with the next tick
+func TestServerBatchEvents(t *testing.T) {
+    const port = "8812"
+    startServerWithConfig(t, port, Config{BatchEvents: true, CountdownSeconds: -1})
+    conn1, reader1, conn2, reader2 := startTwoPlayerGame(t, port)
+    defer conn1.Close()
+    defer conn2.Close()
+
+    sendMessage(t, conn1, `{"type":"player_event","event":{"direction":"up"}}`)
+    sendMessage(t, conn1, `{"type":"start"}`)
+    for _, reader := range []*bufio.Reader{reader1, reader2} {
+	events := &jsontypes.Events{}
+	receiveType(t, reader, "events", events)
+	assertEqual(t, events.Tick, 1, "Events should be sent with the first tick")
+	assertEqual(t, len(events.Events), 1, "")
+	assertEqual(t, events.Events[0].Event.Direction, "up", "")
+	tick := &jsontypes.Tick{}
+	receiveType(t, reader, "tick", tick)
+	assertEqual(t, tick.N, 1, "Events should precede their tick")
+    }
+}
+
+// Clients should join only after authenticating
+func TestServerAuth(t *testing.T) {
+    const port = "8813"
+    s := startServerWithConfig(t, port, Config{Authenticator: SharedSecret("s3cret"),
+	AuthTimeout: 200 * time.Millisecond})
+    defer s.Stop()
+    conn1 := dial(t, port)
+    defer conn1.Close()
+    reader1 := bufio.NewReader(conn1)
+    // messages right after the auth message should not be lost
+    sendMessage(t, conn1, `{"type":"auth","token":"s3cret"}` + "\n" + `{"type":"set_name","name":"alice"}`)
+    receiveType(t, reader1, "connect", &jsontypes.ColorData{})
+    name := &jsontypes.ColorData{}
+    receiveType(t, reader1, "set_name", name)
+    assertEqual(t, name.Name, "alice", "")
+
+    for _, message := range []string{`{"type":"auth","token":"guess"}`, `{"type":"ready"}`, ""} {
+	conn := dial(t, port)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	if message != "" {
+	    sendMessage(t, conn, message)
+	}
+	errorData := &jsontypes.ErrorData{}
+	receiveType(t, reader, "error", errorData)
+	assertEqual(t, errorData.Code, "UNAUTHORIZED", message)
+	if _, err := reader.ReadString('\n'); err == nil {
+	    t.Fatalf("Connection should be closed after %s", message)
+	}
+    }
+}
+
+// Messages after the connect message should be prefixed with their length
+func TestServerLengthPrefixedFraming(t *testing.T) {
+    const port = "8814"
+    startServerWithConfig(t, port, Config{Framing: LengthPrefixedFraming})
+    conn := dial(t, port)
+    defer conn.Close()
+    reader := bufio.NewReader(conn)
+    connect := &jsontypes.ColorData{}
+    receiveType(t, reader, "connect", connect)
+    assertEqual(t, connect.Framing, LengthPrefixedFraming, "")
+
+    message := `{"type":"set_name","name":"al\nice"}`
+    header := make([]byte, 4)
+    binary.BigEndian.PutUint32(header, uint32(len(message)))
+    conn.Write(append(header, message...))
+    for {
+	if _, err := io.ReadFull(reader, header); err != nil {
+	    t.Fatalf("Cannot read header: %s", err.Error())
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(header))
+	if _, err := io.ReadFull(reader, payload); err != nil {
+	    t.Fatalf("Cannot read payload: %s", err.Error())
+	}
+	name := &jsontypes.ColorData{}
+	if json.Unmarshal(payload, name) == nil && name.Type == "set_name" {
+	    assertEqual(t, name.Name, "alice", "Newline in the name should be removed")
+	    return
+	}
+    }
+}
+
+// Relayed events should be marshalled with the color of the sender
+func TestServerRelayedEventColor(t *testing.T) {
+    const port = "8815"
+    startServer(t, port)
+    conn1, reader1, conn2, reader2 := startTwoPlayerGame(t, port)
+    defer conn1.Close()
+    defer conn2.Close()
+
+    sendMessage(t, conn2, `{"type":"player_event","color":"\"#000000","event":{"direction":"up"}}`)
+    event := &jsontypes.GameData{}
+    receiveType(t, reader1, "player_event", event)
+    sendMessage(t, conn1, `{"type":"player_event","event":{"direction":"up"}}`)
+    own := &jsontypes.GameData{}
+    receiveType(t, reader2, "player_event", own)
+    if event.Color == own.Color || event.Color == `"#000000` {
+	t.Fatalf("Event should have the color of the sender, got %s", event.Color)
+    }
+    assertColorFormat(t, event.Color)
+}
+
+// Messages of the embedder should be delivered to every client
+func TestServerBroadcast(t *testing.T) {
+    const port = "8816"
+    assertEqual(t, Create().Broadcast(map[string]string{}) != nil, true,
+	"Broadcasting on a server which is not started should fail")
+    s := startServer(t, port)
+    conn1, reader1, conn2, reader2 := connectPlayers(t, port)
+    defer conn1.Close()
+    defer conn2.Close()
+
+    if err := s.Broadcast(make(chan int)); err == nil {
+	t.Fatal("Message which cannot be marshalled should be refused")
+    }
+    announcement := map[string]string{"type": "announcement", "message": "restarting in 5 minutes"}
+    if err := s.Broadcast(announcement); err != nil {
+	t.Fatalf("Broadcast failed: %s", err.Error())
+    }
+    for _, reader := range []*bufio.Reader{reader1, reader2} {
+	received := map[string]string{}
+	receiveType(t, reader, "announcement", &received)
+	assertEqual(t, received["message"], announcement["message"], "")
+    }
+}
+
+// Round trip times of the pings should be reported and announced in the lobby
+func TestServerLatency(t *testing.T) {
+    const port = "8817"
+    s := startServerWithConfig(t, port, Config{PingInterval: 20 * time.Millisecond, LatencyInterval: time.Hour})
+    defer s.Stop()
+    conn1 := dial(t, port)
+    defer conn1.Close()
+    reader1 := bufio.NewReader(conn1)
+    connect := &jsontypes.ColorData{}
+    receiveType(t, reader1, "connect", connect)
+    receiveType(t, reader1, "ping", &jsontypes.SimpleData{})
+    sendMessage(t, conn1, `{"type":"pong"}`)
+
+    latency := &jsontypes.Latency{}
+    receiveType(t, reader1, "latency", latency)
+    assertEqual(t, latency.Color, connect.Color, "")
+    if _, ok := s.Stats().Rooms[0].Latencies[connect.Color]; !ok {
+	t.Fatal("Latency should be reported by Stats")
+    }
+
+    // the next announcement is due in an hour
+    receiveType(t, reader1, "ping", &jsontypes.SimpleData{})
+    sendMessage(t, conn1, `{"type":"pong"}`)
+    for pings := 0; pings < 2; {
+	msg, err := reader1.ReadString('\n')
+	if err != nil {
+	    t.Fatal("Cannot read message")
+	}
+	if strings.Contains(msg, `"latency"`) {
+	    t.Fatal("Latency should not be announced more than once per interval")
+	}
+	if strings.Contains(msg, `"ping"`) {
+	    pings++
+	}
+    }
+}
+
+// Players asking for a rematch should play again, the others should leave
+func TestServerRematch(t *testing.T) {
+    const port = "8818"
+    startServerWithConfig(t, port, Config{TickInterval: 5 * time.Millisecond, CountdownSeconds: -1,
+	RematchTimeout: 300 * time.Millisecond})
+    conn1, reader1, conn2, reader2 := connectPlayers(t, port)
+    defer conn1.Close()
+    defer conn2.Close()
+    sendMessage(t, conn1, `{"type":"rematch"}`)
+    errorData := &jsontypes.ErrorData{}
+    receiveType(t, reader1, "error", errorData)
+    assertEqual(t, errorData.Code, "REMATCH_UNAVAILABLE", "No game to rematch yet")
+    sendMessage(t, conn1, `{"type":"ready"}`)
+    sendMessage(t, conn2, `{"type":"ready"}`)
+
+    playToEnd := func() {
+	receiveType(t, reader1, "start_game", &jsontypes.StartGame{})
+	receiveType(t, reader2, "start_game", &jsontypes.StartGame{})
+	// player 1 drives into the wall
+	sendMessage(t, conn1, `{"type":"player_event","event":{"direction":"up"}}`)
+	sendMessage(t, conn1, `{"type":"start"}`)
+	receiveType(t, reader1, "game_over", &jsontypes.GameOver{})
+	receiveType(t, reader2, "game_over", &jsontypes.GameOver{})
+    }
+    playToEnd()
+    sendMessage(t, conn1, `{"type":"rematch"}`)
+    sendMessage(t, conn2, `{"type":"rematch"}`)
+    playToEnd()
+
+    sendMessage(t, conn1, `{"type":"rematch"}`)
+    left := &jsontypes.PlayerLeft{}
+    receiveType(t, reader1, "player_left", left)
+    assertEqual(t, left.Reason, "rematch_timeout", "")
+    connect := &jsontypes.ColorData{}
+    receiveType(t, reader2, "connect", connect)
+    assertEqual(t, connect.Room, "", "Player should be moved to the default room")
+}
+
+// A single player should be able to practice if the minimum allows it
+func TestServerMinPlayers(t *testing.T) {
+    const port = "8819"
+    startServerWithConfig(t, port, Config{MinPlayers: 1, TickInterval: 5 * time.Millisecond,
+	CountdownSeconds: -1})
+    conn := dial(t, port)
+    defer conn.Close()
+    reader := bufio.NewReader(conn)
+    connect := &jsontypes.ColorData{}
+    receiveType(t, reader, "connect", connect)
+    sendMessage(t, conn, `{"type":"ready"}`)
+    startGame := &jsontypes.StartGame{}
+    receiveType(t, reader, "start_game", startGame)
+    assertEqual(t, len(startGame.Colors), 1, "")
+
+    sendMessage(t, conn, `{"type":"start"}`)
+    dead := &jsontypes.PlayerDead{}
+    receiveType(t, reader, "player_dead", dead)
+    assertEqual(t, dead.Color, connect.Color, "Game should go on until the car crashes")
+    receiveType(t, reader, "game_over", &jsontypes.GameOver{})
+}
+
+// Spectators joining during the game should get the state of the board
+func TestServerGameState(t *testing.T) {
+    const port = "8820"
+    startServerWithConfig(t, port, Config{CountdownSeconds: -1})
+    conn1, reader1, conn2, _ := startTwoPlayerGame(t, port)
+    defer conn1.Close()
+    defer conn2.Close()
+    sendMessage(t, conn1, `{"type":"start"}`)
+    tick := &jsontypes.Tick{}
+    for tick.N < 3 {
+	receiveType(t, reader1, "tick", tick)
+    }
+
+    conn3 := dial(t, port)
+    defer conn3.Close()
+    reader3 := bufio.NewReader(conn3)
+    receiveType(t, reader3, "connect", &jsontypes.ColorData{})
+    sendMessage(t, conn3, `{"type":"spectate","room":"game-1"}`)
+    state := &jsontypes.State{}
+    receiveType(t, reader3, "state", state)
+    if state.Tick < 3 {
+	t.Fatalf("State should be taken after tick 3, got tick %d", state.Tick)
+    }
+    assertEqual(t, len(state.Cars), 2, "")
+    for _, car := range state.Cars {
+	assertEqual(t, car.Alive, true, "")
+	assertEqual(t, len(car.Trail), state.Tick + 1, "Trail should cover the spawn and every step")
+	found := false
+	for _, cell := range car.Trail {
+	    found = found || cell.X == car.X && cell.Y == car.Y
+	}
+	assertEqual(t, found, true, "Trail should contain the cell of the car")
+    }
+}
+
+// Players should choose their teams in the lobby
+func TestServerTeams(t *testing.T) {
+    const port = "8821"
+    startServerWithConfig(t, port, Config{Teams: 2})
+    conn1, reader1, conn2, reader2 := connectPlayers(t, port)
+    defer conn1.Close()
+    defer conn2.Close()
+
+    sendMessage(t, conn1, `{"type":"set_team","team":2}`)
+    errorData := &jsontypes.ErrorData{}
+    receiveType(t, reader1, "error", errorData)
+    assertEqual(t, errorData.Code, "BAD_MESSAGE", "")
+    sendMessage(t, conn2, `{"type":"set_team","team":0}`)
+    update := &jsontypes.LobbyUpdate{}
+    for len(update.Players) != 2 || *update.Players[1].Team != 0 {
+	receiveType(t, reader1, "lobby_update", update)
+    }
+    assertEqual(t, *update.Players[0].Team, 0, "")
+
+    sendMessage(t, conn1, `{"type":"ready"}`)
+    sendMessage(t, conn2, `{"type":"ready"}`)
+    startGame := &jsontypes.StartGame{}
+    receiveType(t, reader2, "start_game", startGame)
+    assertEqual(t, len(startGame.Teams), 2, "")
+    for _, member := range startGame.Teams {
+	assertEqual(t, member.Team, 0, "")
+    }
+}
+
+// Failing accepts should not pass connections to the broker
+func TestServerAcceptError(t *testing.T) {
+    s := Create()
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+	t.Fatalf("Cannot listen: %s", err.Error())
+    }
+    stopped := make(chan bool)
+    go func() {
+	s.acceptConnections(l)
+	close(stopped)
+    }()
+    l.Close()
+    select {
+    case <-stopped:
+    case <-time.After(time.Second):
+	t.Fatal("Accepting should stop when the listener is closed")
+    }
+    select {
+    case c := <-s.conns:
+	t.Fatalf("No connection should be passed to the broker, got %v", c)
+    default:
+    }
+}
+
+// Clients should be able to list the rooms
+func TestServerListRooms(t *testing.T) {
+    const port = "8822"
+    s := startServerWithConfig(t, port, Config{CountdownSeconds: -1})
+    conn1, reader1, conn2, _ := startTwoPlayerGame(t, port)
+    defer conn1.Close()
+    defer conn2.Close()
+    sendMessage(t, conn1, `{"type":"start"}`)
+    receiveType(t, reader1, "tick", &jsontypes.Tick{})
+
+    conn3 := dial(t, port)
+    defer conn3.Close()
+    reader3 := bufio.NewReader(conn3)
+    receiveType(t, reader3, "connect", &jsontypes.ColorData{})
+    sendMessage(t, conn3, `{"type":"list_rooms"}`)
+    list := &jsontypes.RoomList{}
+    receiveType(t, reader3, "room_list", list)
+    if len(list.Rooms) == 0 {
+	t.Fatal("Room list should not be empty")
+    }
+    var game *jsontypes.RoomEntry
+    for i := range list.Rooms {
+	if list.Rooms[i].Id == "game-1" {
+	    game = &list.Rooms[i]
+	}
+    }
+    if game == nil {
+	t.Fatalf("Room list should contain the game, got %v", list.Rooms)
+    }
+    assertEqual(t, game.Players, 2, "")
+    assertEqual(t, game.Phase, "game", "")
+    assertEqual(t, game.Joinable, false, "")
+
+    rooms := s.Rooms()
+    assertEqual(t, len(rooms), len(list.Rooms), "")
+    for i, info := range rooms {
+	assertEqual(t, info.Id, list.Rooms[i].Id, "")
+    }
+}
+
+// Expired trails should be announced to the clients
+func TestServerTrailExpire(t *testing.T) {
+    const port = "8823"
+    startServerWithConfig(t, port, Config{CountdownSeconds: -1, TrailTTL: 2})
+    conn1, reader1, conn2, _ := startTwoPlayerGame(t, port)
+    defer conn1.Close()
+    defer conn2.Close()
+    sendMessage(t, conn1, `{"type":"start"}`)
+    expire := &jsontypes.TrailExpire{}
+    receiveType(t, reader1, "trail_expire", expire)
+    assertColorFormat(t, expire.Color)
+}
+
+// Servers with the same seed should generate the same board
+func TestServerSeed(t *testing.T) {
+    var layouts [][]jsontypes.Point
+    for _, port := range []string{"8824", "8825"} {
+	startServerWithConfig(t, port, Config{Seed: 7, ObstacleLayout: RandomObstacles})
+	conn1, reader1, conn2, _ := connectPlayers(t, port)
+	defer conn1.Close()
+	defer conn2.Close()
+	sendMessage(t, conn1, `{"type":"ready"}`)
+	sendMessage(t, conn2, `{"type":"ready"}`)
+	startGame := &jsontypes.StartGame{}
+	receiveType(t, reader1, "start_game", startGame)
+	if len(startGame.Obstacles) == 0 {
+	    t.Fatal("Random layout should place obstacles")
+	}
+	layouts = append(layouts, startGame.Obstacles)
+    }
+    assertEqual(t, len(layouts[0]), len(layouts[1]), "")
+    for i := range layouts[0] {
+	assertEqual(t, layouts[0][i], layouts[1][i], "")
+    }
+}
+
+// Connections over the maximum should be refused
+func TestServerMaxConnections(t *testing.T) {
+    const port = "8826"
+    const max = 3
+    startServerWithConfig(t, port, Config{MaxConnections: max})
+    for i := 0; i < max; i++ {
+	conn := dial(t, port)
+	defer conn.Close()
+	receiveType(t, bufio.NewReader(conn), "connect", &jsontypes.ColorData{})
+    }
+    conn := dial(t, port)
+    defer conn.Close()
+    errorData := &jsontypes.ErrorData{}
+    receiveType(t, bufio.NewReader(conn), "error", errorData)
+    assertEqual(t, errorData.Code, "SERVER_FULL", "")
+}
+
+// Players should be identified by their ids
+func TestServerPlayerIds(t *testing.T) {
+    const port = "8827"
+    startServer(t, port)
+    conn1 := dial(t, port)
+    defer conn1.Close()
+    reader1 := bufio.NewReader(conn1)
+    connect1 := &jsontypes.ColorData{}
+    receiveType(t, reader1, "connect", connect1)
+    conn2 := dial(t, port)
+    defer conn2.Close()
+    reader2 := bufio.NewReader(conn2)
+    connect2 := &jsontypes.ColorData{}
+    receiveType(t, reader2, "connect", connect2)
+    if connect1.PlayerId == nil || connect2.PlayerId == nil || *connect1.PlayerId == *connect2.PlayerId {
+	t.Fatalf("Players should get different ids, got %v and %v", connect1.PlayerId, connect2.PlayerId)
+    }
+
+    sendMessage(t, conn1, `{"type":"ready"}`)
+    sendMessage(t, conn2, `{"type":"ready"}`)
+    startGame := &jsontypes.StartGame{}
+    receiveType(t, reader1, "start_game", startGame)
+    assertEqual(t, len(startGame.PlayerIds), 2, "")
+    for i, color := range startGame.Colors {
+	if color == connect1.Color {
+	    assertEqual(t, startGame.PlayerIds[i], *connect1.PlayerId, "")
+	} else {
+	    assertEqual(t, startGame.PlayerIds[i], *connect2.PlayerId, "")
+	}
+    }
+
+    sendMessage(t, conn2, `{"type":"player_event","event":{"direction":"up"}}`)
+    event := &jsontypes.GameData{}
+    receiveType(t, reader1, "player_event", event)
+    if event.PlayerId == nil || *event.PlayerId != *connect2.PlayerId {
+	t.Fatalf("Event should have the id of the sender, got %v", event.PlayerId)
+    }
+}
+
+// Players leaving at the same time during the game should not block the server
+func TestServerSimultaneousDisconnects(t *testing.T) {
+    const port = "8828"
+    s := startServerWithConfig(t, port, Config{CountdownSeconds: -1, TickInterval: time.Millisecond})
+    conn1, reader1, conn2, _ := startTwoPlayerGame(t, port)
+    sendMessage(t, conn1, `{"type":"start"}`)
+    receiveType(t, reader1, "tick", &jsontypes.Tick{})
+    go conn1.Close()
+    go conn2.Close()
+
+    // the broker has to handle both disconnects before answering
+    for i := 0; i < 100 && s.Stats().Clients > 0; i++ {
+	time.Sleep(10 * time.Millisecond)
+    }
+    assertEqual(t, s.Stats().Clients, 0, "Both disconnects should be handled")
+    s.Stop()
+    select {
+    case <-s.done:
+    case <-time.After(time.Second):
+	t.Fatal("Server should shut down")
+    }
+}
+
+// Game messages should carry timestamps if configured
+func TestServerTimestamps(t *testing.T) {
+    const port = "8829"
+    startServerWithConfig(t, port, Config{CountdownSeconds: -1, Timestamps: true})
+    conn1, reader1, conn2, reader2 := connectPlayers(t, port)
+    defer conn1.Close()
+    defer conn2.Close()
+    sendMessage(t, conn1, `{"type":"ready"}`)
+    sendMessage(t, conn2, `{"type":"ready"}`)
+    startGame := &jsontypes.StartGame{}
+    receiveType(t, reader1, "start_game", startGame)
+    if startGame.Ts == nil || *startGame.Ts != 0 {
+	t.Fatalf("Start game should have the timestamp 0, got %v", startGame.Ts)
+    }
+    receiveType(t, reader2, "start_game", &jsontypes.StartGame{})
+
+    sendMessage(t, conn1, `{"type":"start"}`)
+    first := &jsontypes.Tick{}
+    receiveType(t, reader1, "tick", first)
+    second := &jsontypes.Tick{}
+    receiveType(t, reader1, "tick", second)
+    if first.Ts == nil || second.Ts == nil || *second.Ts <= *first.Ts {
+	t.Fatalf("Ticks should have increasing timestamps, got %v and %v", first.Ts, second.Ts)
+    }
+    sendMessage(t, conn1, `{"type":"player_event","event":{"direction":"up"}}`)
+    event := &jsontypes.GameData{}
+    receiveType(t, reader2, "player_event", event)
+    if event.Ts == nil || *event.Ts < *second.Ts {
+	t.Fatalf("Event should have a timestamp after the ticks, got %v", event.Ts)
+    }
+}
+
+// lockedBuffer collects the log of a server, which is written from several
+// goroutines.
+type lockedBuffer struct {
+    mu sync.Mutex
+    buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.buf.String()
+}
+
+// Players should be able to leave without a read error
+func TestServerLeave(t *testing.T) {
+    const port = "8830"
+    log := &lockedBuffer{}
+    startServerWithConfig(t, port, Config{Logger: slog.New(slog.NewTextHandler(log, nil))})
+    conn1, reader1, conn2, reader2 := connectPlayers(t, port)
+    defer conn1.Close()
+    defer conn2.Close()
+
+    sendMessage(t, conn1, `{"type":"leave"}`)
+    left := &jsontypes.PlayerLeft{}
+    receiveType(t, reader2, "player_left", left)
+    assertEqual(t, left.Reason, "left", "")
+    for {
+	if _, err := reader1.ReadString('\n'); err != nil {
+	    break
+	}
+    }
+    for i := 0; i < 100 && !strings.Contains(log.String(), "Serving client stopped"); i++ {
+	time.Sleep(10 * time.Millisecond)
+    }
+    if strings.Contains(log.String(), "Error while reading") {
+	t.Fatalf("Leaving should not be logged as a read error, got %s", log.String())
+    }
+}
+
+// Power-ups should only be announced to clients supporting them
+func TestServerFeatures(t *testing.T) {
+    const port = "8831"
+    startServerWithConfig(t, port, Config{CountdownSeconds: -1, PowerUpInterval: 1})
+    conn1 := dial(t, port)
+    defer conn1.Close()
+    reader1 := bufio.NewReader(conn1)
+    connect := &jsontypes.ColorData{}
+    receiveType(t, reader1, "connect", connect)
+    found := false
+    for _, feature := range connect.Features {
+	found = found || feature == PowerUpsFeature
+    }
+    assertEqual(t, found, true, "Server should advertise power-ups")
+    conn2 := dial(t, port)
+    defer conn2.Close()
+    reader2 := bufio.NewReader(conn2)
+    receiveType(t, reader2, "connect", &jsontypes.ColorData{})
+    sendMessage(t, conn1, fmt.Sprintf(`{"type":"hello","protocol":%d,"features":[]}`, ProtocolVersion))
+    sendMessage(t, conn2, fmt.Sprintf(`{"type":"hello","protocol":%d,"features":["powerups"]}`, ProtocolVersion))
+
+    sendMessage(t, conn1, `{"type":"ready"}`)
+    sendMessage(t, conn2, `{"type":"ready"}`)
+    receiveType(t, reader1, "start_game", &jsontypes.StartGame{})
+    sendMessage(t, conn1, `{"type":"start"}`)
+    receiveType(t, reader2, "powerup_spawn", &jsontypes.PowerUpSpawn{})
+    tick := &jsontypes.Tick{}
+    for tick.N < 3 {
+	line, err := reader1.ReadString('\n')
+	if err != nil {
+	    t.Fatalf("Cannot read: %s", err.Error())
+	}
+	if strings.Contains(line, "powerup_spawn") {
+	    t.Fatal("Power-ups should not be sent to clients without the feature")
+	}
+	json.Unmarshal([]byte(line), tick)
+    }
+}
+
+// Hello without protocol should be enough to list the features
+func TestServerFeaturesOnlyHello(t *testing.T) {
+    const port = "8853"
+    startServerWithConfig(t, port, Config{CountdownSeconds: -1, PowerUpInterval: 1})
+    conn1, reader1, conn2, reader2 := connectPlayers(t, port)
+    defer conn1.Close()
+    defer conn2.Close()
+    sendMessage(t, conn1, `{"type":"hello","features":["compression"]}`)
+
+    sendMessage(t, conn1, `{"type":"ready"}`)
+    sendMessage(t, conn2, `{"type":"ready"}`)
+    receiveType(t, reader1, "start_game", &jsontypes.StartGame{})
+    sendMessage(t, conn1, `{"type":"start"}`)
+    receiveType(t, reader2, "powerup_spawn", &jsontypes.PowerUpSpawn{})
+    tick := &jsontypes.Tick{}
+    for tick.N < 3 {
+	line, err := reader1.ReadString('\n')
+	if err != nil {
+	    t.Fatalf("Cannot read: %s", err.Error())
+	}
+	if strings.Contains(line, `"error"`) {
+	    t.Fatalf("Hello without protocol should be accepted, got %s", line)
+	}
+	if strings.Contains(line, "powerup_spawn") {
+	    t.Fatal("Power-ups should not be sent to clients without the feature")
+	}
+	json.Unmarshal([]byte(line), tick)
+    }
+}
+
+// The message of the day should follow the connect message
+func TestServerMOTD(t *testing.T) {
+    const port = "8832"
+    startServerWithConfig(t, port, Config{MOTD: "Welcome!"})
+    conn := dial(t, port)
+    defer conn.Close()
+    reader := bufio.NewReader(conn)
+    receiveType(t, reader, "connect", &jsontypes.ColorData{})
+    line, err := reader.ReadString('\n')
+    if err != nil {
+	t.Fatalf("Cannot read: %s", err.Error())
+    }
+    motd := &jsontypes.Motd{}
+    json.Unmarshal([]byte(line), motd)
+    assertEqual(t, motd.Type, "motd", "Message of the day should come right after connect")
+    assertEqual(t, motd.Message, "Welcome!", "")
+}
+
+// Long games should be decided in sudden death
+func TestServerSuddenDeath(t *testing.T) {
+    const port = "8833"
+    startServerWithConfig(t, port, Config{CountdownSeconds: -1, TickInterval: 10 * time.Millisecond,
+	MaxGameDuration: 20 * time.Millisecond})
+    conn1, reader1, conn2, _ := startTwoPlayerGame(t, port)
+    defer conn1.Close()
+    defer conn2.Close()
+    sendMessage(t, conn1, `{"type":"start"}`)
+    shrink := &jsontypes.Shrink{}
+    receiveType(t, reader1, "shrink", shrink)
+    assertEqual(t, shrink.Bounds, jsontypes.Bounds{X: 1, Y: 1, Width: 98, Height: 98}, "")
+    receiveType(t, reader1, "game_over", &jsontypes.GameOver{})
+}
+
+// Repeated ready messages should be announced once
+func TestServerDuplicateReady(t *testing.T) {
+    const port = "8834"
+    startServer(t, port)
+    conn1, _, conn2, reader2 := connectPlayers(t, port)
+    defer conn1.Close()
+    defer conn2.Close()
+    // skip the messages of connecting
+    sendMessage(t, conn1, `{"type":"chat","message":"sync"}`)
+    for chat := (&jsontypes.ChatData{}); chat.Message != "sync"; {
+	receiveType(t, reader2, "chat", chat)
+    }
+
+    sendMessage(t, conn1, `{"type":"ready"}`)
+    sendMessage(t, conn1, `{"type":"ready"}`)
+    sendMessage(t, conn1, `{"type":"chat","message":"done"}`)
+    updates := 0
+    for {
+	line, err := reader2.ReadString('\n')
+	if err != nil {
+	    t.Fatalf("Cannot read: %s", err.Error())
+	}
+	if strings.Contains(line, `"lobby_update"`) {
+	    updates++
+	}
+	if strings.Contains(line, `"done"`) {
+	    break
+	}
+    }
+    assertEqual(t, updates, 1, "Only the first ready should be announced")
+}
+
+// Servers started on port 0 should tell the port chosen
+func TestServerAddr(t *testing.T) {
+    s := Create()
+    if s.Addr() != nil {
+	t.Fatalf("Server should have no address before listening, got %s", s.Addr())
+    }
+    go s.StartAddr("127.0.0.1:0")
+    defer s.Stop()
+    for i := 0; i < 100 && s.Addr() == nil; i++ {
+	time.Sleep(10 * time.Millisecond)
+    }
+    if s.Addr() == nil {
+	t.Fatal("Server should have an address when listening")
+    }
+    conn, err := net.Dial("tcp", s.Addr().String())
+    if err != nil {
+	t.Fatalf("Cannot connect to %s: %s", s.Addr(), err.Error())
+    }
+    defer conn.Close()
+    conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+    receiveType(t, bufio.NewReader(conn), "connect", &jsontypes.ColorData{})
+}
+
+// Spectators over the limit should be refused
+func TestServerMaxSpectators(t *testing.T) {
+    const port = "8835"
+    startServerWithConfig(t, port, Config{MaxSpectatorsPerIP: 1})
+    conn1, reader1, conn2, reader2 := connectPlayers(t, port)
+    defer conn1.Close()
+    defer conn2.Close()
+    sendMessage(t, conn1, `{"type":"spectate"}`)
+    receiveType(t, reader1, "spectate", &jsontypes.RoomData{})
+    sendMessage(t, conn2, `{"type":"spectate"}`)
+    errorData := &jsontypes.ErrorData{}
+    receiveType(t, reader2, "error", errorData)
+    assertEqual(t, errorData.Code, "SPECTATORS_FULL", "")
+}
+
+// Players asking for a quick match should be matched in a new room
+func TestServerQuickMatch(t *testing.T) {
+    const port = "8838"
+    startServer(t, port)
+    conn1, reader1, conn2, reader2 := connectPlayers(t, port)
+    defer conn1.Close()
+    defer conn2.Close()
+    sendMessage(t, conn1, `{"type":"quick_match"}`)
+    sendMessage(t, conn2, `{"type":"quick_match"}`)
+    for _, reader := range []*bufio.Reader{reader1, reader2} {
+	matched := &jsontypes.Matched{}
+	receiveType(t, reader, "matched", matched)
+	assertEqual(t, matched.Room, "match-1", "")
+	assertEqual(t, len(matched.Players), 2, "")
+	receiveType(t, reader, "start_game", &jsontypes.StartGame{})
+    }
+}
+
+// Quick matches should not be put in a room created by a player
+func TestServerQuickMatchRoomIdTaken(t *testing.T) {
+    const port = "8855"
+    startServer(t, port)
+    conn := dial(t, port)
+    defer conn.Close()
+    reader := bufio.NewReader(conn)
+    receiveType(t, reader, "connect", &jsontypes.ColorData{})
+    sendMessage(t, conn, `{"type":"join_room","room":"match-1"}`)
+    receiveType(t, reader, "connect", &jsontypes.ColorData{})
+
+    conn1, reader1, conn2, reader2 := connectPlayers(t, port)
+    defer conn1.Close()
+    defer conn2.Close()
+    sendMessage(t, conn1, `{"type":"quick_match"}`)
+    sendMessage(t, conn2, `{"type":"quick_match"}`)
+    for _, reader := range []*bufio.Reader{reader1, reader2} {
+	matched := &jsontypes.Matched{}
+	receiveType(t, reader, "matched", matched)
+	assertEqual(t, matched.Room, "match-2", "")
+	assertEqual(t, len(matched.Players), 2, "")
+	receiveType(t, reader, "start_game", &jsontypes.StartGame{})
+    }
+}
+
+// A stalled quick match queue should be matched with bots
+func TestServerQuickMatchTimeout(t *testing.T) {
+    const port = "8839"
+    startServerWithConfig(t, port, Config{MatchSize: 3, MatchTimeout: 50 * time.Millisecond})
+    conn := dial(t, port)
+    defer conn.Close()
+    reader := bufio.NewReader(conn)
+    receiveType(t, reader, "connect", &jsontypes.ColorData{})
+    sendMessage(t, conn, `{"type":"quick_match"}`)
+    matched := &jsontypes.Matched{}
+    receiveType(t, reader, "matched", matched)
+    assertEqual(t, len(matched.Players), 2, "Match should be filled up with a bot")
+    receiveType(t, reader, "start_game", &jsontypes.StartGame{})
+}
+
+// Server should only shut down without players if configured so
+func TestServerShutdownWhenEmpty(t *testing.T) {
+    for _, c := range []struct {
+	port     string
+	shutdown bool
+    }{{"8840", false}, {"8841", true}} {
+	s := startServerWithConfig(t, c.port, Config{ShutdownWhenEmpty: c.shutdown})
+	conn := dial(t, c.port)
+	receiveType(t, bufio.NewReader(conn), "connect", &jsontypes.ColorData{})
+	sendMessage(t, conn, `{"type":"leave"}`)
+	conn.Close()
+	for i := 0; i < 100 && s.Stats().Running; i++ {
+	    time.Sleep(10 * time.Millisecond)
+	}
+	assertEqual(t, s.Stats().Running, !c.shutdown, "")
+	s.Stop()
+    }
+}
+
+// Players joining should get the last chat messages of the room
+func TestServerChatHistory(t *testing.T) {
+    const port = "8842"
+    startServerWithConfig(t, port, Config{ChatHistory: 2})
+    conn1, _, conn2, reader2 := connectPlayers(t, port)
+    defer conn1.Close()
+    defer conn2.Close()
+    for _, message := range []string{"one", "two", "three"} {
+	sendMessage(t, conn1, `{"type":"chat","message":"` + message + `"}`)
+    }
+    chat := &jsontypes.ChatData{}
+    for chat.Message != "three" {
+	receiveType(t, reader2, "chat", chat)
+    }
+    conn3 := dial(t, port)
+    defer conn3.Close()
+    history := &jsontypes.ChatHistory{}
+    receiveType(t, bufio.NewReader(conn3), "chat_history", history)
+    assertEqual(t, len(history.Messages), 2, "Only the last messages should be kept")
+    assertEqual(t, history.Messages[0].Message, "two", "")
+    assertEqual(t, history.Messages[1].Message, "three", "")
+    assertEqual(t, history.Messages[1].Color, chat.Color, "")
+}
+
+// Chat history should be kept when a game of the room is over
+func TestServerChatHistoryAfterGame(t *testing.T) {
+    const port = "8851"
+    startServerWithConfig(t, port, Config{ChatHistory: 2, CountdownSeconds: -1, TickInterval: 5 * time.Millisecond})
+    conn1, reader1, conn2, reader2 := connectPlayers(t, port)
+    defer conn1.Close()
+    defer conn2.Close()
+    sendMessage(t, conn1, `{"type":"chat","message":"gl"}`)
+    receiveType(t, reader2, "chat", &jsontypes.ChatData{})
+    sendMessage(t, conn1, `{"type":"ready"}`)
+    sendMessage(t, conn2, `{"type":"ready"}`)
+    receiveType(t, reader1, "start_game", &jsontypes.StartGame{})
+    sendMessage(t, conn1, `{"type":"start"}`)
+    receiveType(t, reader1, "game_over", &jsontypes.GameOver{})
+    receiveType(t, reader1, "lobby_update", &jsontypes.LobbyUpdate{})
+
+    // the room of the game is no longer the default room
+    conn3 := dial(t, port)
+    defer conn3.Close()
+    reader3 := bufio.NewReader(conn3)
+    receiveType(t, reader3, "connect", &jsontypes.ColorData{})
+    sendMessage(t, conn3, `{"type":"join_room","room":"game-1"}`)
+    history := &jsontypes.ChatHistory{}
+    receiveType(t, reader3, "chat_history", history)
+    assertEqual(t, len(history.Messages), 1, "History should survive the game")
+    assertEqual(t, history.Messages[0].Message, "gl", "")
+}
+
+// Dead players should spectate the rest of the game
+func TestServerYouDied(t *testing.T) {
+    const port = "8845"
+    startServerWithConfig(t, port, Config{CountdownSeconds: -1, TickInterval: 5 * time.Millisecond})
+    conn1, reader1, conn2, reader2 := connectPlayers(t, port)
+    defer conn1.Close()
+    defer conn2.Close()
+    conn3 := dial(t, port)
+    defer conn3.Close()
+    reader3 := bufio.NewReader(conn3)
+    receiveType(t, reader3, "connect", &jsontypes.ColorData{})
+    for _, c := range []net.Conn{conn1, conn2, conn3} {
+	sendMessage(t, c, `{"type":"ready"}`)
+    }
+    startGame := &jsontypes.StartGame{}
+    receiveType(t, reader1, "start_game", startGame)
+    receiveType(t, reader2, "start_game", &jsontypes.StartGame{})
+    // the first car drives into the top of the map long before the others
+    sendMessage(t, conn1, `{"type":"player_event","event":{"direction":"up"}}`)
+    sendMessage(t, conn1, `{"type":"start"}`)
+    receiveType(t, reader1, "you_died", &jsontypes.SimpleData{})
+    sendMessage(t, conn1, `{"type":"player_event","event":{"direction":"left"}}`)
+    receiveType(t, reader1, "tick", &jsontypes.Tick{})
+
+    dead := false
+    for {
+	line, err := reader2.ReadString('\n')
+	if err != nil {
+	    t.Fatalf("Cannot read: %s", err.Error())
+	}
+	data := &jsontypes.GameData{}
+	json.Unmarshal([]byte(line), data)
+	switch data.Type {
+	case "player_event":
+	    if dead && data.Color == startGame.Colors[0] {
+		t.Fatal("Events of dead players should not be relayed")
+	    }
+	case "player_dead":
+	    dead = dead || data.Color == startGame.Colors[0]
+	}
+	if data.Type == "game_over" {
+	    break
+	}
+    }
+    if !dead {
+	t.Fatal("First car should crash before the game is over")
+    }
+}
+
+// Clients watching replays should get the recorded game
+func TestServerPlayReplay(t *testing.T) {
+    const port = "8846"
+    s := startServer(t, port)
+    conn := dial(t, port)
+    defer conn.Close()
+    reader := bufio.NewReader(conn)
+    receiveType(t, reader, "connect", &jsontypes.ColorData{})
+    sendMessage(t, conn, `{"type":"watch_replay"}`)
+    spectate := &jsontypes.RoomData{}
+    receiveType(t, reader, "spectate", spectate)
+    assertEqual(t, spectate.Room, "replays", "")
+
+    winner := "#ff0000"
+    replay := jsontypes.Replay{Room: "game-1", Ticks: 2, Winner: &winner, TickInterval: 100,
+	Start: jsontypes.StartGame{Type: "start_game", Colors: []string{"#ff0000", "#00ff00"}},
+	Events: []jsontypes.ReplayEvent{{Tick: 1, Color: "#00ff00", Direction: "up"}}}
+    jsonByte, _ := json.Marshal(replay)
+    file := filepath.Join(t.TempDir(), "replay.json")
+    os.WriteFile(file, jsonByte, 0644)
+    if err := s.PlayReplay(file, 0); err == nil {
+	t.Fatal("Speed should be positive")
+    }
+    if err := s.PlayReplay(filepath.Join(t.TempDir(), "missing.json"), 1); err == nil {
+	t.Fatal("Missing replay should not be played")
+    }
+    start := time.Now()
+    if err := s.PlayReplay(file, 10); err != nil {
+	t.Fatalf("Cannot play replay: %s", err.Error())
+    }
+
+    startGame := &jsontypes.StartGame{}
+    receiveType(t, reader, "start_game", startGame)
+    assertEqual(t, strings.Join(startGame.Colors, ","), "#ff0000,#00ff00", "")
+    tick := &jsontypes.Tick{}
+    receiveType(t, reader, "tick", tick)
+    assertEqual(t, tick.N, 1, "")
+    event := &jsontypes.GameData{}
+    receiveType(t, reader, "player_event", event)
+    assertEqual(t, event.Color, "#00ff00", "")
+    assertEqual(t, event.Event.Direction, "up", "")
+    receiveType(t, reader, "tick", tick)
+    assertEqual(t, tick.N, 2, "Event should be played back before its tick")
+    if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+	t.Fatalf("Ticks should follow the scaled interval, got %s", elapsed)
+    }
+    gameOver := &jsontypes.GameOver{}
+    receiveType(t, reader, "game_over", gameOver)
+    assertEqual(t, *gameOver.Winner, winner, "")
+}
+
+// The host should choose the game mode of the room
+func TestServerGameModes(t *testing.T) {
+    const port = "8847"
+    startServerWithConfig(t, port, Config{Modes: map[string]GameMode{"walls": {ObstacleLayout: CrossObstacles}}})
+    conn1, reader1, conn2, reader2 := connectPlayers(t, port)
+    defer conn1.Close()
+    defer conn2.Close()
+
+    sendMessage(t, conn2, `{"type":"set_mode","mode":"classic"}`)
+    errorData := &jsontypes.ErrorData{}
+    receiveType(t, reader2, "error", errorData)
+    assertEqual(t, errorData.Code, "NOT_HOST", "")
+    sendMessage(t, conn1, `{"type":"set_mode","mode":"chess"}`)
+    receiveType(t, reader1, "error", errorData)
+    assertEqual(t, errorData.Code, "BAD_MESSAGE", "Unknown modes should be refused")
+
+    sendMessage(t, conn1, `{"type":"set_mode","mode":"walls"}`)
+    mode := &jsontypes.ModeData{}
+    receiveType(t, reader2, "set_mode", mode)
+    assertEqual(t, mode.Mode, "walls", "")
+    sendMessage(t, conn1, `{"type":"ready"}`)
+    sendMessage(t, conn2, `{"type":"ready"}`)
+    startGame := &jsontypes.StartGame{}
+    receiveType(t, reader2, "start_game", startGame)
+    assertEqual(t, startGame.Mode, "walls", "")
+    if len(startGame.Obstacles) == 0 {
+	t.Fatal("Settings of the mode should be applied")
+    }
+}
+
+// Clients should be told which entries are their own
+func TestServerYouAre(t *testing.T) {
+    const port = "8848"
+    startServer(t, port)
+    conn := dial(t, port)
+    defer conn.Close()
+    reader := bufio.NewReader(conn)
+    connect := &jsontypes.ColorData{}
+    receiveType(t, reader, "connect", connect)
+    if connect.YouAre == nil {
+	t.Fatal("Connect message should identify the recipient")
+    }
+    assertEqual(t, connect.YouAre.Color, connect.Color, "")
+    assertEqual(t, connect.YouAre.PlayerId, *connect.PlayerId, "")
+    update := &jsontypes.LobbyUpdate{}
+    receiveType(t, reader, "lobby_update", update)
+    assertEqual(t, update.Players[0].IsSelf, true, "Own entry should be marked")
+}
+
+// Messages should be traced in both directions
+func TestServerTrace(t *testing.T) {
+    const port = "8849"
+    file := filepath.Join(t.TempDir(), "trace.json")
+    startServerWithConfig(t, port, Config{Trace: true, TraceFile: file})
+    conn1, reader1, conn2, _ := connectPlayers(t, port)
+    defer conn1.Close()
+    defer conn2.Close()
+    sendMessage(t, conn2, `{"type":"chat","message":"traced"}`)
+    receiveType(t, reader1, "chat", &jsontypes.ChatData{})
+
+    content, err := os.ReadFile(file)
+    if err != nil {
+	t.Fatalf("Cannot read trace: %s", err.Error())
+    }
+    directions := make(map[string]bool)
+    for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+	entry := struct {
+	    Level     string
+	    Conn      string
+	    Direction string
+	    Message   string
+	}{}
+	if err := json.Unmarshal([]byte(line), &entry); err != nil {
+	    t.Fatalf("Malformed trace %s", line)
+	}
+	assertEqual(t, entry.Level, "DEBUG-4", "")
+	if strings.Contains(entry.Message, "traced") {
+	    directions[entry.Direction] = true
+	}
+	if entry.Direction == "in" && strings.Contains(entry.Message, "traced") {
+	    assertEqual(t, entry.Message, `{"type":"chat","message":"traced"}`, "Framing should not be traced")
+	}
+    }
+    assertEqual(t, directions["in"], true, "Received chat should be traced")
+    assertEqual(t, directions["out"], true, "Relayed chat should be traced")
+}
+
+// Long chat messages and chat floods should be refused
+func TestServerChatLimits(t *testing.T) {
+    const port = "8850"
+    startServerWithConfig(t, port, Config{MaxChatLength: 5, ChatRate: 2})
+    conn1, reader1, conn2, reader2 := connectPlayers(t, port)
+    defer conn1.Close()
+    defer conn2.Close()
+
+    sendMessage(t, conn1, `{"type":"chat","message":"too long"}`)
+    errorData := &jsontypes.ErrorData{}
+    receiveType(t, reader1, "error", errorData)
+    assertEqual(t, errorData.Code, "CHAT_TOO_LONG", "")
+    sendMessage(t, conn1, `{"type":"chat","message":"héllo"}`)
+    chat := &jsontypes.ChatData{}
+    receiveType(t, reader2, "chat", chat)
+    assertEqual(t, chat.Message, "héllo", "Length should be counted in characters")
+
+    for i := 0; i < 5; i++ {
+	sendMessage(t, conn1, `{"type":"chat","message":"spam"}`)
+    }
+    receiveType(t, reader1, "error", errorData)
+    assertEqual(t, errorData.Code, "RATE_LIMITED", "Chat flood should be limited")
+}
+
 // Server should not listen to new connections given game phase alredy started
 func TestServerListeningGamePhase(t *testing.T) {
     // TODO
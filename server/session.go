@@ -0,0 +1,89 @@
+package server
+
+import (
+	"crypto/rand"
+	"fmt"
+	"github.com/tron_server/jsontypes"
+	"time"
+)
+
+// holdExpiry is sent to the broker when the grace period of a disconnected
+// player is over.
+type holdExpiry struct {
+	token string
+	gen   int // number of the disconnect the grace period belongs to
+}
+
+// newToken returns a random UUID, which identifies a player when
+// reconnecting.
+func newToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// hold keeps the slot of a disconnected player for the grace period, so that
+// the player can reconnect.
+func (s *Server) hold(p *client) {
+	s.log.Info("Holding slot of player", "color", p.color, "period", s.cfg.ReconnectGracePeriod)
+	p.disconnected = true
+	p.disconnects++
+	expiry := holdExpiry{token: p.token, gen: p.disconnects}
+	time.AfterFunc(s.cfg.ReconnectGracePeriod, func() {
+		select {
+		case s.expired <- expiry:
+		case <-s.done:
+		}
+	})
+}
+
+// handleExpired removes the player if it did not reconnect in the grace
+// period.
+func (s *Server) handleExpired(e holdExpiry) {
+	p, ok := s.tokens[e.token]
+	if !ok || !p.disconnected || p.disconnects != e.gen {
+		return
+	}
+	s.log.Info("Player did not reconnect", "color", p.color)
+	s.removeClient(p)
+}
+
+// handleReconnect gives the slot of the disconnected player with the token to
+// the connection with the given id. The new connection leaves its room.
+func (s *Server) handleReconnect(connId int, p *client, token string) {
+	old, ok := s.tokens[token]
+	if !ok || !old.disconnected {
+		s.log.Warn("Invalid reconnect", "id", connId)
+		s.sendError(p.conn, jsontypes.CodeInvalidToken, "")
+		return
+	}
+	s.leaveRoom(p)
+	delete(s.tokens, p.token)
+
+	old.conn = p.conn
+	old.queue = p.queue
+	old.broken = false
+	old.compression = p.compression
+	old.framing = p.framing
+	if p.features != nil {
+		old.features = p.features
+	}
+	old.disconnected = false
+	// pongs of the lost connection cannot arrive anymore
+	old.missedPongs = 0
+	old.lastPong = time.Now()
+	old.pingSent = time.Time{}
+	s.clients[connId] = old
+	s.log.Info("Player reconnected", "color", old.color)
+
+	s.sendConnect(old)
+	if old.room.phase == phaseLobby {
+		if update := old.room.lobbyUpdate(old); update != "" {
+			s.write(old.conn, update)
+		}
+	} else {
+		s.sendState(old)
+	}
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"net"
+)
+
+// remoteIP returns the IP address the connection comes from.
+func remoteIP(c net.Conn) string {
+	addr := c.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// spectatorsFull tells whether the client cannot become a spectator, because
+// the server has MaxSpectators spectators already, or MaxSpectatorsPerIP of
+// them come from the IP address of the client. Every spectator gets every
+// message of its room, so they are limited separately from the connections.
+func (s *Server) spectatorsFull(p *client) bool {
+	if s.cfg.MaxSpectators <= 0 && s.cfg.MaxSpectatorsPerIP <= 0 {
+		return false
+	}
+	ip := remoteIP(p.conn)
+	total, fromIP := 0, 0
+	for _, r := range s.rooms {
+		for _, spectator := range r.spectators {
+			total++
+			if remoteIP(spectator.conn) == ip {
+				fromIP++
+			}
+		}
+	}
+	return s.cfg.MaxSpectators > 0 && total >= s.cfg.MaxSpectators ||
+		s.cfg.MaxSpectatorsPerIP > 0 && fromIP >= s.cfg.MaxSpectatorsPerIP
+}
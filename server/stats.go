@@ -0,0 +1,123 @@
+package server
+
+import (
+	"github.com/tron_server/jsontypes"
+	"sort"
+	"time"
+)
+
+// ServerStats is a snapshot of the state of the server, e.g. for health
+// checks.
+type ServerStats struct {
+	Running bool // whether the broker loop is running
+	Uptime  time.Duration
+	Clients int // number of connected players and spectators
+	Rooms   []RoomStats
+}
+
+// RoomStats is a snapshot of the state of a room.
+type RoomStats struct {
+	Id         string
+	Phase      string // "lobby" or "game"
+	Players    int
+	Spectators int
+	Ticking    bool // whether the game is started and the ticker is running
+	// Latencies contain the round trip time of the pings of the
+	// connected players, by color. Players who did not answer a ping yet
+	// are missing.
+	Latencies map[string]time.Duration
+	// Dropped contain the number of messages dropped for the connected
+	// players who are too slow, by color, see Config.SendQueuePolicy.
+	// Players without dropped messages are missing.
+	Dropped map[string]int64
+}
+
+// Stats returns a snapshot of the state of the server. The state is only
+// touched by the broker, so the snapshot is taken by the broker as well. A
+// server which is not running reports the zero value.
+func (s *Server) Stats() ServerStats {
+	if !s.started.IsSet() {
+		return ServerStats{}
+	}
+	reply := make(chan ServerStats, 1)
+	select {
+	case s.statsReqs <- reply:
+	case <-s.done:
+		return ServerStats{}
+	}
+	return <-reply
+}
+
+// handleStats sends a snapshot of the state to the requester.
+func (s *Server) handleStats(reply chan ServerStats) {
+	stats := ServerStats{
+		Running: true,
+		Uptime:  time.Since(s.startTime),
+		Clients: len(s.clients),
+		Rooms:   make([]RoomStats, 0, len(s.rooms)),
+	}
+	for _, r := range s.rooms {
+		latencies := make(map[string]time.Duration)
+		dropped := make(map[string]int64)
+		for _, p := range r.players {
+			if p.disconnected {
+				continue
+			}
+			if p.latency > 0 {
+				latencies[p.color] = p.latency
+			}
+			if p.queue != nil && p.queue.dropped.Load() > 0 {
+				dropped[p.color] = p.queue.dropped.Load()
+			}
+		}
+		stats.Rooms = append(stats.Rooms, RoomStats{Id: r.id, Phase: phaseNames[r.phase], Players: len(r.players),
+			Spectators: len(r.spectators), Ticking: r.ticking.IsSet(), Latencies: latencies, Dropped: dropped})
+	}
+	sort.Slice(stats.Rooms, func(i, j int) bool { return stats.Rooms[i].Id < stats.Rooms[j].Id })
+	reply <- stats
+}
+
+// RoomInfo describes a room for choosing one to join, e.g. in a server
+// browser.
+type RoomInfo struct {
+	Id       string
+	Players  int
+	Phase    string // "lobby" or "game"
+	Joinable bool   // whether new players can join the room
+}
+
+// Rooms returns the rooms of the server, ordered by id. The list is taken by
+// the broker, like Stats. A server which is not running has no rooms.
+func (s *Server) Rooms() []RoomInfo {
+	if !s.started.IsSet() {
+		return nil
+	}
+	reply := make(chan []RoomInfo, 1)
+	select {
+	case s.roomsReqs <- reply:
+	case <-s.done:
+		return nil
+	}
+	return <-reply
+}
+
+// roomInfos lists the rooms of the server, ordered by id.
+func (s *Server) roomInfos() []RoomInfo {
+	infos := make([]RoomInfo, 0, len(s.rooms))
+	for _, r := range s.rooms {
+		infos = append(infos, RoomInfo{Id: r.id, Players: len(r.players), Phase: phaseNames[r.phase],
+			Joinable: r.joinable()})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Id < infos[j].Id })
+	return infos
+}
+
+// handleListRooms sends the list of rooms to the client.
+func (s *Server) handleListRooms(p *client) {
+	list := jsontypes.RoomList{Type: "room_list", Rooms: make([]jsontypes.RoomEntry, 0, len(s.rooms))}
+	for _, info := range s.roomInfos() {
+		list.Rooms = append(list.Rooms, jsontypes.RoomEntry{Id: info.Id, Players: info.Players,
+			Phase: info.Phase, Joinable: info.Joinable})
+	}
+	s.sendMessage(p.conn, list)
+}
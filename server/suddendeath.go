@@ -0,0 +1,48 @@
+package server
+
+import (
+	"github.com/tron_server/jsontypes"
+	"sort"
+)
+
+// shrink removes the outermost ring of cells from the playable area, unless
+// it is as small as it gets already. Living cars left outside crash, their
+// ids are returned.
+func (g *game) shrink() []int {
+	if 2*(g.shrunk+1) < g.width && 2*(g.shrunk+1) < g.height {
+		g.shrunk++
+	}
+	dead := make([]int, 0)
+	for id, c := range g.cars {
+		if c.alive && !g.inside(c.pos) {
+			c.alive = false
+			dead = append(dead, id)
+		}
+	}
+	sort.Ints(dead)
+	return dead
+}
+
+// suddenDeath shrinks the map of games running longer than MaxGameDuration
+// every ShrinkInterval ticks, and announces the new bounds. Nothing is
+// announced once the map is as small as it gets. It returns the ids of the
+// players who crashed because of the shrinking.
+func (s *Server) suddenDeath(r *room) []int {
+	maxDuration := r.settings().MaxGameDuration
+	if maxDuration <= 0 {
+		return nil
+	}
+	start := int(maxDuration / s.cfg.TickInterval)
+	g := r.game
+	if g.ticks <= start || (g.ticks-start)%s.cfg.ShrinkInterval != 0 {
+		return nil
+	}
+	shrunk := g.shrunk
+	dead := g.shrink()
+	if g.shrunk == shrunk {
+		return dead
+	}
+	s.sendAll(r, jsontypes.Shrink{Type: "shrink", Bounds: jsontypes.Bounds{X: g.shrunk, Y: g.shrunk,
+		Width: g.width - 2*g.shrunk, Height: g.height - 2*g.shrunk}})
+	return dead
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"fmt"
+	"github.com/tron_server/jsontypes"
+	"sort"
+)
+
+// handleSetTeam moves the player to another team of the room.
+func (s *Server) handleSetTeam(p *client, team *int) {
+	if s.cfg.Teams == 0 {
+		s.sendError(p.conn, jsontypes.CodeBadMessage, "teams are disabled")
+		return
+	}
+	if *team < 0 || *team >= s.cfg.Teams {
+		s.log.Warn("Invalid team", "color", p.color, "team", *team)
+		s.sendError(p.conn, jsontypes.CodeBadMessage, fmt.Sprintf("team must be between 0 and %d", s.cfg.Teams-1))
+		return
+	}
+	p.team = *team
+	p.room.sendLobbyUpdate(-1)
+}
+
+// smallestTeam returns the team with the fewest players in the room, not
+// counting the given player. Ties are broken by the lowest team number.
+func (r *room) smallestTeam(except *client) int {
+	sizes := make([]int, r.server.cfg.Teams)
+	for _, p := range r.players {
+		if p != except {
+			sizes[p.team]++
+		}
+	}
+	smallest := 0
+	for team, size := range sizes {
+		if size < sizes[smallest] {
+			smallest = team
+		}
+	}
+	return smallest
+}
+
+// teammates tells whether the players with the given ids are different
+// players of the same team. Their cars do not crash into each other's trails.
+func (g *game) teammates(a, b int) bool {
+	if !g.teams || a == b {
+		return false
+	}
+	ca, cb := g.cars[a], g.cars[b]
+	return ca != nil && cb != nil && ca.team == cb.team
+}
+
+// aliveTeams returns the teams which have cars alive, in order.
+func (g *game) aliveTeams() []int {
+	alive := make(map[int]bool)
+	for _, c := range g.cars {
+		if c.alive {
+			alive[c.team] = true
+		}
+	}
+	teams := make([]int, 0, len(alive))
+	for team := range alive {
+		teams = append(teams, team)
+	}
+	sort.Ints(teams)
+	return teams
+}
+
+// teamCount returns the number of teams playing in the game.
+func (g *game) teamCount() int {
+	teams := make(map[int]bool)
+	for _, c := range g.cars {
+		teams[c.team] = true
+	}
+	return len(teams)
+}
+
+// teamGameOver credits a win to every player of the team left, and returns
+// the message announcing the team.
+func (s *Server) teamGameOver(r *room) jsontypes.TeamGameOver {
+	gameOver := jsontypes.TeamGameOver{Type: "game_over"}
+	if teams := r.game.aliveTeams(); len(teams) == 1 {
+		gameOver.WinningTeam = &teams[0]
+		for _, p := range r.players {
+			if c := r.game.cars[p.id]; c != nil && c.team == teams[0] {
+				r.scores[p.token]++
+			}
+		}
+	}
+	return gameOver
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeCertificate writes a self-signed certificate and its key to dir.
+func writeCertificate(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certFile, keyFile
+}
+
+func TestStartTLSInvalidCertificate(t *testing.T) {
+	dir := t.TempDir()
+	missing := filepath.Join(dir, "missing.pem")
+	if err := Create().StartTLS("8775", missing, missing); err == nil {
+		t.Fatal("StartTLS should fail without certificate")
+	}
+}
+
+func TestStartTLS(t *testing.T) {
+	const port = "8776"
+	certFile, keyFile := writeCertificate(t, t.TempDir())
+	s := Create()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- s.StartTLS(port, certFile, keyFile)
+	}()
+
+	var conn *tls.Conn
+	var err error
+	for i := 0; i < 50; i++ {
+		conn, err = tls.Dial("tcp", "localhost:"+port, &tls.Config{InsecureSkipVerify: true})
+		if err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("TLS connection failed: %s", err.Error())
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	msg, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || !strings.Contains(msg, `"connect"`) {
+		t.Fatalf("Connect message not received over TLS: %q", msg)
+	}
+	conn.Close()
+	s.Stop()
+
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Fatalf("StartTLS failed: %s", err.Error())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Server did not shut down")
+	}
+}
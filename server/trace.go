@@ -0,0 +1,41 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"os"
+)
+
+// LevelTrace is the level the messages are logged at, see Config.Trace. It is
+// below slog.LevelDebug, so the handler of the logger has to be configured
+// with it.
+const LevelTrace = slog.LevelDebug - 4
+
+// newTracer returns the logger of the messages, or nil if tracing is
+// disabled. Traces go to the trace file if one is configured, otherwise to
+// the logger of the server.
+func newTracer(cfg Config) (*slog.Logger, *os.File, error) {
+	if !cfg.Trace {
+		return nil, nil, nil
+	}
+	if cfg.TraceFile == "" {
+		return cfg.Logger, nil, nil
+	}
+	f, err := os.OpenFile(cfg.TraceFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	return slog.New(slog.NewJSONHandler(f, &slog.HandlerOptions{Level: LevelTrace})), f, nil
+}
+
+// trace logs the message sent to or received from the connection, with the
+// direction "out" or "in". Incoming messages are logged as they were read,
+// without their framing.
+func (s *Server) trace(c net.Conn, direction, msg string) {
+	if s.tracer == nil {
+		return
+	}
+	s.tracer.Log(context.Background(), LevelTrace, "Message", "conn", c.RemoteAddr().String(),
+		"direction", direction, "message", msg)
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"github.com/tron_server/jsontypes"
+)
+
+// trailCell is a cell of a trail, covered by the car of the player with id in
+// the given tick.
+type trailCell struct {
+	p    point
+	id   int
+	tick int
+}
+
+// cover marks the cell as covered by the trail of the player with the given
+// id in the current tick.
+func (g *game) cover(p point, id int) {
+	g.grid[p] = id
+	g.laid[p] = g.ticks
+	g.trail = append(g.trail, trailCell{p: p, id: id, tick: g.ticks})
+}
+
+// expireTrails removes the trail cells older than the TTL of the trails from
+// the grid. The removed cells are kept in expired until the next step. Cells
+// covered again since, e.g. by an invincible car, are removed only when the
+// newer trail expires.
+func (g *game) expireTrails() {
+	g.expired = g.expired[:0]
+	if g.trailTTL == 0 {
+		return
+	}
+	n := 0
+	for ; n < len(g.trail) && g.trail[n].tick <= g.ticks-g.trailTTL; n++ {
+		cell := g.trail[n]
+		// cells cleared by a power-up are gone already
+		if owner, ok := g.grid[cell.p]; !ok || owner != cell.id || g.laid[cell.p] != cell.tick {
+			continue
+		}
+		delete(g.grid, cell.p)
+		delete(g.laid, cell.p)
+		g.expired = append(g.expired, cell)
+	}
+	g.trail = g.trail[n:]
+}
+
+// sendExpired tells the clients which trail cells expired in the last step.
+func (s *Server) sendExpired(r *room) {
+	for _, cell := range r.game.expired {
+		s.sendAll(r, jsontypes.TrailExpire{Type: "trail_expire", Color: r.game.cars[cell.id].color,
+			X: cell.p.x, Y: cell.p.y})
+	}
+}
@@ -0,0 +1,247 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+// maxFrameSize limits the payload of a single incoming frame.
+const maxFrameSize = 1 << 20
+
+// StartWebSocket accepts WebSocket connections on the given port, in addition
+// to the TCP connections of Start. Each text frame carries newline delimited
+// JSON messages of the same protocol. WebSocket players share the rooms with
+// TCP players, their connections are handled by the broker loop of Start, so
+// Start has to be called as well. Browsers are only let in from the origins of
+// Config.AllowedOrigins. StartWebSocket returns after the listener is set up.
+func (s *Server) StartWebSocket(port string) error {
+	l, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		return err
+	}
+	s.wsListener = l
+	s.log.Info("Start hosting WebSocket server", "port", port)
+	go http.Serve(l, http.HandlerFunc(s.handleWebSocket))
+	return nil
+}
+
+// handleWebSocket upgrades the HTTP request to a WebSocket connection and
+// passes it to the broker, after authentication if it is configured.
+func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || key == "" ||
+		!headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "Not a WebSocket handshake", http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+		return
+	}
+	if origin := r.Header.Get("Origin"); !s.originAllowed(origin, r.Host) {
+		s.log.Warn("WebSocket origin not allowed", "origin", origin)
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Cannot upgrade connection", http.StatusInternalServerError)
+		return
+	}
+	c, rw, err := hijacker.Hijack()
+	if err != nil {
+		s.log.Error("Error while upgrading to WebSocket", "err", err)
+		return
+	}
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		c.Close()
+		return
+	}
+
+	if !s.reserveConn() {
+		s.refuseFull(&wsConn{Conn: c, reader: rw.Reader})
+		return
+	}
+	s.admit(&wsConn{Conn: &countedConn{Conn: c, server: s}, reader: rw.Reader})
+}
+
+// isWebSocket tells whether the connection is a WebSocket connection.
+func isWebSocket(c net.Conn) bool {
+	if b, ok := c.(*bufferedConn); ok {
+		c = b.Conn
+	}
+	_, ok := c.(*wsConn)
+	return ok
+}
+
+// originAllowed tells whether a browser on the origin may connect, see
+// Config.AllowedOrigins. Clients which are not browsers send no origin, they
+// are always allowed.
+func (s *Server) originAllowed(origin, host string) bool {
+	if origin == "" {
+		return true
+	}
+	if len(s.cfg.AllowedOrigins) == 0 {
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, host)
+	}
+	for _, allowed := range s.cfg.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func headerContains(h http.Header, name, value string) bool {
+	for _, v := range h.Values(name) {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func acceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// wsConn is a WebSocket connection usable as a plain net.Conn by the broker.
+// Reading returns the payload of the incoming data frames as a stream, each
+// frame terminated by a newline. Every Write is sent as one text frame.
+type wsConn struct {
+	net.Conn
+	reader  *bufio.Reader
+	pending []byte // payload not read yet
+	writeMu sync.Mutex
+	closed  bool
+}
+
+func (c *wsConn) Read(b []byte) (int, error) {
+	for len(c.pending) == 0 {
+		if c.closed {
+			return 0, io.EOF
+		}
+		if err := c.readFrame(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// readFrame reads the next frame. Payload of data frames is appended to the
+// pending data, control frames are answered.
+func (c *wsConn) readFrame() error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(c.reader, header); err != nil {
+		return err
+	}
+	fin := header[0]&0x80 != 0
+	opcode := header[0] & 0x0f
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err := io.ReadFull(c.reader, ext); err != nil {
+			return err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err := io.ReadFull(c.reader, ext); err != nil {
+			return err
+		}
+		length = binary.BigEndian.Uint64(ext)
+	}
+	if length > maxFrameSize {
+		return errors.New("WebSocket frame too large")
+	}
+	if !masked {
+		return errors.New("Unmasked WebSocket frame from client")
+	}
+	mask := make([]byte, 4)
+	if _, err := io.ReadFull(c.reader, mask); err != nil {
+		return err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	switch opcode {
+	case opText, opBinary, opContinuation:
+		c.pending = append(c.pending, payload...)
+		if fin && (len(c.pending) == 0 || c.pending[len(c.pending)-1] != '\n') {
+			c.pending = append(c.pending, '\n')
+		}
+	case opPing:
+		return c.writeFrame(opPong, payload)
+	case opClose:
+		c.closed = true
+		c.writeFrame(opClose, nil)
+	}
+	return nil
+}
+
+func (c *wsConn) Write(b []byte) (int, error) {
+	if err := c.writeFrame(opText, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	header := []byte{0x80 | opcode}
+	switch length := len(payload); {
+	case length < 126:
+		header = append(header, byte(length))
+	case length <= 0xffff:
+		header = append(header, 126, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(length))
+	default:
+		header = append(header, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(length))
+	}
+	if _, err := c.Conn.Write(append(header, payload...)); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/tron_server/jsontypes"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// wsDial opens a WebSocket connection to the server listening on port.
+func wsDial(t *testing.T, port string) (net.Conn, *bufio.Reader) {
+	var c net.Conn
+	var err error
+	for i := 0; i < 50; i++ {
+		if c, err = net.Dial("tcp", ":"+port); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal("connection failed.")
+	}
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	key := "dGhlIHNhbXBsZSBub25jZQ=="
+	c.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\n" +
+		"Connection: Upgrade\r\nSec-WebSocket-Key: " + key + "\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"))
+	reader := bufio.NewReader(c)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("Handshake failed: %s", err.Error())
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Unexpected handshake status: %d", resp.StatusCode)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatal("Wrong accept key")
+	}
+	return c, reader
+}
+
+// wsSend sends a masked text frame, as clients have to.
+func wsSend(c net.Conn, message string) {
+	mask := []byte{1, 2, 3, 4}
+	frame := []byte{0x81, 0x80 | byte(len(message))}
+	frame = append(frame, mask...)
+	for i := range message {
+		frame = append(frame, message[i]^mask[i%4])
+	}
+	c.Write(frame)
+}
+
+// wsReceive reads the payload of the next frame.
+func wsReceive(t *testing.T, reader *bufio.Reader) string {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		t.Fatalf("Cannot read frame: %s", err.Error())
+	}
+	length := int(header[1] & 0x7f)
+	if length == 126 {
+		ext := make([]byte, 2)
+		io.ReadFull(reader, ext)
+		length = int(binary.BigEndian.Uint16(ext))
+	}
+	payload := make([]byte, length)
+	io.ReadFull(reader, payload)
+	return string(payload)
+}
+
+func TestAcceptKey(t *testing.T) {
+	// example of RFC 6455
+	if k := acceptKey("dGhlIHNhbXBsZSBub25jZQ=="); k != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("Wrong accept key: %s", k)
+	}
+}
+
+// WebSocket and TCP players should share the lobby
+func TestServerWebSocket(t *testing.T) {
+	const port = "8773"
+	const wsPort = "8774"
+	s := startServer(t, port)
+	if err := s.StartWebSocket(wsPort); err != nil {
+		t.Fatalf("Cannot start WebSocket server: %s", err.Error())
+	}
+
+	wsConn, wsReader := wsDial(t, wsPort)
+	defer wsConn.Close()
+	colorData := &jsontypes.ColorData{}
+	if err := json.Unmarshal([]byte(wsReceive(t, wsReader)), colorData); err != nil {
+		t.Fatal("Malformed connect message")
+	}
+	if colorData.Type != "connect" {
+		t.Fatalf("Expected connect message, got %s", colorData.Type)
+	}
+
+	conn := dial(t, port)
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	receiveType(t, reader, "connect", &jsontypes.ColorData{})
+
+	wsSend(wsConn, `{"type":"chat","message":"hello from the browser"}`)
+	chatData := &jsontypes.ChatData{}
+	receiveType(t, reader, "chat", chatData)
+	if chatData.Message != "hello from the browser" {
+		t.Fatalf("Unexpected message: %s", chatData.Message)
+	}
+}
+
+func TestOriginAllowed(t *testing.T) {
+	tests := []struct {
+		allowed []string
+		origin  string
+		ok      bool
+	}{
+		{nil, "", true},
+		{nil, "http://localhost:8080", true},
+		{nil, "http://evil.com", false},
+		{[]string{"https://example.com"}, "https://example.com", true},
+		{[]string{"https://example.com"}, "HTTPS://EXAMPLE.COM", true},
+		{[]string{"https://example.com"}, "http://example.com", false},
+		{[]string{"https://example.com"}, "http://localhost:8080", false},
+		{[]string{"https://example.com"}, "", true},
+		{[]string{"*"}, "http://evil.com", true},
+	}
+	for _, test := range tests {
+		s, _ := CreateWithConfig(Config{AllowedOrigins: test.allowed})
+		if ok := s.originAllowed(test.origin, "localhost:8080"); ok != test.ok {
+			t.Fatalf("origin '%s' with %v: expected %v, got %v", test.origin, test.allowed, test.ok, ok)
+		}
+	}
+}
+
+// WebSocket connections of other origins should be refused
+func TestServerWebSocketOrigin(t *testing.T) {
+	const port = "8843"
+	const wsPort = "8844"
+	s := startServerWithConfig(t, port, Config{AllowedOrigins: []string{"https://example.com"}})
+	if err := s.StartWebSocket(wsPort); err != nil {
+		t.Fatalf("Cannot start WebSocket server: %s", err.Error())
+	}
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost:"+wsPort+"/", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Origin", "http://evil.com")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %s", err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected status 403, got %d", resp.StatusCode)
+	}
+}